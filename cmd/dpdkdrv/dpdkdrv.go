@@ -0,0 +1,370 @@
+package dpdkdrv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/shuoyanshen/qat_plugin/pkg/deviceplugin"
+	"github.com/shuoyanshen/qat_plugin/pkg/hostroot"
+)
+
+const (
+	vfioPci = "vfio-pci"
+
+	vendorIntel = "8086"
+
+	vfioDevicePath     = "/dev/vfio"
+	vfioCtrlDevicePath = "/dev/vfio/vfio"
+
+	genericResource = "generic"
+
+	// scanRetryMin is the delay before the first retry of a failed scan.
+	// It doubles with every failed retry up to the scan interval.
+	scanRetryMin = time.Second
+)
+
+var (
+	// QAT VF PCI device ID -> kernel QAT VF driver.
+	qatDeviceDriver = map[string]string{
+		"0443": "dh895xccvf",
+		"19e3": "c3xxxvf",
+		"37c9": "c6xxvf",
+		"4941": "4xxxvf",
+		"4943": "4xxxvf",
+		"6f55": "d15xxvf",
+	}
+
+	// cfg_services value of a gen4 PF -> resource name of its VFs.
+	servicesResource = map[string]string{
+		"sym;asym": "cy",
+		"asym;sym": "cy",
+		"sym;dc":   "sym-dc",
+		"dc;sym":   "sym-dc",
+		"asym;dc":  "asym-dc",
+		"dc;asym":  "asym-dc",
+		"sym":      "sym",
+		"asym":     "asym",
+		"dc":       "dc",
+	}
+)
+
+// DevicePlugin represents vfio-pci based QAT plugin.
+type DevicePlugin struct {
+	root            hostroot.Root
+	pciDriverDir    string
+	pciDeviceDir    string
+	kernelVfDrivers []string
+	maxDevices      int
+	rebind          bool
+	splitServices   bool
+	scanInterval    time.Duration
+}
+
+// NewDevicePlugin returns new instance of vfio-pci based QAT plugin.
+// root locates the host sysfs and device nodes, the device nodes are still
+// advertised with their host paths.
+// VFs bound to one of kernelVfDrivers are rebound to vfio-pci if rebind is set.
+// If splitServices is set, VFs are advertised by the services configured on
+// their PF instead of as generic resources.
+func NewDevicePlugin(root hostroot.Root, maxDevices int, kernelVfDrivers []string, rebind, splitServices bool, scanInterval time.Duration) *DevicePlugin {
+	return &DevicePlugin{
+		root:            root,
+		pciDriverDir:    root.Sys("bus", "pci", "drivers"),
+		pciDeviceDir:    root.Sys("bus", "pci", "devices"),
+		kernelVfDrivers: kernelVfDrivers,
+		maxDevices:      maxDevices,
+		rebind:          rebind,
+		splitServices:   splitServices,
+		scanInterval:    scanInterval,
+	}
+}
+
+// Scan implements Scanner interface for vfio-pci based QAT plugin. Failed
+// scans are retried with backoff while the last good device tree stays
+// published.
+func (dp *DevicePlugin) Scan(ctx context.Context, notifier dpapi.Notifier) error {
+	backoff := dp.retryMin()
+
+	for {
+		wait := dp.scanInterval
+
+		devTree, err := dp.scan()
+		if err == nil {
+			backoff = dp.retryMin()
+
+			notifier.Notify(devTree)
+		} else {
+			klog.ErrorS(err, "Device scan failed", "retryIn", backoff)
+
+			wait = backoff
+
+			if backoff *= 2; backoff > dp.scanInterval {
+				backoff = dp.scanInterval
+			}
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// retryMin returns the delay before the first retry of a failed scan, which
+// is never longer than the scan interval.
+func (dp *DevicePlugin) retryMin() time.Duration {
+	if dp.scanInterval < scanRetryMin {
+		return dp.scanInterval
+	}
+
+	return scanRetryMin
+}
+
+func (dp *DevicePlugin) scan() (dpapi.DeviceTree, error) {
+	devTree := dpapi.NewDeviceTree()
+
+	vfBdfs, err := dp.getQatVFs()
+	if err != nil {
+		return nil, err
+	}
+
+	n := 0
+
+	for _, vfBdf := range vfBdfs {
+		if n >= dp.maxDevices {
+			break
+		}
+
+		bound, err := dp.ensureVfioPci(vfBdf)
+		if err != nil {
+			klog.Warningf("Unable to bind %s to %s: %+v", vfBdf, vfioPci, err)
+			continue
+		}
+
+		if !bound {
+			continue
+		}
+
+		group, err := dp.getIOMMUGroup(vfBdf)
+		if err != nil {
+			return nil, err
+		}
+
+		resource, err := dp.getResourceName(vfBdf)
+		if err != nil {
+			return nil, err
+		}
+
+		devs := []pluginapi.DeviceSpec{
+			newDeviceSpec(filepath.Join(vfioDevicePath, group)),
+			newDeviceSpec(vfioCtrlDevicePath),
+		}
+
+		envs := map[string]string{
+			fmt.Sprintf("QAT%d", n): vfBdf,
+		}
+
+		devTree.AddDevice(resource, vfBdf, dpapi.NewDeviceInfoAt(dp.root, pluginapi.Healthy, devs, nil, envs, nil))
+		klog.V(4).Infof("New %s device %s in IOMMU group %s", resource, vfBdf, group)
+		n++
+	}
+
+	return devTree, nil
+}
+
+// getQatVFs returns the sorted list of PCI addresses of QAT VFs.
+func (dp *DevicePlugin) getQatVFs() ([]string, error) {
+	pciDevs, err := os.ReadDir(dp.pciDeviceDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't read %s", dp.pciDeviceDir)
+	}
+
+	vfBdfs := []string{}
+
+	for _, pciDev := range pciDevs {
+		vendor, err := readID(filepath.Join(dp.pciDeviceDir, pciDev.Name(), "vendor"))
+		if err != nil || vendor != vendorIntel {
+			continue
+		}
+
+		devID, err := readID(filepath.Join(dp.pciDeviceDir, pciDev.Name(), "device"))
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := qatDeviceDriver[devID]; ok {
+			vfBdfs = append(vfBdfs, pciDev.Name())
+		}
+	}
+
+	sort.Strings(vfBdfs)
+
+	return vfBdfs, nil
+}
+
+// ensureVfioPci returns true if the VF is bound to vfio-pci, rebinding it from
+// one of the allowed kernel drivers when needed.
+func (dp *DevicePlugin) ensureVfioPci(vfBdf string) (bool, error) {
+	driver, err := dp.getDriver(vfBdf)
+	if err != nil {
+		return false, err
+	}
+
+	if driver == vfioPci {
+		return true, nil
+	}
+
+	if !dp.rebind {
+		return false, nil
+	}
+
+	if driver != "" && !dp.isKernelVfDriver(driver) {
+		klog.V(4).Infof("Skip %s bound to %s", vfBdf, driver)
+		return false, nil
+	}
+
+	devDir := filepath.Join(dp.pciDeviceDir, vfBdf)
+
+	if err := writeToSysfs(filepath.Join(devDir, "driver_override"), vfioPci); err != nil {
+		return false, err
+	}
+
+	if driver != "" {
+		if err := writeToSysfs(filepath.Join(devDir, "driver", "unbind"), vfBdf); err != nil {
+			return false, err
+		}
+	}
+
+	if err := writeToSysfs(filepath.Join(dp.pciDriverDir, vfioPci, "bind"), vfBdf); err != nil {
+		return false, err
+	}
+
+	klog.V(1).Infof("Rebound %s from %q to %s", vfBdf, driver, vfioPci)
+
+	return true, nil
+}
+
+func (dp *DevicePlugin) isKernelVfDriver(driver string) bool {
+	for _, kernelVfDriver := range dp.kernelVfDrivers {
+		if kernelVfDriver == driver {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getDriver returns the name of the driver the device is bound to or an empty string.
+func (dp *DevicePlugin) getDriver(bdf string) (string, error) {
+	driver, err := filepath.EvalSymlinks(filepath.Join(dp.pciDeviceDir, bdf, "driver"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+
+		return "", errors.Wrapf(err, "Can't get driver of %s", bdf)
+	}
+
+	return filepath.Base(driver), nil
+}
+
+func (dp *DevicePlugin) getIOMMUGroup(vfBdf string) (string, error) {
+	group, err := filepath.EvalSymlinks(filepath.Join(dp.pciDeviceDir, vfBdf, "iommu_group"))
+	if err != nil {
+		return "", errors.Wrapf(err, "Can't get IOMMU group of %s", vfBdf)
+	}
+
+	return filepath.Base(group), nil
+}
+
+// getResourceName returns the resource a VF is advertised as. It is derived
+// from cfg_services of the parent PF which exists only for gen4 devices.
+func (dp *DevicePlugin) getResourceName(vfBdf string) (string, error) {
+	if !dp.splitServices {
+		return genericResource, nil
+	}
+
+	servicesFile := filepath.Join(dp.pciDeviceDir, vfBdf, "physfn", "qat", "cfg_services")
+
+	services, err := os.ReadFile(servicesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return genericResource, nil
+		}
+
+		return "", errors.Wrapf(err, "Can't read %s", servicesFile)
+	}
+
+	resource, ok := servicesResource[string(bytes.TrimSpace(services))]
+	if !ok {
+		return "", errors.Errorf("Unsupported services %q configured for %s", bytes.TrimSpace(services), vfBdf)
+	}
+
+	return resource, nil
+}
+
+func newDeviceSpec(devPath string) pluginapi.DeviceSpec {
+	return pluginapi.DeviceSpec{
+		HostPath:      devPath,
+		ContainerPath: devPath,
+		Permissions:   "rw",
+	}
+}
+
+// readID reads a PCI ID attribute like vendor or device without the 0x prefix.
+func readID(path string) (string, error) {
+	id, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Can't read %s", path)
+	}
+
+	return strings.TrimPrefix(string(bytes.TrimSpace(id)), "0x"), nil
+}
+
+func writeToSysfs(path, value string) error {
+	if err := os.WriteFile(path, []byte(value), 0600); err != nil {
+		return errors.Wrapf(err, "Can't write %q to %s", value, path)
+	}
+
+	return nil
+}
+
+// PostAllocate implements PostAllocator interface for vfio-pci based QAT plugin.
+// It renumbers QAT<n> variables so that every container sees QAT0..QAT<k-1>.
+func (dp *DevicePlugin) PostAllocate(response *pluginapi.AllocateResponse) error {
+	for _, containerResponse := range response.GetContainerResponses() {
+		bdfs := []string{}
+
+		for key, value := range containerResponse.Envs {
+			if !strings.HasPrefix(key, "QAT") {
+				continue
+			}
+
+			bdfs = append(bdfs, value)
+			delete(containerResponse.Envs, key)
+		}
+
+		sort.Strings(bdfs)
+
+		for i, bdf := range bdfs {
+			containerResponse.Envs[fmt.Sprintf("QAT%d", i)] = bdf
+		}
+	}
+
+	return nil
+}
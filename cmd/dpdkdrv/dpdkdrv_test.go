@@ -0,0 +1,298 @@
+package dpdkdrv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	dpapi "github.com/shuoyanshen/qat_plugin/pkg/deviceplugin"
+	"github.com/shuoyanshen/qat_plugin/pkg/qatfixture"
+)
+
+// newTestHost returns a host with the IOMMU enabled and a c6xx PF with two
+// VFs bound to driver, or unbound if driver is empty.
+func newTestHost(t *testing.T, driver string) *qatfixture.Host {
+	t.Helper()
+
+	host := qatfixture.New(t.TempDir()).WithIOMMU().
+		AddDevice(qatfixture.Device{BDF: "0000:3d:00.0", DevType: "c6xx", NUMANode: 1, LocalCPUList: "16-31"}).
+		AddVF("0000:3d:01.1", "0000:3d:00.0", "").
+		AddVF("0000:3d:01.0", "0000:3d:00.0", "")
+
+	for i := range host.Devices {
+		if host.Devices[i].PhysFn != "" {
+			host.Devices[i].Driver = driver
+			host.Devices[i].Unbound = driver == ""
+		}
+	}
+
+	return host
+}
+
+func buildHost(t *testing.T, host *qatfixture.Host) {
+	t.Helper()
+
+	if err := host.Build(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// goldenDevice is an expected device of the device tree, in scan order.
+type goldenDevice struct {
+	resource string
+	bdf      string
+	numa     []int64
+}
+
+func goldenTree(host *qatfixture.Host, devices []goldenDevice) dpapi.DeviceTree {
+	tree := dpapi.NewDeviceTree()
+
+	for n, dev := range devices {
+		nodes := []pluginapi.DeviceSpec{
+			newDeviceSpec(filepath.Join(vfioDevicePath, host.IOMMUGroup(dev.bdf))),
+			newDeviceSpec(vfioCtrlDevicePath),
+		}
+
+		envs := map[string]string{
+			fmt.Sprintf("QAT%d", n): dev.bdf,
+		}
+
+		var topology *pluginapi.TopologyInfo
+
+		// The topology is unknown without device nodes.
+		if host.CharDevices() {
+			topology = &pluginapi.TopologyInfo{}
+			for _, node := range dev.numa {
+				topology.Nodes = append(topology.Nodes, &pluginapi.NUMANode{ID: node})
+			}
+		}
+
+		tree.AddDevice(dev.resource, dev.bdf, dpapi.NewDeviceInfoWithTopologyHints(pluginapi.Healthy, nodes, nil, envs, nil, topology))
+	}
+
+	return tree
+}
+
+func TestScan(t *testing.T) {
+	tcases := []struct {
+		name          string
+		host          func(t *testing.T) *qatfixture.Host
+		rebind        bool
+		splitServices bool
+		maxDevices    int
+		expected      []goldenDevice
+		// rebound are the VFs expected to be rebound to vfio-pci.
+		rebound []string
+	}{
+		{
+			name: "VFs bound to vfio-pci",
+			host: func(t *testing.T) *qatfixture.Host { return newTestHost(t, vfioPci) },
+			expected: []goldenDevice{
+				{resource: genericResource, bdf: "0000:3d:01.0", numa: []int64{1}},
+				{resource: genericResource, bdf: "0000:3d:01.1", numa: []int64{1}},
+			},
+		},
+		{
+			name:       "max devices",
+			host:       func(t *testing.T) *qatfixture.Host { return newTestHost(t, vfioPci) },
+			maxDevices: 1,
+			expected: []goldenDevice{
+				{resource: genericResource, bdf: "0000:3d:01.0", numa: []int64{1}},
+			},
+		},
+		{
+			name:     "VFs bound to the kernel VF driver without rebind",
+			host:     func(t *testing.T) *qatfixture.Host { return newTestHost(t, "c6xxvf") },
+			expected: []goldenDevice{},
+		},
+		{
+			name:   "VFs bound to the kernel VF driver",
+			host:   func(t *testing.T) *qatfixture.Host { return newTestHost(t, "c6xxvf") },
+			rebind: true,
+			expected: []goldenDevice{
+				{resource: genericResource, bdf: "0000:3d:01.0", numa: []int64{1}},
+				{resource: genericResource, bdf: "0000:3d:01.1", numa: []int64{1}},
+			},
+			rebound: []string{"0000:3d:01.0", "0000:3d:01.1"},
+		},
+		{
+			name:   "unbound VFs",
+			host:   func(t *testing.T) *qatfixture.Host { return newTestHost(t, "") },
+			rebind: true,
+			expected: []goldenDevice{
+				{resource: genericResource, bdf: "0000:3d:01.0", numa: []int64{1}},
+				{resource: genericResource, bdf: "0000:3d:01.1", numa: []int64{1}},
+			},
+			rebound: []string{"0000:3d:01.0", "0000:3d:01.1"},
+		},
+		{
+			name:     "VFs bound to igb_uio",
+			host:     func(t *testing.T) *qatfixture.Host { return newTestHost(t, "igb_uio") },
+			rebind:   true,
+			expected: []goldenDevice{},
+		},
+		{
+			name: "split services",
+			host: func(t *testing.T) *qatfixture.Host {
+				host := qatfixture.New(t.TempDir()).WithIOMMU().
+					AddDevice(qatfixture.Device{BDF: "0000:6b:00.0", DevType: "4xxx", State: "up", Services: "sym;dc"}).
+					AddDevice(qatfixture.Device{BDF: "0000:70:00.0", DevType: "4xxx", State: "up", Services: "asym"}).
+					AddVF("0000:6b:00.1", "0000:6b:00.0", "").
+					AddVF("0000:70:00.1", "0000:70:00.0", "")
+
+				for i := range host.Devices {
+					if host.Devices[i].PhysFn != "" {
+						host.Devices[i].Driver = vfioPci
+					}
+				}
+
+				return host
+			},
+			splitServices: true,
+			expected: []goldenDevice{
+				{resource: "sym-dc", bdf: "0000:6b:00.1"},
+				{resource: "asym", bdf: "0000:70:00.1"},
+			},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			host := tc.host(t)
+			buildHost(t, host)
+
+			maxDevices := tc.maxDevices
+			if maxDevices == 0 {
+				maxDevices = 64
+			}
+
+			dp := NewDevicePlugin(host.HostRoot(), maxDevices, []string{"c6xxvf", "4xxxvf"}, tc.rebind, tc.splitServices, time.Minute)
+
+			tree, err := dp.scan()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := goldenTree(host, tc.expected); !reflect.DeepEqual(tree, expected) {
+				t.Errorf("expected device tree\n%+v\ngot\n%+v", expected, tree)
+			}
+
+			for _, bdf := range tc.rebound {
+				override, err := os.ReadFile(filepath.Join(host.SysfsDir(), "bus", "pci", "devices", bdf, "driver_override"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if strings.TrimSpace(string(override)) != vfioPci {
+					t.Errorf("%s: expected driver_override %s, got %q", bdf, vfioPci, override)
+				}
+			}
+		})
+	}
+}
+
+// treeNotifier passes the notified device trees to a channel.
+type treeNotifier struct {
+	trees chan dpapi.DeviceTree
+}
+
+func (n *treeNotifier) Notify(tree dpapi.DeviceTree) {
+	n.trees <- tree
+}
+
+func TestScanKeepsLastTree(t *testing.T) {
+	host := newTestHost(t, vfioPci)
+	buildHost(t, host)
+
+	dp := NewDevicePlugin(host.HostRoot(), 64, nil, false, false, 10*time.Millisecond)
+	notifier := &treeNotifier{trees: make(chan dpapi.DeviceTree)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- dp.Scan(ctx, notifier)
+	}()
+
+	select {
+	case <-notifier.trees:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no device tree notified")
+	}
+
+	// Scans fail without the IOMMU group of a VF.
+	groupLink := filepath.Join(host.SysfsDir(), "bus", "pci", "devices", "0000:3d:01.0", "iommu_group")
+
+	group, err := os.Readlink(groupLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(groupLink); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drain the tree notified before the removal, if any.
+	select {
+	case <-notifier.trees:
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	select {
+	case tree := <-notifier.trees:
+		t.Errorf("device tree notified by a failed scan: %+v", tree)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := os.Symlink(group, groupLink); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case tree := <-notifier.trees:
+		if expected := goldenTree(host, []goldenDevice{
+			{resource: genericResource, bdf: "0000:3d:01.0", numa: []int64{1}},
+			{resource: genericResource, bdf: "0000:3d:01.1", numa: []int64{1}},
+		}); !reflect.DeepEqual(tree, expected) {
+			t.Errorf("expected device tree\n%+v\ngot\n%+v", expected, tree)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no device tree notified after the scans recovered")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Scan() failed: %+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scan() didn't return after the context was canceled")
+	}
+}
+
+func TestPostAllocate(t *testing.T) {
+	response := &pluginapi.AllocateResponse{
+		ContainerResponses: []*pluginapi.ContainerAllocateResponse{
+			{Envs: map[string]string{"QAT3": "0000:3d:01.1", "QAT7": "0000:3d:01.0", "OTHER": "value"}},
+		},
+	}
+
+	if err := (&DevicePlugin{}).PostAllocate(response); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"QAT0": "0000:3d:01.0", "QAT1": "0000:3d:01.1", "OTHER": "value"}
+	if envs := response.ContainerResponses[0].Envs; !reflect.DeepEqual(envs, expected) {
+		t.Errorf("expected envs %v, got %v", expected, envs)
+	}
+}
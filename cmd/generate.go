@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/shuoyanshen/qat_plugin/cmd/kerneldrv"
+	"github.com/shuoyanshen/qat_plugin/pkg/hostroot"
+)
+
+// generate implements the generate subcommand which writes QAT driver
+// configuration files for the detected devices from a spec. It returns the
+// exit code.
+func generate(args []string) int {
+	var (
+		specPath     string
+		configDir    string
+		hostRoot     string
+		discovery    string
+		pluginConfig string
+		dryRun       bool
+	)
+
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s generate -spec <file> [flags]\n\nGenerate QAT driver configuration files for the detected devices. Changed\nfiles are kept as <name>.bak.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&specPath, "spec", "", "YAML file with the desired sections")
+	flags.StringVar(&configDir, "config-dir", "/etc", "directory to write the QAT driver configuration files to")
+	flags.StringVar(&hostRoot, "host-root", "/", "directory the host /sys and /dev are mounted under")
+	flags.StringVar(&discovery, "discovery", kerneldrv.DiscoverySysfs, "device discovery backend, sysfs or adf_ctl")
+	flags.StringVar(&pluginConfig, "plugin-config", "", "YAML file with the plugin config selecting the devices and sections")
+	flags.BoolVar(&dryRun, "dry-run", false, "print the files instead of writing them")
+	_ = flags.Parse(args)
+
+	if specPath == "" {
+		flags.Usage()
+		return 2
+	}
+
+	spec, err := kerneldrv.LoadConfSpec(specPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	config := kerneldrv.DefaultPluginConfig()
+
+	if pluginConfig != "" {
+		if config, err = kerneldrv.LoadPluginConfig(pluginConfig); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+	}
+
+	plugin := kerneldrv.NewDevicePlugin(configDir, hostroot.New(hostRoot), discovery, time.Minute, 0, kerneldrv.PolicySpread)
+	plugin.SetConfig(config)
+
+	devices, err := plugin.ConfDevices()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	files, err := kerneldrv.GenerateConfigs(spec, devices, config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	if dryRun {
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Printf("# %s\n%s\n", filepath.Join(configDir, name), files[name])
+		}
+
+		return 0
+	}
+
+	if err := kerneldrv.WriteConfigs(configDir, files); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,193 @@
+package kerneldrv
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+// Preferred allocation policies.
+const (
+	// PolicySpread spreads slots across QAT endpoints for throughput.
+	PolicySpread = "spread"
+	// PolicyPack packs slots on as few QAT endpoints as possible.
+	PolicyPack = "pack"
+)
+
+// slot describes a section process advertised to kubelet.
+type slot struct {
+	section  string
+	resource string
+	// endpoint is the device ID of the endpoint of a pinned section, empty otherwise.
+	endpoint string
+	// bdfs are the PCI addresses of the endpoints the slot uses.
+	bdfs []string
+	// numaNode is the NUMA node of the endpoint, -1 if unknown.
+	numaNode int
+}
+
+// getNUMANode returns the NUMA node of the PCI device or -1 if it's unknown.
+func getNUMANode(sysfs, bsf string) int {
+	numaNode, err := os.ReadFile(filepath.Join(sysfs, "bus", "pci", "devices", fullBDF(bsf), "numa_node"))
+	if err != nil {
+		return -1
+	}
+
+	node, err := strconv.Atoi(strings.TrimSpace(string(numaNode)))
+	if err != nil || node < 0 {
+		return -1
+	}
+
+	return node
+}
+
+// GetPreferredAllocation implements PreferredAllocator interface for kernel
+// based QAT plugin. Slots on the NUMA node of the must-include slots are
+// preferred. The remaining choice spreads slots across endpoints or packs
+// them depending on the policy, slots of unpinned sections are spread or
+// packed by section. The response is only shorter than requested if there
+// are not enough available slots.
+func (dp *DevicePlugin) GetPreferredAllocation(rqt *pluginapi.PreferredAllocationRequest) (*pluginapi.PreferredAllocationResponse, error) {
+	dp.slotsMutex.Lock()
+	slots := dp.slots
+	dp.slotsMutex.Unlock()
+
+	response := &pluginapi.PreferredAllocationResponse{}
+
+	for _, crqt := range rqt.ContainerRequests {
+		deviceIDs := preferSlots(slots, crqt.AvailableDeviceIDs, crqt.MustIncludeDeviceIDs, int(crqt.AllocationSize), dp.policy)
+
+		klog.V(4).Infof("Preferred slots %v out of %v", deviceIDs, crqt.AvailableDeviceIDs)
+
+		response.ContainerResponses = append(response.ContainerResponses, &pluginapi.ContainerPreferredAllocationResponse{
+			DeviceIDs: deviceIDs,
+		})
+	}
+
+	return response, nil
+}
+
+// SlotEndpoints returns the PCI addresses of the endpoints the slot of the
+// resource uses, the endpoint of a pinned section or all endpoints of an
+// unpinned one. It returns nil for slots unknown to the last scan.
+func (dp *DevicePlugin) SlotEndpoints(resource, deviceID string) []string {
+	dp.slotsMutex.Lock()
+	defer dp.slotsMutex.Unlock()
+
+	s, ok := dp.slots[deviceID]
+	if !ok || s.resource != resource {
+		return nil
+	}
+
+	return append([]string{}, s.bdfs...)
+}
+
+func preferSlots(slots map[string]slot, available, mustInclude []string, size int, policy string) []string {
+	selected := []string{}
+	selectedSet := map[string]bool{}
+	load := map[string]int{}
+	numaNode := -1
+
+	add := func(id string) {
+		selected = append(selected, id)
+		selectedSet[id] = true
+		load[slots[id].loadKey()]++
+
+		if numaNode == -1 {
+			numaNode = slots[id].numaNode
+		}
+	}
+
+	for _, id := range mustInclude {
+		add(id)
+	}
+
+	candidates := []string{}
+
+	for _, id := range available {
+		if _, ok := slots[id]; ok && !selectedSet[id] {
+			candidates = append(candidates, id)
+		}
+	}
+
+	sort.Strings(candidates)
+
+	if numaNode == -1 {
+		numaNode = busiestNUMANode(slots, candidates)
+	}
+
+	for len(selected) < size {
+		best := ""
+
+		for _, id := range candidates {
+			if selectedSet[id] {
+				continue
+			}
+
+			if best == "" || betterSlot(slots[id], slots[best], numaNode, load, policy) {
+				best = id
+			}
+		}
+
+		if best == "" {
+			break
+		}
+
+		add(best)
+	}
+
+	return selected
+}
+
+// busiestNUMANode returns the NUMA node with most candidate slots or -1.
+func busiestNUMANode(slots map[string]slot, candidates []string) int {
+	counts := map[int]int{}
+	numaNode := -1
+
+	for _, id := range candidates {
+		node := slots[id].numaNode
+		if node == -1 {
+			continue
+		}
+
+		counts[node]++
+
+		if numaNode == -1 || counts[node] > counts[numaNode] || (counts[node] == counts[numaNode] && node < numaNode) {
+			numaNode = node
+		}
+	}
+
+	return numaNode
+}
+
+// loadKey returns the key the selected slots are counted by: the endpoint
+// of a pinned slot or the section of an unpinned one, whose processes may run
+// on any endpoint.
+func (s slot) loadKey() string {
+	if s.endpoint != "" {
+		return "endpoint/" + s.endpoint
+	}
+
+	return "section/" + s.section
+}
+
+// betterSlot returns true if slot a is preferred over slot b.
+func betterSlot(a, b slot, numaNode int, load map[string]int, policy string) bool {
+	aLocal := numaNode == -1 || a.numaNode == -1 || a.numaNode == numaNode
+	bLocal := numaNode == -1 || b.numaNode == -1 || b.numaNode == numaNode
+
+	if aLocal != bLocal {
+		return aLocal
+	}
+
+	if policy == PolicyPack {
+		return load[a.loadKey()] > load[b.loadKey()]
+	}
+
+	return load[a.loadKey()] < load[b.loadKey()]
+}
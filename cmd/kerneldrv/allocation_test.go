@@ -0,0 +1,110 @@
+package kerneldrv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPreferSlots(t *testing.T) {
+	slots := map[string]slot{
+		"SSL_0":  {section: "SSL", numaNode: 0},
+		"SSL_1":  {section: "SSL", numaNode: 0},
+		"SSL_2":  {section: "SSL", numaNode: 0},
+		"DC_0":   {section: "DC", numaNode: 0},
+		"DC_1":   {section: "DC", numaNode: 0},
+		"PIN_0":  {section: "PIN", endpoint: "dev0", numaNode: 0},
+		"PIN_1":  {section: "PIN", endpoint: "dev1", numaNode: 1},
+		"PIN_2":  {section: "PIN", endpoint: "dev0", numaNode: 0},
+		"PIN_3":  {section: "PIN", endpoint: "dev1", numaNode: 1},
+		"PIN2_0": {section: "PIN2", endpoint: "dev0", numaNode: 0},
+	}
+
+	tcases := []struct {
+		name        string
+		available   []string
+		mustInclude []string
+		size        int
+		policy      string
+		expected    []string
+	}{
+		{
+			name:      "one section fills the request",
+			available: []string{"SSL_0", "SSL_1", "SSL_2"},
+			size:      2,
+			policy:    PolicySpread,
+			expected:  []string{"SSL_0", "SSL_1"},
+		},
+		{
+			name:      "spread across unpinned sections",
+			available: []string{"SSL_0", "SSL_1", "SSL_2", "DC_0", "DC_1"},
+			size:      3,
+			policy:    PolicySpread,
+			expected:  []string{"DC_0", "SSL_0", "DC_1"},
+		},
+		{
+			name:      "pack unpinned sections",
+			available: []string{"SSL_0", "SSL_1", "SSL_2", "DC_0", "DC_1"},
+			size:      3,
+			policy:    PolicyPack,
+			expected:  []string{"DC_0", "DC_1", "SSL_0"},
+		},
+		{
+			name:        "spread across endpoints on the NUMA node of must-include slots",
+			available:   []string{"PIN_0", "PIN_1", "PIN_2", "PIN_3", "PIN2_0"},
+			mustInclude: []string{"PIN_1"},
+			size:        3,
+			policy:      PolicySpread,
+			expected:    []string{"PIN_1", "PIN_3", "PIN2_0"},
+		},
+		{
+			name:      "pack on one endpoint",
+			available: []string{"PIN_0", "PIN_1", "PIN_2", "PIN_3", "PIN2_0"},
+			size:      3,
+			policy:    PolicyPack,
+			expected:  []string{"PIN2_0", "PIN_0", "PIN_2"},
+		},
+		{
+			name:      "fewer slots than requested",
+			available: []string{"SSL_0", "unknown"},
+			size:      2,
+			policy:    PolicySpread,
+			expected:  []string{"SSL_0"},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			selected := preferSlots(slots, tc.available, tc.mustInclude, tc.size, tc.policy)
+			if !reflect.DeepEqual(selected, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, selected)
+			}
+		})
+	}
+}
+
+func TestSlotEndpoints(t *testing.T) {
+	host := buildHost(t, hostTestCases()[0])
+	dp := newTestPlugin(host, DiscoveryAdfCtl, 1)
+
+	if _, err := dp.scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	tcases := []struct {
+		resource string
+		deviceID string
+		expected []string
+	}{
+		{resource: "cy1_dc1", deviceID: "PIN_1", expected: []string{"0000:3d:00.0"}},
+		{resource: "cy1_dc1", deviceID: "PIN_2", expected: []string{"0000:3f:00.0"}},
+		{resource: "cy2_dc0", deviceID: "SSL_3", expected: []string{"0000:3d:00.0", "0000:3f:00.0"}},
+		{resource: "cy2_dc0", deviceID: "PIN_1"},
+		{resource: "cy2_dc0", deviceID: "SSL_9"},
+	}
+
+	for _, tc := range tcases {
+		if endpoints := dp.SlotEndpoints(tc.resource, tc.deviceID); !reflect.DeepEqual(endpoints, tc.expected) {
+			t.Errorf("%s/%s: expected %v, got %v", tc.resource, tc.deviceID, tc.expected, endpoints)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package kerneldrv
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultDeniedSections are the sections of driver configuration files
+// which don't describe user space processes.
+var defaultDeniedSections = []string{"GENERAL", "SIOV", "KERNEL", "KERNEL_QAT"}
+
+// PluginConfig is the operator configuration of the kernel mode plugin.
+//
+//	devices:
+//	  deny:
+//	  - bdf: "0000:3d:00.0"   # reserved for kernel users
+//	  allow:
+//	  - devtype: "4xxx*"
+//	sections:
+//	  deny: [SHIM]
+//	functions:
+//	  policy: mixed
+//	  pfs:
+//	  - bdf: "0000:3f:00.0"
+//	    policy: pf-only
+//	resources:
+//	  template: "{devtype}-{section}"
+//	  names:
+//	    SSL: crypto
+//	sriov:
+//	  teardown: true
+//	  pfs:
+//	  - devtype: "4xxx"
+//	    numvfs: max
+//	  - bdf: "0000:3f:00.0"
+//	    numvfs: 4
+//	    driver: vfio-pci
+//
+// A device is used if it matches an allow rule, or there are none, and no
+// deny rule. The same applies to sections. The sections not used by user
+// space are always denied, the section deny list adds to them.
+// Allowed devices are further selected by the PF/VF policy of their PF.
+// Sections are advertised as resources named by the template or the
+// explicit names. VFs of the PFs matching an SR-IOV rule are enabled before
+// the first scan.
+type PluginConfig struct {
+	Devices   DeviceRules     `yaml:"devices"`
+	Sections  SectionRules    `yaml:"sections"`
+	Functions FunctionsConfig `yaml:"functions"`
+	Resources ResourcesConfig `yaml:"resources"`
+	SRIOV     SRIOVConfig     `yaml:"sriov"`
+}
+
+// DeviceRules select the QAT devices the plugin uses.
+type DeviceRules struct {
+	Allow []DeviceMatch `yaml:"allow"`
+	Deny  []DeviceMatch `yaml:"deny"`
+}
+
+// DeviceMatch matches devices by shell patterns of their device type and
+// PCI address. Empty fields match any device.
+type DeviceMatch struct {
+	DevType string `yaml:"devtype"`
+	BDF     string `yaml:"bdf"`
+}
+
+// SectionRules select the driver configuration sections advertised to
+// kubelet by shell patterns of their names.
+type SectionRules struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// FunctionsConfig selects between PFs and their VFs. Policy applies to PFs
+// without an entry in PFs.
+type FunctionsConfig struct {
+	Policy string     `yaml:"policy"`
+	PFs    []PFPolicy `yaml:"pfs"`
+}
+
+// PFPolicy is the PF/VF policy of a single PF.
+type PFPolicy struct {
+	BDF    string `yaml:"bdf"`
+	Policy string `yaml:"policy"`
+}
+
+// ResourcesConfig names the resources of the sections.
+type ResourcesConfig struct {
+	// Template is expanded for each section. The placeholders are {section},
+	// {devtype}, {gen}, {cy} and {dc}.
+	Template string `yaml:"template"`
+	// Names maps section names to resource names, overriding the template.
+	Names map[string]string `yaml:"names"`
+}
+
+// SRIOVConfig provisions the VFs of PFs. The first rule matching a PF
+// applies, PFs without a matching rule are left alone.
+type SRIOVConfig struct {
+	// Teardown disables the VFs enabled by the plugin when it stops, except
+	// on PFs with VFs allocated to containers. The allocations are read from
+	// the kubelet PodResources API, VFs are left enabled without it.
+	Teardown bool     `yaml:"teardown"`
+	PFs      []VFRule `yaml:"pfs"`
+}
+
+// VFRule sets the number of VFs of the matching PFs and the driver the
+// VFs are bound to.
+type VFRule struct {
+	DeviceMatch `yaml:",inline"`
+	// NumVFs is a number or VFsMax for all VFs the PF supports.
+	NumVFs string `yaml:"numvfs"`
+	// Driver is VFDriverQAT, the default, or VFDriverVfioPci.
+	Driver string `yaml:"driver"`
+}
+
+// DefaultPluginConfig returns the configuration used without a config file.
+func DefaultPluginConfig() *PluginConfig {
+	return &PluginConfig{
+		Functions: FunctionsConfig{
+			Policy: FunctionsAuto,
+		},
+		Resources: ResourcesConfig{
+			Template: DefaultResourceTemplate,
+		},
+	}
+}
+
+// LoadPluginConfig reads the plugin configuration file. Missing settings
+// keep their defaults.
+func LoadPluginConfig(configPath string) (*PluginConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read plugin config")
+	}
+
+	config := DefaultPluginConfig()
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, errors.Wrapf(err, "Can't parse %s", configPath)
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid plugin config %s", configPath)
+	}
+
+	return config, nil
+}
+
+func (c *PluginConfig) validate() error {
+	for _, rule := range append(append([]DeviceMatch{}, c.Devices.Allow...), c.Devices.Deny...) {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, pattern := range append(append([]string{}, c.Sections.Allow...), c.Sections.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "Bad pattern %q", pattern)
+		}
+	}
+
+	if !functionPolicies[c.Functions.Policy] {
+		return errors.Errorf("Unknown PF/VF policy %q", c.Functions.Policy)
+	}
+
+	for _, pf := range c.Functions.PFs {
+		if pf.BDF == "" {
+			return errors.New("PF policies must set bdf")
+		}
+
+		if !functionPolicies[pf.Policy] {
+			return errors.Errorf("Unknown PF/VF policy %q for %s", pf.Policy, pf.BDF)
+		}
+	}
+
+	for _, rule := range c.SRIOV.PFs {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+
+		if err := rule.validateFunctions(c.Functions); err != nil {
+			return err
+		}
+	}
+
+	if err := validateResourceTemplate(c.Resources.Template); err != nil {
+		return err
+	}
+
+	for sname, name := range c.Resources.Names {
+		if err := validateResourceName(name); err != nil {
+			return errors.Wrapf(err, "Invalid resource name of section [%s]", sname)
+		}
+	}
+
+	return nil
+}
+
+// functionPolicy returns the PF/VF policy of the PF.
+func (c *PluginConfig) functionPolicy(pf string) string {
+	for _, pfPolicy := range c.Functions.PFs {
+		if pf != "" && fullBDF(pfPolicy.BDF) == pf {
+			return pfPolicy.Policy
+		}
+	}
+
+	return c.Functions.Policy
+}
+
+// fullBDF returns the PCI address with the domain, adf_ctl may omit it.
+func fullBDF(bsf string) string {
+	if strings.Count(bsf, ":") == 1 {
+		return "0000:" + bsf
+	}
+
+	return bsf
+}
+
+func matchPattern(pattern, name string) bool {
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+func (m DeviceMatch) validate() error {
+	if m.DevType == "" && m.BDF == "" {
+		return errors.New("Device rules must set devtype or bdf")
+	}
+
+	for _, pattern := range []string{m.DevType, m.BDF} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "Bad pattern %q", pattern)
+		}
+	}
+
+	return nil
+}
+
+func (m DeviceMatch) matches(dev device) bool {
+	if m.DevType != "" && !matchPattern(m.DevType, dev.devtype) {
+		return false
+	}
+
+	if m.BDF != "" && !matchPattern(fullBDF(m.BDF), fullBDF(dev.bsf)) {
+		return false
+	}
+
+	return true
+}
+
+// deviceAllowed returns whether the device can be used along with the reason.
+func (c *PluginConfig) deviceAllowed(dev device) (bool, string) {
+	for _, rule := range c.Devices.Deny {
+		if rule.matches(dev) {
+			return false, "denied by plugin config"
+		}
+	}
+
+	if len(c.Devices.Allow) == 0 {
+		return true, ""
+	}
+
+	for _, rule := range c.Devices.Allow {
+		if rule.matches(dev) {
+			return true, ""
+		}
+	}
+
+	return false, "not allowed by plugin config"
+}
+
+// sectionAllowed returns whether the section is advertised to kubelet.
+func (c *PluginConfig) sectionAllowed(name string) bool {
+	for _, pattern := range append(append([]string{}, defaultDeniedSections...), c.Sections.Deny...) {
+		if matchPattern(pattern, name) {
+			return false
+		}
+	}
+
+	if len(c.Sections.Allow) == 0 {
+		return true
+	}
+
+	for _, pattern := range c.Sections.Allow {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,70 @@
+package kerneldrv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSectionAllowed(t *testing.T) {
+	tcases := []struct {
+		name     string
+		config   string
+		expected map[string]bool
+	}{
+		{
+			name:   "defaults",
+			config: "",
+			expected: map[string]bool{
+				"GENERAL":    false,
+				"SIOV":       false,
+				"KERNEL":     false,
+				"KERNEL_QAT": false,
+				"SSL":        true,
+				"SHIM":       true,
+			},
+		},
+		{
+			name:   "deny list adds to the defaults",
+			config: "sections:\n  deny: [SHIM]\n",
+			expected: map[string]bool{
+				"GENERAL":    false,
+				"SIOV":       false,
+				"KERNEL":     false,
+				"KERNEL_QAT": false,
+				"SSL":        true,
+				"SHIM":       false,
+			},
+		},
+		{
+			name:   "allow list doesn't override the defaults",
+			config: "sections:\n  allow: [\"*\"]\n  deny: [\"S*\"]\n",
+			expected: map[string]bool{
+				"GENERAL": false,
+				"KERNEL":  false,
+				"SSL":     false,
+				"DC":      true,
+			},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(tc.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := LoadPluginConfig(configPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for section, allowed := range tc.expected {
+				if got := config.sectionAllowed(section); got != allowed {
+					t.Errorf("%s: expected allowed=%t, got %t", section, allowed, got)
+				}
+			}
+		})
+	}
+}
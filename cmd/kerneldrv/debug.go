@@ -0,0 +1,120 @@
+package kerneldrv
+
+import (
+	"sort"
+	"time"
+)
+
+// EndpointState is a QAT endpoint found by the last scan with the decision
+// to use it.
+type EndpointState struct {
+	ID       string `json:"id"`
+	BDF      string `json:"bdf"`
+	DevType  string `json:"devtype"`
+	State    string `json:"state"`
+	Included bool   `json:"included"`
+	Reason   string `json:"reason"`
+}
+
+// SectionEndpoint is an endpoint of a driver configuration section.
+type SectionEndpoint struct {
+	ID        string `json:"id"`
+	Processes int    `json:"processes"`
+}
+
+// SectionState is a driver configuration section advertised to kubelet.
+type SectionState struct {
+	Name               string            `json:"name"`
+	Pinned             bool              `json:"pinned"`
+	CryptoEngines      int               `json:"cryptoEngines"`
+	CompressionEngines int               `json:"compressionEngines"`
+	Endpoints          []SectionEndpoint `json:"endpoints"`
+}
+
+// SlotState maps a device ID advertised to kubelet to its section and
+// endpoint.
+type SlotState struct {
+	ID       string `json:"id"`
+	Resource string `json:"resource"`
+	Section  string `json:"section"`
+	// Endpoint is empty for slots of not pinned sections.
+	Endpoint string `json:"endpoint,omitempty"`
+	NUMANode int    `json:"numaNode"`
+}
+
+// State is the state of the kernel mode plugin after the last scan.
+type State struct {
+	LastScan  *time.Time      `json:"lastScan,omitempty"`
+	IOMMU     bool            `json:"iommu"`
+	Endpoints []EndpointState `json:"endpoints"`
+	Sections  []SectionState  `json:"sections"`
+	Slots     []SlotState     `json:"slots"`
+}
+
+// DebugState returns the endpoints with their PF/VF and IOMMU decisions
+// and the sections and slots of the last successful scan.
+func (dp *DevicePlugin) DebugState() interface{} {
+	state := State{
+		Endpoints: []EndpointState{},
+		Sections:  []SectionState{},
+		Slots:     []SlotState{},
+	}
+
+	dp.stateMutex.Lock()
+
+	if !dp.lastScan.IsZero() {
+		lastScan := dp.lastScan
+		state.LastScan = &lastScan
+	}
+
+	state.IOMMU = dp.lastIOMMU
+
+	for _, sel := range dp.lastSelections {
+		state.Endpoints = append(state.Endpoints, EndpointState{
+			ID:       sel.dev.id,
+			BDF:      sel.dev.bsf,
+			DevType:  sel.dev.devtype,
+			State:    sel.dev.state,
+			Included: sel.included,
+			Reason:   sel.reason,
+		})
+	}
+
+	for name, s := range dp.lastDriverConfig {
+		section := SectionState{
+			Name:               name,
+			Pinned:             s.pinned,
+			CryptoEngines:      s.cryptoEngines,
+			CompressionEngines: s.compressionEngines,
+			Endpoints:          []SectionEndpoint{},
+		}
+
+		for _, ep := range s.endpoints {
+			section.Endpoints = append(section.Endpoints, SectionEndpoint{ID: ep.id, Processes: ep.processes})
+		}
+
+		state.Sections = append(state.Sections, section)
+	}
+
+	dp.stateMutex.Unlock()
+
+	sort.Slice(state.Sections, func(i, j int) bool { return state.Sections[i].Name < state.Sections[j].Name })
+
+	dp.slotsMutex.Lock()
+
+	for id, s := range dp.slots {
+		state.Slots = append(state.Slots, SlotState{
+			ID:       id,
+			Resource: s.resource,
+			Section:  s.section,
+			Endpoint: s.endpoint,
+			NUMANode: s.numaNode,
+		})
+	}
+
+	dp.slotsMutex.Unlock()
+
+	sort.Slice(state.Slots, func(i, j int) bool { return state.Slots[i].ID < state.Slots[j].ID })
+
+	return state
+}
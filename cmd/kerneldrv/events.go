@@ -0,0 +1,186 @@
+package kerneldrv
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/uevent"
+)
+
+// rescanDebounce is the time to collect further events after the first one
+// before rescanning, so that a burst of events results in a single rescan.
+const rescanDebounce = 500 * time.Millisecond
+
+// eventlessScanInterval is the longest scan interval used when device
+// uevents can't be received, so that devices which come and go are still
+// noticed in time.
+const eventlessScanInterval = 5 * time.Second
+
+// requestRescan triggers a rescan unless one is pending already.
+func requestRescan(rescan chan<- struct{}) {
+	select {
+	case rescan <- struct{}{}:
+	default:
+	}
+}
+
+// watchEvents triggers rescans on changes of configuration files and on
+// uevents of QAT devices. Failing watchers are logged and scans fall back to
+// the periodic timer. The returned function stops all watchers, the returned
+// bool is false if device uevents can't be received.
+func (dp *DevicePlugin) watchEvents(rescan chan<- struct{}) (func(), bool) {
+	trigger := func() {
+		requestRescan(rescan)
+	}
+
+	stops := []func(){}
+
+	if stop, err := watchConfigDir(dp.configDir, trigger); err == nil {
+		stops = append(stops, stop)
+	} else {
+		klog.Warningf("Config changes won't trigger rescans: %+v", err)
+	}
+
+	uevents := true
+
+	if stop, err := watchUevents(trigger); err == nil {
+		stops = append(stops, stop)
+	} else {
+		klog.Warningf("Device uevents won't trigger rescans: %+v", err)
+
+		uevents = false
+	}
+
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}, uevents
+}
+
+func watchConfigDir(configDir string, trigger func()) (func(), error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create watcher for %s", configDir)
+	}
+
+	if err := watcher.Add(configDir); err != nil {
+		watcher.Close()
+		return nil, errors.Wrapf(err, "Failed to add %s to watcher", configDir)
+	}
+
+	go func() {
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Ext(ev.Name) == ".conf" {
+					klog.V(4).Infof("Config %s changed: %s", ev.Name, ev.Op)
+					trigger()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				klog.Warningf("Config watcher error: %+v", err)
+			}
+		}
+	}()
+
+	return func() { watcher.Close() }, nil
+}
+
+func watchUevents(trigger func()) (func(), error) {
+	listener, err := uevent.NewListener()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			ev, err := listener.Read()
+			if err != nil {
+				klog.V(4).Infof("Stopped reading uevents: %v", err)
+				return
+			}
+
+			if isQatEvent(ev) {
+				klog.V(4).Infof("QAT uevent %s %s", ev.Action, ev.DevPath)
+				trigger()
+			}
+		}
+	}()
+
+	return func() { listener.Close() }, nil
+}
+
+// isQatEvent returns true for uevents of QAT PCI devices, their drivers and UIO devices.
+func isQatEvent(ev *uevent.Event) bool {
+	switch ev.Env["SUBSYSTEM"] {
+	case "uio":
+		return true
+	case "pci":
+		if driver, ok := ev.Env["DRIVER"]; ok {
+			for _, devtype := range qatDeviceTypes {
+				if driver == devtype {
+					return true
+				}
+			}
+		}
+
+		// PCI_ID is formatted as VVVV:DDDD.
+		ids := strings.SplitN(strings.ToLower(ev.Env["PCI_ID"]), ":", 2)
+		if len(ids) != 2 || ids[0] != vendorIntel {
+			return false
+		}
+
+		_, ok := qatDeviceTypes[ids[1]]
+
+		return ok
+	}
+
+	return false
+}
+
+// waitForRescan blocks until a rescan is triggered or the fallback interval
+// elapses. It returns false if ctx is done before.
+func waitForRescan(ctx context.Context, rescan <-chan struct{}, fallback time.Duration) bool {
+	timer := time.NewTimer(fallback)
+	defer timer.Stop()
+
+	select {
+	case <-rescan:
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+
+	debounce := time.NewTimer(rescanDebounce)
+	defer debounce.Stop()
+
+	select {
+	case <-debounce.C:
+	case <-ctx.Done():
+		return false
+	}
+
+	// Drop the events received while debouncing.
+	select {
+	case <-rescan:
+	default:
+	}
+
+	return true
+}
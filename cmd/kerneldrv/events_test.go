@@ -0,0 +1,100 @@
+package kerneldrv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/uevent"
+)
+
+func TestIsQatEvent(t *testing.T) {
+	tcases := []struct {
+		name     string
+		env      map[string]string
+		expected bool
+	}{
+		{name: "UIO device", env: map[string]string{"SUBSYSTEM": "uio"}, expected: true},
+		{name: "bound to the QAT driver", env: map[string]string{"SUBSYSTEM": "pci", "DRIVER": "c6xx"}, expected: true},
+		{name: "QAT VF", env: map[string]string{"SUBSYSTEM": "pci", "PCI_ID": "8086:37C9"}, expected: true},
+		{name: "gen4 PF", env: map[string]string{"SUBSYSTEM": "pci", "PCI_ID": "8086:4940"}, expected: true},
+		{name: "other Intel device", env: map[string]string{"SUBSYSTEM": "pci", "DRIVER": "ixgbe", "PCI_ID": "8086:10FB"}},
+		{name: "other vendor", env: map[string]string{"SUBSYSTEM": "pci", "PCI_ID": "15B3:37C9"}},
+		{name: "malformed PCI ID", env: map[string]string{"SUBSYSTEM": "pci", "PCI_ID": "8086"}},
+		{name: "other subsystem", env: map[string]string{"SUBSYSTEM": "net", "DRIVER": "c6xx"}},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if isQat := isQatEvent(&uevent.Event{Action: "add", Env: tc.env}); isQat != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, isQat)
+			}
+		})
+	}
+}
+
+func TestWaitForRescan(t *testing.T) {
+	tcases := []struct {
+		name     string
+		events   int
+		fallback time.Duration
+		cancel   bool
+		expected bool
+		// minWait is the least time waited.
+		minWait time.Duration
+	}{
+		{name: "fallback interval", fallback: 10 * time.Millisecond, expected: true},
+		{name: "single event", events: 1, fallback: time.Hour, expected: true, minWait: rescanDebounce},
+		{name: "burst of events", events: 3, fallback: time.Hour, expected: true, minWait: rescanDebounce},
+		{name: "canceled", fallback: time.Hour, cancel: true},
+		{name: "canceled while debouncing", events: 1, fallback: time.Hour, cancel: true},
+	}
+
+	for _, tc := range tcases {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			rescan := make(chan struct{}, 1)
+			trigger := func() {
+				select {
+				case rescan <- struct{}{}:
+				default:
+				}
+			}
+
+			if tc.events > 0 {
+				trigger()
+			}
+
+			// Further events arrive while debouncing.
+			go func() {
+				for i := 1; i < tc.events; i++ {
+					time.Sleep(rescanDebounce / 10)
+					trigger()
+				}
+			}()
+
+			if tc.cancel {
+				time.AfterFunc(rescanDebounce/5, cancel)
+			}
+
+			start := time.Now()
+
+			if ok := waitForRescan(ctx, rescan, tc.fallback); ok != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, ok)
+			}
+
+			if waited := time.Since(start); waited < tc.minWait {
+				t.Errorf("returned after %v, expected at least %v", waited, tc.minWait)
+			}
+
+			// The events of a burst result in a single rescan.
+			if tc.expected && len(rescan) != 0 {
+				t.Error("events received while debouncing not dropped")
+			}
+		})
+	}
+}
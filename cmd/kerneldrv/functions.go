@@ -0,0 +1,152 @@
+package kerneldrv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/metrics"
+)
+
+// PF/VF selection policies.
+const (
+	// FunctionsAuto uses only VFs if any VF exists on the host, PFs otherwise.
+	FunctionsAuto = "auto"
+	// FunctionsPFOnly uses PFs and ignores their VFs.
+	FunctionsPFOnly = "pf-only"
+	// FunctionsVFOnly uses VFs and ignores PFs.
+	FunctionsVFOnly = "vf-only"
+	// FunctionsMixed uses the VFs of PFs with VFs enabled and the other PFs.
+	FunctionsMixed = "mixed"
+)
+
+var functionPolicies = map[string]bool{
+	FunctionsAuto:   true,
+	FunctionsPFOnly: true,
+	FunctionsVFOnly: true,
+	FunctionsMixed:  true,
+}
+
+// selection is the decision to use an endpoint or not.
+type selection struct {
+	dev      device
+	included bool
+	reason   string
+}
+
+func isVF(dev device) bool {
+	return strings.HasSuffix(dev.devtype, "vf")
+}
+
+// getPhysFn returns the PCI address of the PF of a VF or an empty string if
+// it's unknown.
+func getPhysFn(sysfs, bsf string) string {
+	physfn, err := os.Readlink(filepath.Join(sysfs, "bus", "pci", "devices", fullBDF(bsf), "physfn"))
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Base(physfn)
+}
+
+// selectFunction returns whether the device is used under the policy and why.
+// pfHasVFs tells if VFs of a PF are listed, hostHasVFs if any VF is listed.
+// With IOMMU enabled PFs are only used under an explicit pf-only policy.
+func selectFunction(dev device, policy string, pfHasVFs, hostHasVFs, iommuOn bool) (bool, string) {
+	if isVF(dev) {
+		if policy == FunctionsPFOnly {
+			return false, "pf-only policy"
+		}
+
+		return true, policy + " policy"
+	}
+
+	switch {
+	case policy == FunctionsPFOnly:
+		return true, "pf-only policy"
+	case iommuOn:
+		return false, "PFs can't be used with IOMMU enabled"
+	case policy == FunctionsVFOnly:
+		return false, "vf-only policy"
+	case policy == FunctionsMixed && pfHasVFs:
+		return false, "mixed policy, PF has VFs enabled"
+	case policy == FunctionsMixed:
+		return true, "mixed policy, PF has no VFs enabled"
+	case hostHasVFs:
+		return false, "auto policy, VFs enabled on the host"
+	default:
+		return true, "auto policy, no VFs enabled on the host"
+	}
+}
+
+// selectFunctions decides which of the devices are used. The policy of a PF
+// applies to its VFs too.
+func (dp *DevicePlugin) selectFunctions(allDevices []device, iommuOn bool) []selection {
+	physFns := map[string]string{}
+	pfsWithVFs := map[string]bool{}
+	hostHasVFs := false
+
+	for _, dev := range allDevices {
+		if !isVF(dev) {
+			continue
+		}
+
+		hostHasVFs = true
+
+		if pf := getPhysFn(dp.root.Sysfs, dev.bsf); pf != "" {
+			physFns[dev.bsf] = pf
+			pfsWithVFs[pf] = true
+		}
+	}
+
+	selections := []selection{}
+
+	for _, dev := range allDevices {
+		sel := selection{dev: dev}
+
+		pf := fullBDF(dev.bsf)
+		if isVF(dev) {
+			pf = physFns[dev.bsf]
+		}
+
+		if allowed, reason := dp.config.deviceAllowed(dev); !allowed {
+			sel.reason = reason
+		} else {
+			sel.included, sel.reason = selectFunction(dev, dp.config.functionPolicy(pf), pfsWithVFs[pf], hostHasVFs, iommuOn)
+		}
+
+		selections = append(selections, sel)
+	}
+
+	return selections
+}
+
+// recordSelections logs changed decisions and updates the endpoint metric.
+func (dp *DevicePlugin) recordSelections(selections []selection) {
+	metrics.Endpoints.Reset()
+
+	decisions := map[string]string{}
+
+	for _, sel := range selections {
+		decision := "excluded"
+		if sel.included {
+			decision = "included"
+		}
+
+		metrics.Endpoints.WithLabelValues(sel.dev.bsf, sel.dev.devtype, decision, sel.reason).Set(1)
+
+		decisions[sel.dev.bsf] = decision + ": " + sel.reason
+
+		if dp.lastDecisions[sel.dev.bsf] != decisions[sel.dev.bsf] {
+			klog.V(1).Infof("Device %s %s %s is %s, %s", sel.dev.id, sel.dev.devtype, sel.dev.bsf, decision, sel.reason)
+		}
+	}
+
+	dp.lastDecisions = decisions
+
+	dp.stateMutex.Lock()
+	dp.lastSelections = selections
+	dp.stateMutex.Unlock()
+}
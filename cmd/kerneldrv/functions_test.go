@@ -0,0 +1,42 @@
+package kerneldrv
+
+import "testing"
+
+func TestSelectFunction(t *testing.T) {
+	pf := device{bsf: "3d:00.0", devtype: "c6xx"}
+	vf := device{bsf: "3d:01.0", devtype: "c6xxvf"}
+
+	tcases := []struct {
+		name       string
+		dev        device
+		policy     string
+		pfHasVFs   bool
+		hostHasVFs bool
+		iommuOn    bool
+		expected   bool
+	}{
+		{name: "auto PF without VFs", dev: pf, policy: FunctionsAuto, expected: true},
+		{name: "auto PF with VFs", dev: pf, policy: FunctionsAuto, pfHasVFs: true, hostHasVFs: true, expected: false},
+		{name: "auto PF without VFs, another PF with VFs", dev: pf, policy: FunctionsAuto, hostHasVFs: true, expected: false},
+		{name: "auto PF with IOMMU", dev: pf, policy: FunctionsAuto, iommuOn: true, expected: false},
+		{name: "mixed PF without VFs", dev: pf, policy: FunctionsMixed, expected: true},
+		{name: "mixed PF with VFs", dev: pf, policy: FunctionsMixed, pfHasVFs: true, hostHasVFs: true, expected: false},
+		{name: "mixed PF without VFs, another PF with VFs", dev: pf, policy: FunctionsMixed, hostHasVFs: true, expected: true},
+		{name: "mixed VF", dev: vf, policy: FunctionsMixed, pfHasVFs: true, hostHasVFs: true, expected: true},
+		{name: "mixed PF with IOMMU", dev: pf, policy: FunctionsMixed, iommuOn: true, expected: false},
+		{name: "pf-only PF with IOMMU", dev: pf, policy: FunctionsPFOnly, iommuOn: true, expected: true},
+		{name: "pf-only PF with VFs", dev: pf, policy: FunctionsPFOnly, pfHasVFs: true, hostHasVFs: true, expected: true},
+		{name: "pf-only VF", dev: vf, policy: FunctionsPFOnly, expected: false},
+		{name: "vf-only PF", dev: pf, policy: FunctionsVFOnly, expected: false},
+		{name: "vf-only VF with IOMMU", dev: vf, policy: FunctionsVFOnly, iommuOn: true, expected: true},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			included, reason := selectFunction(tc.dev, tc.policy, tc.pfHasVFs, tc.hostHasVFs, tc.iommuOn)
+			if included != tc.expected {
+				t.Errorf("expected included=%t, got %t (%s)", tc.expected, included, reason)
+			}
+		})
+	}
+}
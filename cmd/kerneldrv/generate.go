@@ -0,0 +1,355 @@
+package kerneldrv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-ini/ini"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfSpec describes the desired driver configuration of all devices.
+//
+//	general:
+//	  ServicesEnabled: "cy;dc"
+//	sections:
+//	- name: SSL
+//	  cyInstances: 2
+//	  slots: 32
+//	  pinned: true
+//	- name: DC
+//	  dcInstances: 1
+//	  slots: 8
+//
+// Slots of pinned sections are spread over the devices, slots of sections
+// which aren't pinned are processes which may use every device.
+type ConfSpec struct {
+	// General holds keys of the GENERAL section overriding the defaults.
+	General  map[string]string `yaml:"general"`
+	Sections []SectionSpec     `yaml:"sections"`
+}
+
+// SectionSpec is a user space section advertised as a resource.
+type SectionSpec struct {
+	Name        string `yaml:"name"`
+	CyInstances int    `yaml:"cyInstances"`
+	DcInstances int    `yaml:"dcInstances"`
+	Slots       int    `yaml:"slots"`
+	Pinned      bool   `yaml:"pinned"`
+}
+
+// ConfDevice is a device to generate a configuration file for.
+type ConfDevice struct {
+	DevType string
+	ID      string
+}
+
+// LoadConfSpec reads a configuration spec file.
+func LoadConfSpec(specPath string) (*ConfSpec, error) {
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't read configuration spec")
+	}
+
+	spec := &ConfSpec{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(spec); err != nil {
+		return nil, errors.Wrapf(err, "Can't parse %s", specPath)
+	}
+
+	return spec, nil
+}
+
+func (spec *ConfSpec) validate(numDevices int, pluginConfig *PluginConfig) error {
+	if numDevices == 0 {
+		return errors.New("No devices to generate configuration files for")
+	}
+
+	names := map[string]bool{}
+
+	for _, s := range spec.Sections {
+		switch {
+		case s.Name == "" || s.Name == ini.DefaultSection:
+			return errors.New("Sections must have a name")
+		case names[s.Name]:
+			return errors.Errorf("Section [%s] is defined twice", s.Name)
+		case !pluginConfig.sectionAllowed(s.Name):
+			return errors.Errorf("Section [%s] is denied by the plugin config", s.Name)
+		case s.CyInstances < 0 || s.DcInstances < 0 || s.CyInstances+s.DcInstances == 0:
+			return errors.Errorf("Section [%s] must have crypto or compression instances", s.Name)
+		case s.Slots <= 0:
+			return errors.Errorf("Section [%s] must have slots", s.Name)
+		case s.Pinned && s.Slots < numDevices:
+			return errors.Errorf("Pinned section [%s] needs at least a slot per device, %d devices", s.Name, numDevices)
+		}
+
+		names[s.Name] = true
+	}
+
+	return nil
+}
+
+// sections returns the section model of the spec for the devices.
+func (spec *ConfSpec) sections(devices []ConfDevice) driverConfig {
+	drvConfig := make(driverConfig)
+
+	for _, s := range spec.Sections {
+		sec := section{
+			cryptoEngines:      s.CyInstances,
+			compressionEngines: s.DcInstances,
+			pinned:             s.Pinned,
+		}
+
+		for i, dev := range devices {
+			processes := s.Slots
+
+			// Spread the slots of pinned sections, the first devices get the remainder.
+			if s.Pinned {
+				processes = s.Slots / len(devices)
+				if i < s.Slots%len(devices) {
+					processes++
+				}
+			}
+
+			sec.endpoints = append(sec.endpoints, endpoint{id: dev.ID, processes: processes})
+		}
+
+		drvConfig[s.Name] = sec
+	}
+
+	return drvConfig
+}
+
+// servicesEnabled returns the services the sections need on devices of the
+// type. QAT 4 devices name the crypto services sym and asym and can't enable
+// them together with dc, the spec has to choose one of them then.
+func (spec *ConfSpec) servicesEnabled(devtype string) (string, error) {
+	if services, ok := spec.General["ServicesEnabled"]; ok {
+		return services, nil
+	}
+
+	cy, dc := false, false
+
+	for _, s := range spec.Sections {
+		cy = cy || s.CyInstances > 0
+		dc = dc || s.DcInstances > 0
+	}
+
+	if qatGenerations[strings.TrimSuffix(devtype, "vf")] == "4" {
+		switch {
+		case cy && dc:
+			return "", errors.Errorf("Devices of type %s can't enable compression with both crypto services, set ServicesEnabled to sym;dc or asym;dc in the general section of the spec", devtype)
+		case dc:
+			return "dc", nil
+		default:
+			return "sym;asym", nil
+		}
+	}
+
+	switch {
+	case cy && dc:
+		return "cy;dc", nil
+	case dc:
+		return "dc", nil
+	default:
+		return "cy", nil
+	}
+}
+
+// GenerateConfigs returns the driver configuration files of the devices by
+// file name. The files are parsed back the way the plugin parses them, so
+// an error is returned instead of files the plugin would reject.
+func GenerateConfigs(spec *ConfSpec, devices []ConfDevice, pluginConfig *PluginConfig) (map[string][]byte, error) {
+	if err := spec.validate(len(devices), pluginConfig); err != nil {
+		return nil, err
+	}
+
+	drvConfig := spec.sections(devices)
+	files := map[string][]byte{}
+
+	for _, dev := range devices {
+		var file bytes.Buffer
+
+		services, err := spec.servicesEnabled(dev.DevType)
+		if err != nil {
+			return nil, err
+		}
+
+		general := map[string]string{
+			"ConfigVersion": "2",
+		}
+
+		for key, value := range spec.General {
+			general[key] = value
+		}
+
+		general["ServicesEnabled"] = services
+
+		writeSection(&file, "GENERAL", general)
+		writeSection(&file, "KERNEL", map[string]string{
+			"NumberCyInstances": "0",
+			"NumberDcInstances": "0",
+		})
+
+		for _, s := range spec.Sections {
+			writeUserSection(&file, s.Name, drvConfig[s.Name], dev.ID)
+		}
+
+		files[confFileName(dev.DevType, dev.ID)] = file.Bytes()
+	}
+
+	if err := checkGenerated(files, devices, pluginConfig); err != nil {
+		return nil, errors.Wrap(err, "Generated configuration is invalid")
+	}
+
+	return files, nil
+}
+
+// writeUserSection writes the user space section with the instances of the endpoint.
+func writeUserSection(file *bytes.Buffer, name string, sec section, devID string) {
+	processes := 0
+
+	for _, ep := range sec.endpoints {
+		if ep.id == devID {
+			processes = ep.processes
+		}
+	}
+
+	limitDevAccess := "0"
+	if sec.pinned {
+		limitDevAccess = "1"
+	}
+
+	keys := map[string]string{
+		"NumberCyInstances": fmt.Sprint(sec.cryptoEngines),
+		"NumberDcInstances": fmt.Sprint(sec.compressionEngines),
+		"NumProcesses":      fmt.Sprint(processes),
+		"LimitDevAccess":    limitDevAccess,
+	}
+
+	for i := 0; i < sec.cryptoEngines; i++ {
+		keys[fmt.Sprintf("Cy%dName", i)] = fmt.Sprintf("%s%d", name, i)
+		keys[fmt.Sprintf("Cy%dIsPolled", i)] = "1"
+		keys[fmt.Sprintf("Cy%dCoreAffinity", i)] = fmt.Sprint(i)
+	}
+
+	for i := 0; i < sec.compressionEngines; i++ {
+		keys[fmt.Sprintf("Dc%dName", i)] = fmt.Sprintf("%sDc%d", name, i)
+		keys[fmt.Sprintf("Dc%dIsPolled", i)] = "1"
+		keys[fmt.Sprintf("Dc%dCoreAffinity", i)] = fmt.Sprint(i)
+	}
+
+	writeSection(file, name, keys)
+}
+
+// writeSection writes the section with the keys in name order. The file is
+// written by hand as the QAT driver doesn't understand the quoting of
+// values like cy;dc done by the ini package.
+func writeSection(file *bytes.Buffer, name string, keys map[string]string) {
+	if file.Len() > 0 {
+		file.WriteString("\n")
+	}
+
+	fmt.Fprintf(file, "[%s]\n", name)
+
+	names := make([]string, 0, len(keys))
+	for key := range keys {
+		names = append(names, key)
+	}
+
+	sort.Strings(names)
+
+	for _, key := range names {
+		fmt.Fprintf(file, "%s = %s\n", key, keys[key])
+	}
+}
+
+// checkGenerated parses the files with the rules of parseConfigs.
+func checkGenerated(files map[string][]byte, devices []ConfDevice, pluginConfig *PluginConfig) error {
+	drvConfig := make(driverConfig)
+
+	for _, dev := range devices {
+		fileName := confFileName(dev.DevType, dev.ID)
+
+		file, err := ini.Load(files[fileName])
+		if err != nil {
+			return errors.Wrapf(err, "Can't parse %s", fileName)
+		}
+
+		for _, sec := range file.Sections() {
+			if sec.Name() == ini.DefaultSection || !pluginConfig.sectionAllowed(sec.Name()) {
+				continue
+			}
+
+			if err := drvConfig.update(fileName, dev.ID, sec); err != nil {
+				return err
+			}
+		}
+	}
+
+	for sname, svalue := range drvConfig {
+		if svalue.pinned && len(svalue.endpoints) != len(devices) {
+			return errors.Errorf("Section [%s] isn't defined for all devices", sname)
+		}
+	}
+
+	return nil
+}
+
+// WriteConfigs atomically writes the generated files to configDir. Existing
+// files with a different content are kept as <name>.bak.
+func WriteConfigs(configDir string, files map[string][]byte) error {
+	for name, data := range files {
+		path := filepath.Join(configDir, name)
+		tmpPath := path + ".tmp"
+
+		old, err := os.ReadFile(path)
+
+		switch {
+		case err == nil && !bytes.Equal(old, data):
+			if err := os.WriteFile(path+".bak", old, 0644); err != nil {
+				return errors.Wrapf(err, "Failed to back up %s", path)
+			}
+		case err != nil && !os.IsNotExist(err):
+			return errors.Wrapf(err, "Can't read %s", path)
+		}
+
+		if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+			return errors.Wrapf(err, "Failed to write %s", tmpPath)
+		}
+
+		if err := os.Rename(tmpPath, path); err != nil {
+			return errors.Wrapf(err, "Failed to rename %s", tmpPath)
+		}
+	}
+
+	return nil
+}
+
+// ConfDevices returns the devices the plugin uses, which need configuration files.
+func (dp *DevicePlugin) ConfDevices() ([]ConfDevice, error) {
+	iommuOn, err := getIOMMUStatus(dp.root.Sysfs)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := dp.getOnlineDevices(iommuOn)
+	if err != nil {
+		return nil, err
+	}
+
+	confDevices := []ConfDevice{}
+	for _, dev := range devices {
+		confDevices = append(confDevices, ConfDevice{DevType: dev.devtype, ID: dev.id})
+	}
+
+	return confDevices, nil
+}
@@ -0,0 +1,183 @@
+package kerneldrv
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/qatfixture"
+)
+
+func TestGenerateConfigsSlots(t *testing.T) {
+	tcases := []struct {
+		name     string
+		sections []SectionSpec
+		// resources are the expected slots per resource.
+		resources map[string]int
+		// endpoints are the expected slots of pinned sections per endpoint.
+		endpoints map[string]int
+	}{
+		{
+			name:      "unpinned",
+			sections:  []SectionSpec{{Name: "SSL", CyInstances: 2, Slots: 4}},
+			resources: map[string]int{"cy2_dc0": 4},
+			endpoints: map[string]int{},
+		},
+		{
+			name:      "pinned",
+			sections:  []SectionSpec{{Name: "PIN", CyInstances: 1, DcInstances: 1, Slots: 6, Pinned: true}},
+			resources: map[string]int{"cy1_dc1": 6},
+			endpoints: map[string]int{"dev0": 2, "dev1": 2, "dev2": 2},
+		},
+		{
+			name:      "pinned with a remainder",
+			sections:  []SectionSpec{{Name: "PIN", CyInstances: 1, Slots: 8, Pinned: true}},
+			resources: map[string]int{"cy1_dc0": 8},
+			endpoints: map[string]int{"dev0": 3, "dev1": 3, "dev2": 2},
+		},
+		{
+			name: "pinned and unpinned",
+			sections: []SectionSpec{
+				{Name: "SSL", CyInstances: 2, Slots: 3},
+				{Name: "DC", DcInstances: 1, Slots: 4, Pinned: true},
+			},
+			resources: map[string]int{"cy2_dc0": 3, "cy0_dc1": 4},
+			endpoints: map[string]int{"dev0": 2, "dev1": 1, "dev2": 1},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			host := buildHost(t, hostTestCase{host: func(root string) *qatfixture.Host {
+				return qatfixture.New(root).
+					AddPF("0000:3d:00.0", "c6xx", 0, "", "uio0").
+					AddPF("0000:3f:00.0", "c6xx", 0, "", "uio1").
+					AddPF("0000:da:00.0", "c6xx", 1, "", "uio2")
+			}})
+			dp := newTestPlugin(host, DiscoveryAdfCtl, 2)
+
+			confDevices, err := dp.ConfDevices()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			files, err := GenerateConfigs(&ConfSpec{Sections: tc.sections}, confDevices, DefaultPluginConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := WriteConfigs(host.ConfigDir(), files); err != nil {
+				t.Fatal(err)
+			}
+
+			devices, err := dp.getOnlineDevices(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := dp.parseConfigs(devices)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tree, slots, err := getDevTree(host.HostRoot(), devices, config, DefaultPluginConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resources := map[string]int{}
+			for name, devices := range tree {
+				resources[name] = len(devices)
+			}
+
+			if !reflect.DeepEqual(resources, tc.resources) {
+				t.Errorf("expected slots per resource %v, got %v", tc.resources, resources)
+			}
+
+			endpoints := map[string]int{}
+			for _, s := range slots {
+				if s.endpoint != "" {
+					endpoints[s.endpoint]++
+				}
+			}
+
+			if !reflect.DeepEqual(endpoints, tc.endpoints) {
+				t.Errorf("expected pinned slots per endpoint %v, got %v", tc.endpoints, endpoints)
+			}
+		})
+	}
+}
+
+func TestGenerateConfigsServices(t *testing.T) {
+	cy := SectionSpec{Name: "SSL", CyInstances: 1, Slots: 2}
+	dc := SectionSpec{Name: "DC", DcInstances: 1, Slots: 2}
+
+	tcases := []struct {
+		name     string
+		devtype  string
+		spec     ConfSpec
+		expected string
+	}{
+		{name: "c6xx crypto", devtype: "c6xx", spec: ConfSpec{Sections: []SectionSpec{cy}}, expected: "cy"},
+		{name: "c6xx crypto and compression", devtype: "c6xx", spec: ConfSpec{Sections: []SectionSpec{cy, dc}}, expected: "cy;dc"},
+		{name: "4xxx crypto", devtype: "4xxx", spec: ConfSpec{Sections: []SectionSpec{cy}}, expected: "sym;asym"},
+		{name: "4xxx compression", devtype: "4xxx", spec: ConfSpec{Sections: []SectionSpec{dc}}, expected: "dc"},
+		{name: "4xxx crypto and compression", devtype: "4xxx", spec: ConfSpec{Sections: []SectionSpec{cy, dc}}},
+		{
+			name:     "4xxx symmetric crypto and compression",
+			devtype:  "4xxx",
+			spec:     ConfSpec{General: map[string]string{"ServicesEnabled": "sym;dc"}, Sections: []SectionSpec{cy, dc}},
+			expected: "sym;dc",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := GenerateConfigs(&tc.spec, []ConfDevice{{DevType: tc.devtype, ID: "dev0"}}, DefaultPluginConfig())
+			if tc.expected == "" {
+				if err == nil {
+					t.Error("expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			name := tc.devtype + "_dev0.conf"
+			if services := "ServicesEnabled = " + tc.expected + "\n"; !strings.Contains(string(files[name]), services) {
+				t.Errorf("expected %q in %s, got\n%s", services, name, files[name])
+			}
+		})
+	}
+}
+
+func TestWriteConfigsBackup(t *testing.T) {
+	configDir := t.TempDir()
+	path := filepath.Join(configDir, "c6xx_dev0.conf")
+
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range []string{"new", "new"} {
+		if err := WriteConfigs(configDir, map[string][]byte{"c6xx_dev0.conf": []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, expected := range map[string]string{path: "new", path + ".bak": "old"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != expected {
+			t.Errorf("expected %s to contain %q, got %q", file, expected, data)
+		}
+	}
+}
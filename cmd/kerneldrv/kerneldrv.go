@@ -1,11 +1,15 @@
 package kerneldrv
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-ini/ini"
@@ -16,8 +20,24 @@ import (
 	utilsexec "k8s.io/utils/exec"
 
 	dpapi "github.com/shuoyanshen/qat_plugin/pkg/deviceplugin"
+	"github.com/shuoyanshen/qat_plugin/pkg/hostroot"
+	"github.com/shuoyanshen/qat_plugin/pkg/metrics"
+	"github.com/shuoyanshen/qat_plugin/pkg/nfd"
+	"github.com/shuoyanshen/qat_plugin/pkg/telemetry"
+	"github.com/shuoyanshen/qat_plugin/pkg/topology"
 )
 
+// Device discovery backends.
+const (
+	DiscoverySysfs  = "sysfs"
+	DiscoveryAdfCtl = "adf_ctl"
+)
+
+// scanRetryMin is the delay before the first retry of a failed scan unless
+// the scan interval is shorter. It's doubled on every further failure up to
+// the scan interval.
+const scanRetryMin = time.Second
+
 var (
 	adfCtlRegex = regexp.MustCompile(`type: (?P<devtype>[[:alnum:]]+), .* inst_id: (?P<instid>[0-9]+), .* bsf: ([0-9a-f]{4}:)?(?P<bsf>[0-9a-f]{2}:[0-9a-f]{2}\.[0-9a-f]), .* state: (?P<state>[[:alpha:]]+)$`)
 )
@@ -38,10 +58,20 @@ type device struct {
 	id      string
 	devtype string
 	bsf     string
+	state   string
 }
 
 type driverConfig map[string]section
 
+// health maps the driver state of the device to the kubelet device health.
+func (dev device) health() string {
+	if dev.state == "up" {
+		return pluginapi.Healthy
+	}
+
+	return pluginapi.Unhealthy
+}
+
 func newDeviceSpec(devPath string) pluginapi.DeviceSpec {
 	return pluginapi.DeviceSpec{
 		HostPath:      devPath,
@@ -50,50 +80,157 @@ func newDeviceSpec(devPath string) pluginapi.DeviceSpec {
 	}
 }
 
-func getDevTree(sysfs string, qatDevs []device, config map[string]section) (dpapi.DeviceTree, error) {
+// getTopologyInfo returns the topology of the device nodes or nil if it's unknown.
+func getTopologyInfo(root hostroot.Root, devs []pluginapi.DeviceSpec) *pluginapi.TopologyInfo {
+	devPaths := []string{}
+
+	for _, dev := range devs {
+		devPaths = append(devPaths, dev.HostPath)
+	}
+
+	topologyInfo, err := topology.GetTopologyInfo(root, devPaths)
+	if err != nil {
+		klog.Warningf("GetTopologyInfo: %v", err)
+		return nil
+	}
+
+	return topologyInfo
+}
+
+// getDevTree returns the device tree of section slots along with the slots
+// indexed by their IDs.
+func getDevTree(root hostroot.Root, qatDevs []device, config map[string]section, pluginConfig *PluginConfig) (dpapi.DeviceTree, map[string]slot, error) {
 	devTree := dpapi.NewDeviceTree()
+	slots := map[string]slot{}
 
-	devs := []pluginapi.DeviceSpec{
+	commonDevs := []pluginapi.DeviceSpec{
 		newDeviceSpec("/dev/qat_adf_ctl"),
 		newDeviceSpec("/dev/qat_dev_processes"),
 		newDeviceSpec("/dev/usdm_drv"),
 	}
 
+	// Slots of pinned sections get the UIO devices of their endpoint only,
+	// slots of not pinned sections get the UIO devices of all endpoints.
+	devs := append([]pluginapi.DeviceSpec{}, commonDevs...)
+	endpointDevs := map[string][]pluginapi.DeviceSpec{}
+
+	health := map[string]string{}
+	numaNodes := map[string]int{}
+	devtypes := map[string]string{}
+	bdfs := map[string]string{}
+
 	for _, qatDev := range qatDevs {
-		uiodevs, err := getUIODevices(sysfs, qatDev.devtype, qatDev.bsf)
+		health[qatDev.id] = qatDev.health()
+		bdfs[qatDev.id] = fullBDF(qatDev.bsf)
+		devtypes[qatDev.id] = qatDev.devtype
+		numaNodes[qatDev.id] = getNUMANode(root.Sysfs, qatDev.bsf)
+		endpointDevs[qatDev.id] = append([]pluginapi.DeviceSpec{}, commonDevs...)
+
+		uiodevs, err := getUIODevices(root.Sysfs, qatDev.devtype, qatDev.bsf)
 		if err != nil {
-			return nil, err
+			// Devices which are down may have no UIO devices.
+			if health[qatDev.id] != pluginapi.Healthy {
+				klog.Warningf("Skip UIO devices of %s %s which is %s: %v", qatDev.id, qatDev.bsf, qatDev.state, err)
+				continue
+			}
+
+			return nil, nil, err
 		}
 
 		for _, uiodev := range uiodevs {
 			devs = append(devs, newDeviceSpec(filepath.Join("/dev/", uiodev)))
+			endpointDevs[qatDev.id] = append(endpointDevs[qatDev.id], newDeviceSpec(filepath.Join("/dev/", uiodev)))
 		}
 	}
 
-	// fmt.Printf("~~~~~~~~~  getDevTree func: devs = %+v\n", devs)
+	// Topology is the same for all slots of an endpoint, get it only once.
+	topologies := map[string]*pluginapi.TopologyInfo{}
+	allTopology := getTopologyInfo(root, devs)
+
+	for id, epDevs := range endpointDevs {
+		topologies[id] = getTopologyInfo(root, epDevs)
+	}
 
 	uniqID := 0
+	instances := resourceInstances{}
+
+	// Iterate sections in a fixed order to keep slot IDs stable across scans.
+	snames := make([]string, 0, len(config))
+	for sname := range config {
+		snames = append(snames, sname)
+	}
+
+	sort.Strings(snames)
+
+	for _, sname := range snames {
+		svalue := config[sname]
+		sectionDevtypes := []string{}
+		sectionBDFs := []string{}
+		for _, ep := range svalue.endpoints {
+			sectionDevtypes = append(sectionDevtypes, devtypes[ep.id])
+			sectionBDFs = append(sectionBDFs, bdfs[ep.id])
+		}
 
-	// fmt.Printf("&&&&&&&&&  config = %+v\n", config)
+		// Processes of not pinned sections use instances of all endpoints.
+		state := pluginapi.Healthy
 
-	for sname, svalue := range config {
-		// fmt.Printf("@@@@@@@@@@  sname = %+v\n", sname)
-		// fmt.Printf("@@@@@@@@@@  svalue = %+v\n", svalue)
-		devType := fmt.Sprintf("cy%d_dc%d", svalue.cryptoEngines, svalue.compressionEngines)
+		for _, ep := range svalue.endpoints {
+			if health[ep.id] != pluginapi.Healthy {
+				state = pluginapi.Unhealthy
+			}
+		}
 
 		for _, ep := range svalue.endpoints {
-			// fmt.Printf("$$$$$$$$$  ep = %+v\n", ep)
+			// Processes of not pinned sections aren't bound to an endpoint.
+			slotInfo := slot{section: sname, numaNode: -1, bdfs: sectionBDFs}
+			slotDevs := devs
+			slotTopology := allTopology
+			slotDevtypes := sectionDevtypes
+
+			if svalue.pinned {
+				slotDevtypes = []string{devtypes[ep.id]}
+				state = health[ep.id]
+				slotInfo.endpoint = ep.id
+				slotInfo.bdfs = []string{bdfs[ep.id]}
+				slotInfo.numaNode = numaNodes[ep.id]
+				slotDevs = endpointDevs[ep.id]
+				slotTopology = topologies[ep.id]
+			}
+
+			devType, err := pluginConfig.resourceName(sname, svalue, slotDevtypes)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if err := instances.add(devType, sname, svalue); err != nil {
+				return nil, nil, err
+			}
+
+			slotInfo.resource = devType
+
+			// The slot IDs change when endpoints or sections come and go,
+			// the stable IDs name the same slot as long as its section and
+			// endpoint exist.
+			stablePrefix := sname
+			if svalue.pinned {
+				stablePrefix = sname + "_" + bdfs[ep.id]
+			}
+
 			for i := 0; i < ep.processes; i++ {
 				envs := map[string]string{
-					fmt.Sprintf("QAT_SECTION_NAME_%s_%d", devType, uniqID): sname,
+					sectionEnvName(devType, uniqID): sname,
 					// This env variable may get overridden if a container requests more than one QAT process.
 					// But we keep this code since the majority of pod workloads run only one QAT process.
 					// The rest should use QAT_SECTION_NAME_XXX variables.
 					"QAT_SECTION_NAME": sname,
 				}
-				deviceInfo := dpapi.NewDeviceInfo(pluginapi.Healthy, devs, nil, envs, nil)
+				deviceInfo := dpapi.NewDeviceInfoWithTopologyHints(state, slotDevs, nil, envs, nil, slotTopology).WithAttributes(map[string]int64{
+					"cryptoInstances":      int64(svalue.cryptoEngines),
+					"compressionInstances": int64(svalue.compressionEngines),
+				}).WithStableID(fmt.Sprintf("%s_%d", stablePrefix, i))
 				uniqID++
 				devTree.AddDevice(devType, fmt.Sprintf("%s_%d", sname, uniqID), deviceInfo)
+				slots[fmt.Sprintf("%s_%d", sname, uniqID)] = slotInfo
 				// devTree.AddDevice(devType, fmt.Sprintf("%s_%s_%d", sname, ep.id, i), deviceInfo)
 				// uniqID++
 			}
@@ -103,29 +240,82 @@ func getDevTree(sysfs string, qatDevs []device, config map[string]section) (dpap
 			}
 		}
 	}
-	// fmt.Printf("########   uniqID++ = %v\n", uniqID)
-	return devTree, nil
+
+	return devTree, slots, nil
 }
 
 // DevicePlugin represents QAT plugin exploiting kernel driver.
 type DevicePlugin struct {
-	execer    utilsexec.Interface
-	configDir string
+	execer       utilsexec.Interface
+	configDir    string
+	root         hostroot.Root
+	discovery    string
+	scanInterval time.Duration
+	gracePeriod  time.Duration
+	policy       string
+	config       *PluginConfig
+
+	// featureFile is the NFD feature file to maintain, disabled if empty.
+	featureFile    string
+	labelNamespace string
+	lastFeatures   nfd.Features
+
+	// telemetry collects device telemetry, disabled if nil.
+	telemetry *telemetry.Collector
+
+	// lastDecisions holds the PF/VF selection of the last scan by PCI address.
+	lastDecisions map[string]string
+
+	// slots of the last successful scan used for preferred allocations.
+	slots      map[string]slot
+	slotsMutex sync.Mutex
+
+	// State of the last scan served by the debug endpoint.
+	stateMutex       sync.Mutex
+	lastScan         time.Time
+	lastIOMMU        bool
+	lastSelections   []selection
+	lastDriverConfig map[string]section
+
+	// provisionedPFs are the PFs the plugin enabled VFs on.
+	provisionedPFs []string
+	provisionMutex sync.Mutex
+
+	// allocations tells which devices containers use, unknown if nil.
+	allocations AllocationLister
 }
 
 // NewDevicePlugin returns new instance of kernel based QAT plugin.
-func NewDevicePlugin() *DevicePlugin {
-	return newDevicePlugin("/etc", utilsexec.New())
+// root locates the host sysfs and device nodes, the device nodes are still
+// advertised with their host paths.
+// discovery selects how online devices are found, DiscoverySysfs or DiscoveryAdfCtl.
+// Devices are reported unhealthy after scans failed for gracePeriod, zero
+// keeps the last good devices published indefinitely. policy selects how
+// preferred allocations are made, PolicySpread or PolicyPack.
+func NewDevicePlugin(configDir string, root hostroot.Root, discovery string, scanInterval, gracePeriod time.Duration, policy string) *DevicePlugin {
+	return newDevicePlugin(configDir, root, discovery, scanInterval, gracePeriod, policy, utilsexec.New())
 }
 
-func newDevicePlugin(configDir string, execer utilsexec.Interface) *DevicePlugin {
+func newDevicePlugin(configDir string, root hostroot.Root, discovery string, scanInterval, gracePeriod time.Duration, policy string, execer utilsexec.Interface) *DevicePlugin {
 	return &DevicePlugin{
-		execer:    execer,
-		configDir: configDir,
+		execer:       execer,
+		configDir:    configDir,
+		root:         root,
+		discovery:    discovery,
+		scanInterval: scanInterval,
+		gracePeriod:  gracePeriod,
+		policy:       policy,
+		config:       DefaultPluginConfig(),
 	}
 }
 
-func (dp *DevicePlugin) getOnlineDevices(iommuOn bool) ([]device, error) {
+// SetConfig replaces the default plugin configuration.
+func (dp *DevicePlugin) SetConfig(config *PluginConfig) {
+	dp.config = config
+}
+
+// listDevicesAdfCtl lists QAT devices known to the driver by parsing "adf_ctl status" output.
+func (dp *DevicePlugin) listDevicesAdfCtl() ([]device, error) {
 	outputBytes, err := dp.execer.Command("adf_ctl", "status").CombinedOutput()
 	if err != nil {
 		return nil, errors.Wrapf(err, "Can't get driver status")
@@ -133,58 +323,65 @@ func (dp *DevicePlugin) getOnlineDevices(iommuOn bool) ([]device, error) {
 
 	devices := []device{}
 
-	// QAT Gen4 devices should not be used with "-mode kernel"
-	devicesDenyList := map[string]struct{}{
-	//	"4xxx":   {},
-	//	"4xxxvf": {},
-	}
-
-	vfOn := false
-
 	for _, line := range strings.Split(string(outputBytes[:]), "\n") {
 		matches := adfCtlRegex.FindStringSubmatch(line)
 		if len(matches) != 6 {
 			continue
 		}
-		
-		if strings.HasSuffix(matches[1], "vf") {
-			vfOn = true
-			break
-		}
+
+		devices = append(devices, device{
+			id:      fmt.Sprintf("dev%s", matches[2]),
+			devtype: matches[1],
+			bsf:     fmt.Sprintf("%s%s", matches[3], matches[4]),
+			state:   matches[5],
+		})
 	}
 
-	for _, line := range strings.Split(string(outputBytes[:]), "\n") {
-		matches := adfCtlRegex.FindStringSubmatch(line)
-		if len(matches) != 6 {
-			continue
-		}
+	return devices, nil
+}
 
-		// Ignore devices which are down.
-		if matches[5] != "up" {
-			continue
+// listDevices lists QAT devices with the configured discovery backend.
+// The sysfs backend falls back to adf_ctl if sysfs can't be read.
+func (dp *DevicePlugin) listDevices() ([]device, error) {
+	if dp.discovery == DiscoverySysfs {
+		devices, err := listDevicesSysfs(dp.root.Sysfs)
+		if err == nil {
+			return devices, nil
 		}
 
-		// Ignore devices which are on the denylist.
-		if _, ok := devicesDenyList[matches[1]]; ok {
-			klog.Warning("skip denylisted device ", matches[1])
-			continue
-		}
+		klog.Warningf("sysfs discovery failed, falling back to adf_ctl: %+v", err)
+	}
 
-		// "Cannot use PF with IOMMU enabled"
-		if iommuOn && !strings.HasSuffix(matches[1], "vf") {
-			continue
+	return dp.listDevicesAdfCtl()
+}
+
+// getOnlineDevices returns the devices selected by the plugin config
+// regardless of their state. Devices which are not up are reported as unhealthy by getDevTree.
+func (dp *DevicePlugin) getOnlineDevices(iommuOn bool) ([]device, error) {
+	allDevices, err := dp.listDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	selections := dp.selectFunctions(allDevices, iommuOn)
+	dp.recordSelections(selections)
+
+	devices := []device{}
+
+	for _, sel := range selections {
+		dev := sel.dev
+
+		// Devices which are down are kept and reported as unhealthy.
+		if dev.state != "up" {
+			klog.Warningf("Device %s %s is %s", dev.id, dev.bsf, dev.state)
 		}
 
-		if vfOn && !strings.HasSuffix(matches[1], "vf") {
+		if !sel.included {
 			continue
 		}
 
-		devices = append(devices, device{
-			id:      fmt.Sprintf("dev%s", matches[2]),
-			devtype: matches[1],
-			bsf:     fmt.Sprintf("%s%s", matches[3], matches[4]),
-		})
-		klog.V(4).Info("New online device", devices[len(devices)-1])
+		devices = append(devices, dev)
+		klog.V(4).Info("New online device", dev)
 	}
 
 	return devices, nil
@@ -221,28 +418,40 @@ func getUIODevices(sysfs, devtype, bsf string) ([]string, error) {
 func (dp *DevicePlugin) parseConfigs(devices []device) (map[string]section, error) {
 	devNum := 0
 	drvConfig := make(driverConfig)
+	violations := ConfigViolations{}
 
 	for _, dev := range devices {
 		// Parse the configuration.
-		config, err := ini.Load(filepath.Join(dp.configDir, fmt.Sprintf("%s_%s.conf", dev.devtype, dev.id)))
+		file := filepath.Join(dp.configDir, confFileName(dev.devtype, dev.id))
+
+		config, err := ini.Load(file)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to parse device config")
 		}
 		devNum++
 
 		for _, section := range config.Sections() {
-			if section.Name() == "GENERAL" || section.Name() == "SIOV" || section.Name() == "KERNEL" || section.Name() == "KERNEL_QAT" || section.Name() == ini.DefaultSection {
+			if section.Name() == ini.DefaultSection || !dp.config.sectionAllowed(section.Name()) {
 				continue
 			}
 
 			klog.V(4).Info(section.Name())
 
-			if err := drvConfig.update(dev.id, section); err != nil {
-				return nil, err
+			if err := drvConfig.update(file, dev.id, section); err != nil {
+				sectionViolations := ConfigViolations{}
+				if !errors.As(err, &sectionViolations) {
+					return nil, err
+				}
+
+				violations = append(violations, sectionViolations...)
 			}
 		}
 	}
 
+	if len(violations) > 0 {
+		return nil, violations
+	}
+
 	// check if the number of sections with LimitDevAccess=1 is equal to the number of endpoints
 	for sname, svalue := range drvConfig {
 		if svalue.pinned && len(svalue.endpoints) != devNum {
@@ -253,20 +462,33 @@ func (dp *DevicePlugin) parseConfigs(devices []device) (map[string]section, erro
 	return drvConfig, nil
 }
 
-func (drvConfig driverConfig) update(devID string, iniSection *ini.Section) error {
+// update adds the endpoint of the section to the driver configuration. All
+// violations found in the section are returned as ConfigViolations.
+func (drvConfig driverConfig) update(file, devID string, iniSection *ini.Section) error {
+	violations := ConfigViolations{}
+
+	violation := func(key, format string, args ...interface{}) {
+		violations = append(violations, &ConfigViolation{
+			File:    file,
+			Section: iniSection.Name(),
+			Key:     key,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
 	numProcesses, err := iniSection.Key("NumProcesses").Int()
 	if err != nil {
-		return errors.Wrapf(err, "Can't parse NumProcesses in %s", iniSection.Name())
+		violation("NumProcesses", "Can't parse NumProcesses: %v", err)
 	}
 
 	cryptoEngines, err := iniSection.Key("NumberCyInstances").Int()
 	if err != nil {
-		return errors.Wrapf(err, "Can't parse NumberCyInstances in %s", iniSection.Name())
+		violation("NumberCyInstances", "Can't parse NumberCyInstances: %v", err)
 	}
 
 	compressionEngines, err := iniSection.Key("NumberDcInstances").Int()
 	if err != nil {
-		return errors.Wrapf(err, "Can't parse NumberDcInstances in %s", iniSection.Name())
+		violation("NumberDcInstances", "Can't parse NumberDcInstances: %v", err)
 	}
 
 	pinned := false
@@ -274,7 +496,7 @@ func (drvConfig driverConfig) update(devID string, iniSection *ini.Section) erro
 	if limitDevAccessKey, err := iniSection.GetKey("LimitDevAccess"); err == nil {
 		limitDevAccess, err := limitDevAccessKey.Bool()
 		if err != nil {
-			return errors.Wrapf(err, "Can't parse LimitDevAccess in %s", iniSection.Name())
+			violation("LimitDevAccess", "Can't parse LimitDevAccess: %v", err)
 		}
 
 		if limitDevAccess {
@@ -282,18 +504,31 @@ func (drvConfig driverConfig) update(devID string, iniSection *ini.Section) erro
 		}
 	}
 
+	// The values can't be compared with other devices if they don't parse.
+	if len(violations) > 0 {
+		return violations
+	}
+
 	if old, ok := drvConfig[iniSection.Name()]; ok {
 		// first check the sections are consistent across endpoints
 		if old.pinned != pinned {
-			return errors.Errorf("Value of LimitDevAccess must be consistent across all devices in %s", iniSection.Name())
+			violation("LimitDevAccess", "Value of LimitDevAccess must be consistent across all devices")
+		}
+
+		if !pinned && !old.pinned && old.endpoints[0].processes != numProcesses {
+			violation("NumProcesses", "For not pinned sections NumProcesses must be equal for all devices, got %d and %d", old.endpoints[0].processes, numProcesses)
 		}
 
-		if !pinned && old.endpoints[0].processes != numProcesses {
-			return errors.Errorf("For not pinned section \"%s\" NumProcesses must be equal for all devices", iniSection.Name())
+		if old.cryptoEngines != cryptoEngines {
+			violation("NumberCyInstances", "NumberCyInstances must be consistent across all devices, got %d and %d", old.cryptoEngines, cryptoEngines)
 		}
 
-		if old.cryptoEngines != cryptoEngines || old.compressionEngines != compressionEngines {
-			return errors.Errorf("NumberCyInstances and NumberDcInstances must be consistent across all devices in %s", iniSection.Name())
+		if old.compressionEngines != compressionEngines {
+			violation("NumberDcInstances", "NumberDcInstances must be consistent across all devices, got %d and %d", old.compressionEngines, compressionEngines)
+		}
+
+		if len(violations) > 0 {
+			return violations
 		}
 
 		// then add a new endpoint to the section
@@ -319,8 +554,8 @@ func (drvConfig driverConfig) update(devID string, iniSection *ini.Section) erro
 	return nil
 }
 
-func getIOMMUStatus() (bool, error) {
-	iommus, err := os.ReadDir("/sys/class/iommu/")
+func getIOMMUStatus(sysfs string) (bool, error) {
+	iommus, err := os.ReadDir(filepath.Join(sysfs, "class", "iommu"))
 	if err != nil {
 		return false, errors.Wrapf(err, "Unable to read IOMMU status")
 	}
@@ -333,41 +568,139 @@ func getIOMMUStatus() (bool, error) {
 }
 
 // Scan implements Scanner interface for kernel based QAT plugin.
-func (dp *DevicePlugin) Scan(notifier dpapi.Notifier) error {
+// Rescans are triggered by config and device events and periodically by
+// the scan interval, which is capped at 5s if device uevents can't be
+// received. Failed scans are retried with backoff while the last good device
+// tree stays published. When scans keep failing longer than the grace period,
+// the devices of the last good tree are reported unhealthy.
+func (dp *DevicePlugin) Scan(ctx context.Context, notifier dpapi.Notifier) error {
+	rescan := make(chan struct{}, 1)
+
+	stop, uevents := dp.watchEvents(rescan)
+	defer stop()
+
+	scanInterval := dp.scanInterval
+	if !uevents && scanInterval > eventlessScanInterval {
+		klog.Warningf("Scanning every %v instead of %v without device uevents", eventlessScanInterval, scanInterval)
+
+		scanInterval = eventlessScanInterval
+	}
+
+	// VFs are provisioned before the first scan so that PFs aren't
+	// advertised only to be replaced by their VFs right after. Failed
+	// provisioning is retried after every scan, which may have learned
+	// that the VFs aren't in use anymore.
+	provisioned := dp.provisionVFs()
+
+	var (
+		lastTree     dpapi.DeviceTree
+		failingSince time.Time
+	)
+
+	retryMin := scanRetryMin
+	if retryMin > scanInterval {
+		retryMin = scanInterval
+	}
+
+	backoff := retryMin
+
 	for {
-		// fmt.Printf("------------------ L O O P ------------------\n")
-		iommuOn, err := getIOMMUStatus()
-		if err != nil {
-			return err
+		start := time.Now()
+		devTree, err := dp.scan()
+
+		metrics.ScanDuration.Observe(time.Since(start).Seconds())
+
+		if !provisioned {
+			if provisioned = dp.provisionVFs(); provisioned {
+				// Pick up the changed VFs right away.
+				requestRescan(rescan)
+			}
 		}
 
-		devices, err := dp.getOnlineDevices(iommuOn)
-		if err != nil {
-			return err
+		if err == nil {
+			if !failingSince.IsZero() {
+				klog.InfoS("Device scan recovered", "failedFor", time.Since(failingSince))
+			}
+
+			failingSince = time.Time{}
+			backoff = retryMin
+			lastTree = devTree
+
+			notifier.Notify(devTree)
+
+			if !waitForRescan(ctx, rescan, scanInterval) {
+				return nil
+			}
+
+			continue
 		}
 
-		driverConfig, err := dp.parseConfigs(devices)
-		if err != nil {
-			return err
+		metrics.ScanErrors.Inc()
+
+		if failingSince.IsZero() {
+			failingSince = time.Now()
 		}
-		// fmt.Printf("========= Scan function: devices = %+v\n", devices)
-		// fmt.Printf("========= Scan function: driverConfig = %+v\n", driverConfig)
 
-		devTree, err := getDevTree("/sys", devices, driverConfig)
-		if err != nil {
-			return err
+		klog.ErrorS(err, "Device scan failed", "failingFor", time.Since(failingSince), "retryIn", backoff)
+
+		if dp.gracePeriod > 0 && lastTree != nil && time.Since(failingSince) >= dp.gracePeriod {
+			notifier.Notify(lastTree.WithState(pluginapi.Unhealthy))
 		}
 
-		notifier.Notify(devTree)
+		if !waitForRescan(ctx, rescan, backoff) {
+			return nil
+		}
 
-		time.Sleep(5 * time.Second)
+		if backoff *= 2; backoff > scanInterval {
+			backoff = scanInterval
+		}
 	}
 }
 
+func (dp *DevicePlugin) scan() (dpapi.DeviceTree, error) {
+	iommuOn, err := getIOMMUStatus(dp.root.Sysfs)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := dp.getOnlineDevices(iommuOn)
+	if err != nil {
+		return nil, err
+	}
+
+	driverConfig, err := dp.parseConfigs(devices)
+	if err != nil {
+		return nil, err
+	}
+
+	devTree, slots, err := getDevTree(dp.root, devices, driverConfig, dp.config)
+	if err != nil {
+		return nil, err
+	}
+
+	dp.slotsMutex.Lock()
+	dp.slots = slots
+	dp.slotsMutex.Unlock()
+
+	dp.stateMutex.Lock()
+	dp.lastScan = time.Now()
+	dp.lastIOMMU = iommuOn
+	dp.lastDriverConfig = driverConfig
+	dp.stateMutex.Unlock()
+
+	dp.updateFeatureFile(dp.features(iommuOn, devices, driverConfig))
+
+	if dp.telemetry != nil {
+		dp.telemetry.SetDevices(telemetryDevices(dp.root.Sysfs, devices, driverConfig, slots))
+	}
+
+	return devTree, nil
+}
+
 // PostAllocate implements PostAllocator interface for kernel based QAT plugin.
 func (dp *DevicePlugin) PostAllocate(response *pluginapi.AllocateResponse) error {
-	fmt.Printf("$$$$$$$$$$$ [kerneldrv.go] PostAllocate func start! $$$$$$$$$\n")
-	fmt.Printf("~~~~~~~~~ response = %+v\n", response)
+	klog.V(4).Infof("PostAllocate response: %+v", response)
+
 	for _, containerResponse := range response.GetContainerResponses() {
 		envsToDelete := []string{}
 		envsToAdd := make(map[string]string)
@@ -378,12 +711,12 @@ func (dp *DevicePlugin) PostAllocate(response *pluginapi.AllocateResponse) error
 				continue
 			}
 
-			parts := strings.Split(key, "_")
-			if len(parts) != 6 {
+			sep := strings.LastIndex(key, "_")
+			if _, err := strconv.Atoi(key[sep+1:]); err != nil {
 				return errors.Errorf("Wrong format of env variable name %s", key)
 			}
 
-			prefix := strings.Join(parts[0:5], "_")
+			prefix := key[:sep]
 
 			envsToDelete = append(envsToDelete, key)
 			envsToAdd[fmt.Sprintf("%s_%d", prefix, counter)] = value
@@ -0,0 +1,397 @@
+package kerneldrv
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	"k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+
+	dpapi "github.com/shuoyanshen/qat_plugin/pkg/deviceplugin"
+	"github.com/shuoyanshen/qat_plugin/pkg/metrics"
+	"github.com/shuoyanshen/qat_plugin/pkg/qatfixture"
+)
+
+// fakeAdfCtl returns a fake execer answering calls commands with the adf_ctl
+// status of the host.
+func fakeAdfCtl(host *qatfixture.Host, calls int) *fakeexec.FakeExec {
+	fake := &fakeexec.FakeExec{}
+
+	for i := 0; i < calls; i++ {
+		fakeCmd := &fakeexec.FakeCmd{
+			CombinedOutputScript: []fakeexec.FakeAction{
+				func() ([]byte, []byte, error) { return []byte(host.AdfCtlStatus()), nil, nil },
+			},
+		}
+
+		fake.CommandScript = append(fake.CommandScript, func(cmd string, args ...string) exec.Cmd {
+			return fakeexec.InitFakeCmd(fakeCmd, cmd, args...)
+		})
+	}
+
+	return fake
+}
+
+// goldenSlot is an expected slot of the device tree.
+type goldenSlot struct {
+	resource string
+	id       string
+	stableID string
+	section  string
+	env      string
+	cy, dc   int64
+	uio      []string
+	numa     []int64
+	health   string
+}
+
+func (s goldenSlot) deviceInfo(host *qatfixture.Host) dpapi.DeviceInfo {
+	nodes := []pluginapi.DeviceSpec{
+		newDeviceSpec("/dev/qat_adf_ctl"),
+		newDeviceSpec("/dev/qat_dev_processes"),
+		newDeviceSpec("/dev/usdm_drv"),
+	}
+
+	for _, uio := range s.uio {
+		nodes = append(nodes, newDeviceSpec("/dev/"+uio))
+	}
+
+	var topology *pluginapi.TopologyInfo
+
+	// The topology is unknown without device nodes.
+	if host.CharDevices() {
+		topology = &pluginapi.TopologyInfo{}
+		for _, node := range s.numa {
+			topology.Nodes = append(topology.Nodes, &pluginapi.NUMANode{ID: node})
+		}
+	}
+
+	envs := map[string]string{
+		s.env:              s.section,
+		"QAT_SECTION_NAME": s.section,
+	}
+
+	return dpapi.NewDeviceInfoWithTopologyHints(s.health, nodes, nil, envs, nil, topology).WithAttributes(map[string]int64{
+		"cryptoInstances":      s.cy,
+		"compressionInstances": s.dc,
+	}).WithStableID(s.stableID)
+}
+
+func goldenTree(host *qatfixture.Host, slots []goldenSlot) dpapi.DeviceTree {
+	tree := dpapi.NewDeviceTree()
+
+	for _, s := range slots {
+		tree.AddDevice(s.resource, s.id, s.deviceInfo(host))
+	}
+
+	return tree
+}
+
+type hostTestCase struct {
+	name  string
+	host  func(root string) *qatfixture.Host
+	slots []goldenSlot
+}
+
+func hostTestCases() []hostTestCase {
+	return []hostTestCase{
+		{
+			name: "c6xx",
+			host: func(root string) *qatfixture.Host {
+				conf := qatfixture.Conf(
+					qatfixture.Section{Name: "SSL", NumProcesses: 2, CyInstances: 2},
+					qatfixture.Section{Name: "PIN", NumProcesses: 1, CyInstances: 1, DcInstances: 1, LimitDevAccess: true},
+				)
+
+				return qatfixture.New(root).
+					AddDevice(qatfixture.Device{BDF: "0000:3f:00.0", DevType: "c6xx", NUMANode: 1, LocalCPUList: "16-31", UIO: []string{"uio2", "uio3"}, Conf: conf}).
+					AddDevice(qatfixture.Device{BDF: "0000:3d:00.0", DevType: "c6xx", NUMANode: 0, LocalCPUList: "0-15", UIO: []string{"uio0", "uio1"}, Conf: conf})
+			},
+			slots: []goldenSlot{
+				{resource: "cy1_dc1", id: "PIN_1", stableID: "PIN_0000:3d:00.0_0", section: "PIN", env: "QAT_SECTION_NAME_cy1_dc1_0", cy: 1, dc: 1, uio: []string{"uio0", "uio1"}, numa: []int64{0}, health: pluginapi.Healthy},
+				{resource: "cy1_dc1", id: "PIN_2", stableID: "PIN_0000:3f:00.0_0", section: "PIN", env: "QAT_SECTION_NAME_cy1_dc1_1", cy: 1, dc: 1, uio: []string{"uio2", "uio3"}, numa: []int64{1}, health: pluginapi.Healthy},
+				{resource: "cy2_dc0", id: "SSL_3", stableID: "SSL_0", section: "SSL", env: "QAT_SECTION_NAME_cy2_dc0_2", cy: 2, uio: []string{"uio0", "uio1", "uio2", "uio3"}, numa: []int64{0, 1}, health: pluginapi.Healthy},
+				{resource: "cy2_dc0", id: "SSL_4", stableID: "SSL_1", section: "SSL", env: "QAT_SECTION_NAME_cy2_dc0_3", cy: 2, uio: []string{"uio0", "uio1", "uio2", "uio3"}, numa: []int64{0, 1}, health: pluginapi.Healthy},
+			},
+		},
+		{
+			name: "4xxx with a device down",
+			host: func(root string) *qatfixture.Host {
+				conf := qatfixture.Conf(
+					qatfixture.Section{Name: "DC", NumProcesses: 1, DcInstances: 1},
+					qatfixture.Section{Name: "SSL", NumProcesses: 1, CyInstances: 1, LimitDevAccess: true},
+				)
+
+				return qatfixture.New(root).
+					AddDevice(qatfixture.Device{BDF: "0000:6b:00.0", DevType: "4xxx", State: "up", NUMANode: 0, LocalCPUList: "0-15", UIO: []string{"uio0"}, Conf: conf}).
+					AddDevice(qatfixture.Device{BDF: "0000:70:00.0", DevType: "4xxx", State: "down", NUMANode: 1, LocalCPUList: "16-31", UIO: []string{"uio1"}, Conf: conf})
+			},
+			slots: []goldenSlot{
+				{resource: "cy0_dc1", id: "DC_1", stableID: "DC_0", section: "DC", env: "QAT_SECTION_NAME_cy0_dc1_0", dc: 1, uio: []string{"uio0", "uio1"}, numa: []int64{0, 1}, health: pluginapi.Unhealthy},
+				{resource: "cy1_dc0", id: "SSL_2", stableID: "SSL_0000:6b:00.0_0", section: "SSL", env: "QAT_SECTION_NAME_cy1_dc0_1", cy: 1, uio: []string{"uio0"}, numa: []int64{0}, health: pluginapi.Healthy},
+				{resource: "cy1_dc0", id: "SSL_3", stableID: "SSL_0000:70:00.0_0", section: "SSL", env: "QAT_SECTION_NAME_cy1_dc0_2", cy: 1, uio: []string{"uio1"}, numa: []int64{1}, health: pluginapi.Unhealthy},
+			},
+		},
+		{
+			name: "c6xx VFs",
+			host: func(root string) *qatfixture.Host {
+				vfConf := qatfixture.Conf(qatfixture.Section{Name: "SSL", NumProcesses: 2, CyInstances: 1})
+
+				return qatfixture.New(root).
+					AddDevice(qatfixture.Device{BDF: "0000:3d:00.0", DevType: "c6xx", NUMANode: 0, LocalCPUList: "0-15", UIO: []string{"uio9"},
+						Conf: qatfixture.Conf(qatfixture.Section{Name: "PF", NumProcesses: 1, CyInstances: 1})}).
+					AddVF("0000:3d:01.1", "0000:3d:00.0", vfConf, "uio1").
+					AddVF("0000:3d:01.0", "0000:3d:00.0", vfConf, "uio0")
+			},
+			slots: []goldenSlot{
+				{resource: "cy1_dc0", id: "SSL_1", stableID: "SSL_0", section: "SSL", env: "QAT_SECTION_NAME_cy1_dc0_0", cy: 1, uio: []string{"uio0", "uio1"}, numa: []int64{0}, health: pluginapi.Healthy},
+				{resource: "cy1_dc0", id: "SSL_2", stableID: "SSL_1", section: "SSL", env: "QAT_SECTION_NAME_cy1_dc0_1", cy: 1, uio: []string{"uio0", "uio1"}, numa: []int64{0}, health: pluginapi.Healthy},
+			},
+		},
+	}
+}
+
+func buildHost(t *testing.T, tc hostTestCase) *qatfixture.Host {
+	t.Helper()
+
+	host := tc.host(t.TempDir())
+	if err := host.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	return host
+}
+
+func newTestPlugin(host *qatfixture.Host, discovery string, calls int) *DevicePlugin {
+	return newDevicePlugin(host.ConfigDir(), host.HostRoot(), discovery, time.Minute, time.Minute, PolicySpread, fakeAdfCtl(host, calls))
+}
+
+func TestGetDevTree(t *testing.T) {
+	for _, tc := range hostTestCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			host := buildHost(t, tc)
+			dp := newTestPlugin(host, DiscoveryAdfCtl, 1)
+
+			devices, err := dp.getOnlineDevices(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := dp.parseConfigs(devices)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tree, slots, err := getDevTree(host.HostRoot(), devices, config, DefaultPluginConfig())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := goldenTree(host, tc.slots); !reflect.DeepEqual(tree, expected) {
+				t.Errorf("expected device tree\n%+v\ngot\n%+v", expected, tree)
+			}
+
+			for _, s := range tc.slots {
+				if slots[s.id].resource != s.resource || slots[s.id].section != s.section {
+					t.Errorf("slot %s: expected %s of section %s, got %+v", s.id, s.resource, s.section, slots[s.id])
+				}
+			}
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	for _, tc := range hostTestCases() {
+		// The sysfs discovery doesn't run adf_ctl.
+		for discovery, calls := range map[string]int{DiscoveryAdfCtl: 1, DiscoverySysfs: 0} {
+			discovery, calls := discovery, calls
+
+			t.Run(tc.name+" "+discovery, func(t *testing.T) {
+				host := buildHost(t, tc)
+				dp := newTestPlugin(host, discovery, calls)
+
+				tree, err := dp.scan()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if expected := goldenTree(host, tc.slots); !reflect.DeepEqual(tree, expected) {
+					t.Errorf("expected device tree\n%+v\ngot\n%+v", expected, tree)
+				}
+			})
+		}
+	}
+}
+
+func TestFixtureInstanceIDs(t *testing.T) {
+	host := buildHost(t, hostTestCases()[2])
+
+	for bdf, id := range map[string]string{
+		"0000:3d:00.0": "dev0",
+		"0000:3d:01.0": "dev0",
+		"0000:3d:01.1": "dev1",
+	} {
+		if got := host.ID(bdf); got != id {
+			t.Errorf("%s: expected %s, got %s", bdf, id, got)
+		}
+	}
+
+	for discovery, calls := range map[string]int{DiscoveryAdfCtl: 1, DiscoverySysfs: 0} {
+		dp := newTestPlugin(host, discovery, calls)
+
+		devices, err := dp.listDevices()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(devices) != len(host.Devices) {
+			t.Errorf("%s: expected %d devices, got %d", discovery, len(host.Devices), len(devices))
+		}
+
+		for _, dev := range devices {
+			if dev.id != host.ID(dev.bsf) {
+				t.Errorf("%s: %s reports %s, the fixture %s", discovery, dev.bsf, dev.id, host.ID(dev.bsf))
+			}
+		}
+	}
+}
+
+func TestListDevicesSysfsFallback(t *testing.T) {
+	host := buildHost(t, hostTestCases()[0])
+
+	root := host.HostRoot()
+	root.Sysfs = filepath.Join(t.TempDir(), "missing")
+
+	dp := newDevicePlugin(host.ConfigDir(), root, DiscoverySysfs, time.Minute, time.Minute, PolicySpread, fakeAdfCtl(host, 1))
+
+	devices, err := dp.listDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != len(host.Devices) {
+		t.Errorf("expected the %d devices reported by adf_ctl, got %d", len(host.Devices), len(devices))
+	}
+}
+
+// treeNotifier passes the notified device trees to a channel until ctx is done.
+type treeNotifier struct {
+	ctx   context.Context
+	trees chan dpapi.DeviceTree
+}
+
+func (n *treeNotifier) Notify(tree dpapi.DeviceTree) {
+	select {
+	case n.trees <- tree:
+	case <-n.ctx.Done():
+	}
+}
+
+// scanCount returns the number of scans observed by the scan duration metric.
+func scanCount(t *testing.T) uint64 {
+	t.Helper()
+
+	m := &dto.Metric{}
+	if err := metrics.ScanDuration.Write(m); err != nil {
+		t.Fatal(err)
+	}
+
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestScanGracePeriod(t *testing.T) {
+	const gracePeriod = 300 * time.Millisecond
+
+	tc := hostTestCases()[0]
+	host := buildHost(t, tc)
+
+	// adf_ctl succeeds once and fails afterwards.
+	fake := fakeAdfCtl(host, 1)
+
+	for i := 0; i < 1000; i++ {
+		fakeCmd := &fakeexec.FakeCmd{
+			CombinedOutputScript: []fakeexec.FakeAction{
+				func() ([]byte, []byte, error) { return nil, nil, &fakeexec.FakeExitError{Status: 1} },
+			},
+		}
+
+		fake.CommandScript = append(fake.CommandScript, func(cmd string, args ...string) exec.Cmd {
+			return fakeexec.InitFakeCmd(fakeCmd, cmd, args...)
+		})
+	}
+
+	dp := newDevicePlugin(host.ConfigDir(), host.HostRoot(), DiscoveryAdfCtl, 10*time.Millisecond, gracePeriod, PolicySpread, fake)
+
+	scanErrors := testutil.ToFloat64(metrics.ScanErrors)
+	scans := scanCount(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notifier := &treeNotifier{ctx: ctx, trees: make(chan dpapi.DeviceTree)}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- dp.Scan(ctx, notifier)
+	}()
+
+	receive := func() dpapi.DeviceTree {
+		select {
+		case tree := <-notifier.trees:
+			return tree
+		case <-time.After(5 * time.Second):
+			t.Fatal("no device tree notified")
+			return nil
+		}
+	}
+
+	if tree, expected := receive(), goldenTree(host, tc.slots); !reflect.DeepEqual(tree, expected) {
+		t.Errorf("expected device tree\n%+v\ngot\n%+v", expected, tree)
+	}
+
+	// The healthy devices stay published until scans failed for the
+	// grace period.
+	start := time.Now()
+	tree := receive()
+
+	if failedFor := time.Since(start); failedFor < gracePeriod {
+		t.Errorf("device tree notified after failing for %v, within the grace period", failedFor)
+	}
+
+	unhealthy := []goldenSlot{}
+	for _, s := range tc.slots {
+		s.health = pluginapi.Unhealthy
+		unhealthy = append(unhealthy, s)
+	}
+
+	if expected := goldenTree(host, unhealthy); !reflect.DeepEqual(tree, expected) {
+		t.Errorf("expected unhealthy device tree\n%+v\ngot\n%+v", expected, tree)
+	}
+
+	// All scans are timed, the failed ones counted.
+	failed := testutil.ToFloat64(metrics.ScanErrors) - scanErrors
+	if failed < 1 {
+		t.Errorf("failed scans not counted")
+	}
+
+	if n := scanCount(t) - scans; float64(n) < failed+1 {
+		t.Errorf("expected at least %v timed scans, got %d", failed+1, n)
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Scan() failed: %+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scan() didn't return after the context was canceled")
+	}
+}
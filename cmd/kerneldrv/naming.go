@@ -0,0 +1,169 @@
+package kerneldrv
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultResourceTemplate names resources by the number of crypto and
+// compression instances of the sections.
+const DefaultResourceTemplate = "cy{cy}_dc{dc}"
+
+// maxResourceNameLength is the maximum length of the name part of an
+// extended resource name.
+const maxResourceNameLength = 63
+
+var (
+	// resourceNameRegex matches the name part of a qualified extended resource name.
+	resourceNameRegex = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	placeholderRegex  = regexp.MustCompile(`\{([^{}]*)\}`)
+	invalidEnvChars   = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// Placeholders of resource name templates.
+var resourcePlaceholders = map[string]bool{
+	"section": true,
+	"devtype": true,
+	"gen":     true,
+	"cy":      true,
+	"dc":      true,
+}
+
+// validateResourceName checks that name can follow the namespace of an
+// extended resource name.
+func validateResourceName(name string) error {
+	if len(name) > maxResourceNameLength {
+		return errors.Errorf("Resource name %q is longer than %d characters", name, maxResourceNameLength)
+	}
+
+	if !resourceNameRegex.MatchString(name) {
+		return errors.Errorf("Resource name %q must consist of alphanumeric characters, '-', '_' or '.', and must start and end with an alphanumeric character", name)
+	}
+
+	return nil
+}
+
+func validateResourceTemplate(template string) error {
+	if template == "" {
+		return errors.New("Resource name template is empty")
+	}
+
+	for _, match := range placeholderRegex.FindAllStringSubmatch(template, -1) {
+		if !resourcePlaceholders[match[1]] {
+			return errors.Errorf("Unknown placeholder {%s} in resource name template %q", match[1], template)
+		}
+	}
+
+	return nil
+}
+
+// resourceName returns the resource name of the section slots using the
+// endpoints of the given device types.
+func (c *PluginConfig) resourceName(sname string, s section, devtypes []string) (string, error) {
+	if name, ok := c.Resources.Names[sname]; ok {
+		return name, nil
+	}
+
+	var expandErr error
+
+	name := placeholderRegex.ReplaceAllStringFunc(c.Resources.Template, func(placeholder string) string {
+		switch strings.Trim(placeholder, "{}") {
+		case "section":
+			return sname
+		case "cy":
+			return strconv.Itoa(s.cryptoEngines)
+		case "dc":
+			return strconv.Itoa(s.compressionEngines)
+		case "devtype", "gen":
+			unique := uniqueStrings(devtypes)
+			if len(unique) != 1 {
+				expandErr = errors.Errorf("Section [%s] uses devices of types %v, %s is ambiguous", sname, unique, placeholder)
+				return ""
+			}
+
+			if placeholder == "{devtype}" {
+				return unique[0]
+			}
+
+			gen, ok := qatGenerations[strings.TrimSuffix(unique[0], "vf")]
+			if !ok {
+				expandErr = errors.Errorf("Section [%s] uses devices of type %s, its QAT generation is unknown", sname, unique[0])
+				return ""
+			}
+
+			return gen
+		}
+
+		return placeholder
+	})
+
+	if expandErr != nil {
+		return "", expandErr
+	}
+
+	if err := validateResourceName(name); err != nil {
+		return "", errors.Wrapf(err, "Invalid resource name of section [%s]", sname)
+	}
+
+	return name, nil
+}
+
+// sectionInstances are the instances of a section providing slots of a resource.
+type sectionInstances struct {
+	section string
+	cy, dc  int
+}
+
+// resourceInstances maps resource names to the instances of their slots.
+type resourceInstances map[string]sectionInstances
+
+// add records the instances of the section slots of the resource. All slots
+// of a resource must have the same instances, sections named explicitly or
+// by a template without {cy} and {dc} may not.
+func (r resourceInstances) add(resource, sname string, s section) error {
+	current := sectionInstances{section: sname, cy: s.cryptoEngines, dc: s.compressionEngines}
+
+	first, ok := r[resource]
+	if !ok {
+		r[resource] = current
+		return nil
+	}
+
+	if first.cy == current.cy && first.dc == current.dc {
+		return nil
+	}
+
+	// Keep the message stable regardless of the order of the sections.
+	if current.section < first.section {
+		first, current = current, first
+	}
+
+	return errors.Errorf("Sections [%s] (cy%d_dc%d) and [%s] (cy%d_dc%d) of resource %s have different numbers of instances",
+		first.section, first.cy, first.dc, current.section, current.cy, current.dc, resource)
+}
+
+// sectionEnvName returns the name of the env variable with the section name
+// of the slot.
+func sectionEnvName(resourceName string, slotIndex int) string {
+	return "QAT_SECTION_NAME_" + invalidEnvChars.ReplaceAllString(resourceName, "_") + "_" + strconv.Itoa(slotIndex)
+}
+
+func uniqueStrings(list []string) []string {
+	set := map[string]bool{}
+	unique := []string{}
+
+	for _, s := range list {
+		if !set[s] {
+			set[s] = true
+			unique = append(unique, s)
+		}
+	}
+
+	sort.Strings(unique)
+
+	return unique
+}
@@ -0,0 +1,111 @@
+package kerneldrv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResourceName(t *testing.T) {
+	tcases := []struct {
+		name     string
+		template string
+		names    map[string]string
+		section  section
+		devtypes []string
+		expected string
+		// err is a substring of the expected error, none if empty.
+		err string
+	}{
+		{
+			name:     "default template",
+			section:  section{cryptoEngines: 2, compressionEngines: 1},
+			devtypes: []string{"c6xx", "c6xx"},
+			expected: "cy2_dc1",
+		},
+		{
+			name:     "section and device type",
+			template: "{section}-{devtype}",
+			section:  section{cryptoEngines: 1},
+			devtypes: []string{"4xxxvf"},
+			expected: "SSL-4xxxvf",
+		},
+		{
+			name:     "generation of a VF",
+			template: "qat{gen}-cy{cy}",
+			section:  section{cryptoEngines: 1},
+			devtypes: []string{"c6xxvf", "c6xxvf"},
+			expected: "qat1.7-cy1",
+		},
+		{
+			name:     "unknown generation",
+			template: "qat{gen}",
+			devtypes: []string{"unknownvf"},
+			err:      "QAT generation is unknown",
+		},
+		{
+			name:     "ambiguous device type",
+			template: "{devtype}",
+			devtypes: []string{"c6xx", "4xxx"},
+			err:      "{devtype} is ambiguous",
+		},
+		{
+			name:     "explicit name",
+			names:    map[string]string{"SSL": "crypto"},
+			devtypes: []string{"c6xx", "4xxx"},
+			expected: "crypto",
+		},
+		{
+			name:     "invalid name",
+			template: "{section}_",
+			err:      "Invalid resource name of section [SSL]",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DefaultPluginConfig()
+			config.Resources.Names = tc.names
+
+			if tc.template != "" {
+				config.Resources.Template = tc.template
+			}
+
+			name, err := config.resourceName("SSL", tc.section, tc.devtypes)
+
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("unexpected error: %+v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			case name != tc.expected:
+				t.Errorf("expected resource name %q, got %q", tc.expected, name)
+			}
+		})
+	}
+}
+
+func TestResourceInstances(t *testing.T) {
+	instances := resourceInstances{}
+
+	if err := instances.add("crypto", "SSL", section{cryptoEngines: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// More slots of the same resource with the same instances.
+	if err := instances.add("crypto", "SSL", section{cryptoEngines: 2}); err != nil {
+		t.Error(err)
+	}
+
+	if err := instances.add("crypto", "NGINX", section{cryptoEngines: 2}); err != nil {
+		t.Error(err)
+	}
+
+	if err := instances.add("compression", "DC", section{compressionEngines: 1}); err != nil {
+		t.Error(err)
+	}
+
+	err := instances.add("crypto", "APP", section{cryptoEngines: 1, compressionEngines: 1})
+	if expected := "Sections [APP] (cy1_dc1) and [SSL] (cy2_dc0) of resource crypto have different numbers of instances"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
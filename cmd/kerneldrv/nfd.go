@@ -0,0 +1,125 @@
+package kerneldrv
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/nfd"
+)
+
+// qatGenerations maps PF device types to their QAT generation.
+var qatGenerations = map[string]string{
+	"dh895xcc": "1.6",
+	"c3xxx":    "1.7",
+	"c6xx":     "1.7",
+	"d15xx":    "1.7",
+	"4xxx":     "4",
+}
+
+// newerGeneration tells if the QAT generation gen is newer than other. Unknown
+// generations are older than any known one.
+func newerGeneration(gen, other string) bool {
+	g, err := strconv.ParseFloat(gen, 64)
+	if err != nil {
+		return false
+	}
+
+	o, err := strconv.ParseFloat(other, 64)
+
+	return err != nil || g > o
+}
+
+// EnableFeatureFile makes the plugin maintain an NFD feature file at path
+// with labels in labelNamespace describing the devices found by the scans.
+func (dp *DevicePlugin) EnableFeatureFile(path, labelNamespace string) {
+	dp.featureFile = path
+	dp.labelNamespace = labelNamespace
+}
+
+// getDriverVersion returns the version of the QAT kernel module or an empty
+// string if it's unknown.
+func getDriverVersion(sysfs string) string {
+	version, err := os.ReadFile(filepath.Join(sysfs, "module", "intel_qat", "version"))
+	if err != nil {
+		return ""
+	}
+
+	return string(bytes.TrimSpace(version))
+}
+
+// features returns the node labels describing the devices used by the plugin.
+func (dp *DevicePlugin) features(iommuOn bool, devices []device, config map[string]section) nfd.Features {
+	label := func(name string) string {
+		return dp.labelNamespace + "/" + name
+	}
+
+	features := nfd.Features{
+		label("iommu"): strconv.FormatBool(iommuOn),
+	}
+
+	if len(devices) == 0 {
+		return features
+	}
+
+	features[label("present")] = "true"
+	generation := ""
+	modes := map[string]bool{}
+
+	for _, dev := range devices {
+		features[label("devtype."+nfd.LabelValue(dev.devtype))] = "true"
+
+		if isVF(dev) {
+			modes["vf"] = true
+		} else {
+			modes["pf"] = true
+		}
+
+		if gen := qatGenerations[strings.TrimSuffix(dev.devtype, "vf")]; newerGeneration(gen, generation) {
+			generation = gen
+		}
+	}
+
+	switch {
+	case modes["pf"] && modes["vf"]:
+		features[label("mode")] = "mixed"
+	case modes["vf"]:
+		features[label("mode")] = "vf"
+	default:
+		features[label("mode")] = "pf"
+	}
+
+	if generation != "" {
+		features[label("gen")] = generation
+	}
+
+	if version := nfd.LabelValue(getDriverVersion(dp.root.Sysfs)); version != "" {
+		features[label("driver-version")] = version
+	}
+
+	for name := range config {
+		features[label("section."+nfd.LabelValue(name))] = "true"
+	}
+
+	return features
+}
+
+// updateFeatureFile rewrites the feature file if the features changed.
+func (dp *DevicePlugin) updateFeatureFile(features nfd.Features) {
+	if dp.featureFile == "" || features.Equal(dp.lastFeatures) {
+		return
+	}
+
+	if err := nfd.WriteFeatureFile(dp.featureFile, features); err != nil {
+		klog.Errorf("Unable to update NFD feature file: %+v", err)
+		return
+	}
+
+	klog.V(1).Infof("Updated NFD feature file %s", dp.featureFile)
+
+	dp.lastFeatures = features
+}
@@ -0,0 +1,121 @@
+package kerneldrv
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/hostroot"
+	"github.com/shuoyanshen/qat_plugin/pkg/nfd"
+)
+
+func TestFeatures(t *testing.T) {
+	const ns = "qat.intel.com"
+
+	tcases := []struct {
+		name     string
+		devices  []device
+		config   map[string]section
+		iommuOn  bool
+		expected nfd.Features
+	}{
+		{
+			name:     "no devices",
+			iommuOn:  true,
+			expected: nfd.Features{ns + "/iommu": "true"},
+		},
+		{
+			name:    "dh895xcc",
+			devices: []device{{bsf: "0000:3d:00.0", devtype: "dh895xcc"}},
+			config:  map[string]section{"SSL": {}},
+			expected: nfd.Features{
+				ns + "/iommu":            "false",
+				ns + "/present":          "true",
+				ns + "/devtype.dh895xcc": "true",
+				ns + "/mode":             "pf",
+				ns + "/gen":              "1.6",
+				ns + "/driver-version":   "0.6.0",
+				ns + "/section.SSL":      "true",
+			},
+		},
+		{
+			name: "newest generation of mixed device types",
+			devices: []device{
+				{bsf: "0000:3d:00.0", devtype: "dh895xcc"},
+				{bsf: "0000:6b:00.1", devtype: "4xxxvf"},
+				{bsf: "0000:3f:00.0", devtype: "c6xx"},
+			},
+			iommuOn: true,
+			expected: nfd.Features{
+				ns + "/iommu":            "true",
+				ns + "/present":          "true",
+				ns + "/devtype.dh895xcc": "true",
+				ns + "/devtype.4xxxvf":   "true",
+				ns + "/devtype.c6xx":     "true",
+				ns + "/mode":             "mixed",
+				ns + "/gen":              "4",
+				ns + "/driver-version":   "0.6.0",
+			},
+		},
+		{
+			name: "unknown device type",
+			devices: []device{
+				{bsf: "0000:3d:01.0", devtype: "c6xxvf"},
+				{bsf: "0000:3e:01.0", devtype: "unknownvf"},
+			},
+			expected: nfd.Features{
+				ns + "/iommu":             "false",
+				ns + "/present":           "true",
+				ns + "/devtype.c6xxvf":    "true",
+				ns + "/devtype.unknownvf": "true",
+				ns + "/mode":              "vf",
+				ns + "/gen":               "1.7",
+				ns + "/driver-version":    "0.6.0",
+			},
+		},
+	}
+
+	sysfs := t.TempDir()
+	versionFile := filepath.Join(sysfs, "module", "intel_qat", "version")
+
+	if err := os.MkdirAll(filepath.Dir(versionFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(versionFile, []byte("0.6.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dp := &DevicePlugin{root: hostroot.Root{Sysfs: sysfs}, labelNamespace: ns}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if features := dp.features(tc.iommuOn, tc.devices, tc.config); !reflect.DeepEqual(features, tc.expected) {
+				t.Errorf("expected features\n%v\ngot\n%v", tc.expected, features)
+			}
+		})
+	}
+}
+
+func TestNewerGeneration(t *testing.T) {
+	tcases := []struct {
+		gen      string
+		other    string
+		expected bool
+	}{
+		{gen: "1.7", other: "1.6", expected: true},
+		{gen: "1.6", other: "1.7", expected: false},
+		{gen: "4", other: "1.7", expected: true},
+		{gen: "1.7", other: "4", expected: false},
+		{gen: "1.7", other: "", expected: true},
+		{gen: "", other: "1.7", expected: false},
+		{gen: "4", other: "4", expected: false},
+	}
+
+	for _, tc := range tcases {
+		if newer := newerGeneration(tc.gen, tc.other); newer != tc.expected {
+			t.Errorf("newerGeneration(%q, %q): expected %t, got %t", tc.gen, tc.other, tc.expected, newer)
+		}
+	}
+}
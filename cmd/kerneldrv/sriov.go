@@ -0,0 +1,444 @@
+package kerneldrv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/podresources"
+)
+
+// VF counts and drivers of SR-IOV rules.
+const (
+	// VFsMax enables all VFs the PF supports.
+	VFsMax = "max"
+	// VFDriverQAT binds VFs to the QAT VF driver of the PF device type.
+	VFDriverQAT = "qat"
+	// VFDriverVfioPci binds VFs to vfio-pci for user space drivers.
+	VFDriverVfioPci = "vfio-pci"
+)
+
+const (
+	// vfTimeout is how long to wait for enabled VFs to appear and bind.
+	vfTimeout      = 30 * time.Second
+	vfPollInterval = 100 * time.Millisecond
+)
+
+func (r VFRule) validate() error {
+	if err := r.DeviceMatch.validate(); err != nil {
+		return err
+	}
+
+	if r.NumVFs == "" {
+		return errors.New("SR-IOV rules must set numvfs")
+	}
+
+	if _, err := r.numVFs(0); err != nil {
+		return err
+	}
+
+	if r.Driver != "" && r.Driver != VFDriverQAT && r.Driver != VFDriverVfioPci {
+		return errors.Errorf("Unknown VF driver %q, supported drivers: %s, %s", r.Driver, VFDriverQAT, VFDriverVfioPci)
+	}
+
+	return nil
+}
+
+// validateFunctions rejects binding VFs to vfio-pci under the vf-only
+// policy. The plugin doesn't use vfio-pci VFs, so the PFs would be left
+// without endpoints.
+func (r VFRule) validateFunctions(functions FunctionsConfig) error {
+	if r.Driver != VFDriverVfioPci {
+		return nil
+	}
+
+	if functions.Policy == FunctionsVFOnly {
+		return errors.Errorf("VFs bound to %s can't be used with the %s policy", VFDriverVfioPci, FunctionsVFOnly)
+	}
+
+	for _, pf := range functions.PFs {
+		if pf.Policy == FunctionsVFOnly && (r.BDF == "" || matchPattern(fullBDF(r.BDF), fullBDF(pf.BDF))) {
+			return errors.Errorf("VFs bound to %s can't be used with the %s policy of %s", VFDriverVfioPci, FunctionsVFOnly, pf.BDF)
+		}
+	}
+
+	return nil
+}
+
+// numVFs returns the number of VFs to enable on a PF supporting total VFs.
+func (r VFRule) numVFs(total int) (int, error) {
+	if r.NumVFs == VFsMax {
+		return total, nil
+	}
+
+	n, err := strconv.Atoi(r.NumVFs)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("Bad numvfs %q, must be a non-negative number or %s", r.NumVFs, VFsMax)
+	}
+
+	return n, nil
+}
+
+// driver returns the name of the driver the VFs of a PF of devtype are bound to.
+func (r VFRule) driver(devtype string) string {
+	if r.Driver == VFDriverVfioPci {
+		return VFDriverVfioPci
+	}
+
+	return devtype + "vf"
+}
+
+// vfRule returns the first SR-IOV rule matching the PF or nil.
+func (c *PluginConfig) vfRule(pf device) *VFRule {
+	for i := range c.SRIOV.PFs {
+		if c.SRIOV.PFs[i].matches(pf) {
+			return &c.SRIOV.PFs[i]
+		}
+	}
+
+	return nil
+}
+
+// AllocationLister lists the devices assigned to containers, e.g. a
+// podresources.Tracker.
+type AllocationLister interface {
+	Allocations() ([]podresources.Allocation, time.Time)
+}
+
+// SetAllocationLister lets the plugin keep the VFs used by containers when
+// it changes the number of VFs or tears them down.
+func (dp *DevicePlugin) SetAllocationLister(lister AllocationLister) {
+	dp.allocations = lister
+}
+
+// allocatedPFs returns the PCI addresses of the PFs whose functions are
+// assigned to containers. ok is false if the allocations are unknown.
+func (dp *DevicePlugin) allocatedPFs() (pfs map[string]bool, ok bool) {
+	if dp.allocations == nil {
+		return nil, false
+	}
+
+	allocations, updated := dp.allocations.Allocations()
+	if updated.IsZero() {
+		return nil, false
+	}
+
+	pfs = map[string]bool{}
+
+	for _, a := range allocations {
+		endpoints := dp.SlotEndpoints(a.Resource, a.DeviceID)
+		if endpoints == nil {
+			// Slots unknown to the last scan may use any PF.
+			return nil, false
+		}
+
+		for _, bdf := range endpoints {
+			if pf := getPhysFn(dp.root.Sysfs, bdf); pf != "" {
+				bdf = pf
+			}
+
+			pfs[bdf] = true
+		}
+	}
+
+	return pfs, true
+}
+
+// vfsInUse returns why the enabled VFs of the PF can't be disabled or an
+// empty string if they can. VFs bound to driver, the driver of the SR-IOV
+// rule, are in use only if they are allocated to containers, VFs bound to
+// other drivers are used outside of the plugin.
+func (dp *DevicePlugin) vfsInUse(pf, driver string) string {
+	allocated, ok := dp.allocatedPFs()
+	if ok && allocated[pf] {
+		return "VFs are allocated to containers"
+	}
+
+	vfs, _ := filepath.Glob(dp.root.Sys("bus", "pci", "devices", pf, "virtfn*"))
+
+	for _, vf := range vfs {
+		switch current := getDriver(vf); {
+		case current == "":
+		case current != driver:
+			return fmt.Sprintf("VF %s is bound to %s", filepath.Base(vf), current)
+		case !ok:
+			return fmt.Sprintf("VF %s is bound to %s and the allocations of containers are unknown", filepath.Base(vf), current)
+		}
+	}
+
+	return ""
+}
+
+// provisionVFs enables the VFs of the PFs matching the SR-IOV rules and
+// binds them to the configured driver. Failures are logged per PF so that
+// one PF doesn't prevent provisioning of the others. It returns false if
+// any PF failed.
+func (dp *DevicePlugin) provisionVFs() bool {
+	if len(dp.config.SRIOV.PFs) == 0 {
+		return true
+	}
+
+	devices, err := listPCIFunctions(dp.root.Sysfs)
+	if err != nil {
+		klog.Errorf("Can't provision VFs: %+v", err)
+		return false
+	}
+
+	provisioned := true
+
+	for _, dev := range devices {
+		if isVF(dev) {
+			continue
+		}
+
+		rule := dp.config.vfRule(dev)
+		if rule == nil {
+			continue
+		}
+
+		if err := dp.provisionPF(dev, rule); err != nil {
+			klog.Errorf("Failed to provision VFs of %s: %+v", dev.bsf, err)
+
+			provisioned = false
+		}
+	}
+
+	return provisioned
+}
+
+func (dp *DevicePlugin) provisionPF(pf device, rule *VFRule) error {
+	pfDir := dp.root.Sys("bus", "pci", "devices", pf.bsf)
+
+	total, err := readSysfsInt(filepath.Join(pfDir, "sriov_totalvfs"))
+	if err != nil {
+		return err
+	}
+
+	want, err := rule.numVFs(total)
+	if err != nil {
+		return err
+	}
+
+	if want > total {
+		return errors.Errorf("%d VFs requested, %s supports %d", want, pf.bsf, total)
+	}
+
+	current, err := readSysfsInt(filepath.Join(pfDir, "sriov_numvfs"))
+	if err != nil {
+		return err
+	}
+
+	driver := rule.driver(pf.devtype)
+
+	if current != want {
+		// The kernel refuses to change the number of enabled VFs directly.
+		// Disabling them first would pull them from under their users.
+		if current != 0 {
+			if reason := dp.vfsInUse(pf.bsf, driver); reason != "" {
+				return errors.Errorf("Refusing to change the number of VFs from %d to %d, %s", current, want, reason)
+			}
+
+			if err := writeToSysfs(filepath.Join(pfDir, "sriov_numvfs"), "0"); err != nil {
+				return err
+			}
+		}
+
+		if want > 0 {
+			if err := writeToSysfs(filepath.Join(pfDir, "sriov_numvfs"), strconv.Itoa(want)); err != nil {
+				return err
+			}
+
+			dp.addProvisionedPF(pf.bsf)
+		}
+
+		klog.InfoS("Changed the number of VFs", "pf", pf.bsf, "from", current, "to", want)
+	}
+
+	if want == 0 {
+		return nil
+	}
+
+	var vfs []string
+
+	err = waitFor(func() bool {
+		vfs = getVFs(pfDir, want)
+		return vfs != nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "%d VFs didn't appear", want)
+	}
+
+	if _, err := os.Stat(dp.root.Sys("bus", "pci", "drivers", driver)); err != nil {
+		return errors.Errorf("Driver %s is not loaded", driver)
+	}
+
+	for _, vf := range vfs {
+		if err := dp.bindVF(vf, driver); err != nil {
+			return err
+		}
+	}
+
+	err = waitFor(func() bool {
+		for _, vf := range vfs {
+			if getDriver(dp.root.Sys("bus", "pci", "devices", vf)) != driver {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	return errors.Wrapf(err, "VFs didn't bind to %s", driver)
+}
+
+// addProvisionedPF records that the plugin enabled VFs of the PF.
+func (dp *DevicePlugin) addProvisionedPF(pf string) {
+	dp.provisionMutex.Lock()
+	defer dp.provisionMutex.Unlock()
+
+	for _, provisioned := range dp.provisionedPFs {
+		if provisioned == pf {
+			return
+		}
+	}
+
+	dp.provisionedPFs = append(dp.provisionedPFs, pf)
+}
+
+// getVFs returns the PCI addresses of the first n VFs of the PF or nil if
+// they don't all exist yet.
+func getVFs(pfDir string, n int) []string {
+	vfs := []string{}
+
+	for i := 0; i < n; i++ {
+		vf, err := os.Readlink(filepath.Join(pfDir, fmt.Sprintf("virtfn%d", i)))
+		if err != nil {
+			return nil
+		}
+
+		vfs = append(vfs, filepath.Base(vf))
+	}
+
+	return vfs
+}
+
+// bindVF binds the VF to the driver through driver_override, unbinding it
+// from its current driver first.
+func (dp *DevicePlugin) bindVF(bdf, driver string) error {
+	devDir := dp.root.Sys("bus", "pci", "devices", bdf)
+
+	current := getDriver(devDir)
+	if current == driver {
+		return nil
+	}
+
+	if err := writeToSysfs(filepath.Join(devDir, "driver_override"), driver); err != nil {
+		return err
+	}
+
+	if current != "" {
+		if err := writeToSysfs(filepath.Join(devDir, "driver", "unbind"), bdf); err != nil {
+			return err
+		}
+	}
+
+	if err := writeToSysfs(dp.root.Sys("bus", "pci", "drivers_probe"), bdf); err != nil {
+		return err
+	}
+
+	klog.V(1).Infof("Bound %s from %q to %s", bdf, current, driver)
+
+	return nil
+}
+
+// Teardown disables the VFs enabled by the plugin if the SR-IOV config asks
+// for it. PFs with VFs allocated to containers keep their VFs, as do all
+// PFs if the allocations are unknown.
+func (dp *DevicePlugin) Teardown() {
+	if !dp.config.SRIOV.Teardown {
+		return
+	}
+
+	dp.provisionMutex.Lock()
+	defer dp.provisionMutex.Unlock()
+
+	if len(dp.provisionedPFs) == 0 {
+		return
+	}
+
+	allocated, ok := dp.allocatedPFs()
+	if !ok {
+		klog.Errorf("Can't tell which VFs are allocated to containers, VFs of %v are left enabled", dp.provisionedPFs)
+		return
+	}
+
+	for _, pf := range dp.provisionedPFs {
+		if allocated[pf] {
+			klog.Errorf("VFs of %s are allocated to containers, leaving them enabled", pf)
+			continue
+		}
+
+		if err := writeToSysfs(dp.root.Sys("bus", "pci", "devices", pf, "sriov_numvfs"), "0"); err != nil {
+			klog.Errorf("Failed to disable VFs of %s: %+v", pf, err)
+			continue
+		}
+
+		klog.InfoS("Disabled VFs", "pf", pf)
+	}
+
+	dp.provisionedPFs = nil
+}
+
+// waitFor polls cond until it returns true or vfTimeout passes.
+func waitFor(cond func() bool) error {
+	deadline := time.Now().Add(vfTimeout)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			return errors.Errorf("Timed out after %v", vfTimeout)
+		}
+
+		time.Sleep(vfPollInterval)
+	}
+
+	return nil
+}
+
+// getDriver returns the name of the driver the device is bound to or an empty string.
+func getDriver(devDir string) string {
+	driver, err := filepath.EvalSymlinks(filepath.Join(devDir, "driver"))
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Base(driver)
+}
+
+func readSysfsInt(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Can't read %s", path)
+	}
+
+	n, err := strconv.Atoi(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "Can't parse %s", path)
+	}
+
+	return n, nil
+}
+
+func writeToSysfs(path, value string) error {
+	if err := os.WriteFile(path, []byte(value), 0600); err != nil {
+		return errors.Wrapf(err, "Can't write %q to %s", value, path)
+	}
+
+	return nil
+}
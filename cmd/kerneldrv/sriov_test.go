@@ -0,0 +1,307 @@
+package kerneldrv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/podresources"
+	"github.com/shuoyanshen/qat_plugin/pkg/qatfixture"
+)
+
+const testPF = "0000:3d:00.0"
+
+type fakeAllocations struct {
+	allocations []podresources.Allocation
+	updated     time.Time
+}
+
+func (f *fakeAllocations) Allocations() ([]podresources.Allocation, time.Time) {
+	return f.allocations, f.updated
+}
+
+func TestVFRuleValidateFunctions(t *testing.T) {
+	tcases := []struct {
+		name      string
+		functions FunctionsConfig
+		rule      VFRule
+		valid     bool
+	}{
+		{
+			name:      "vfio-pci with the vf-only policy",
+			functions: FunctionsConfig{Policy: FunctionsVFOnly},
+			rule:      VFRule{DeviceMatch: DeviceMatch{DevType: "4xxx"}, NumVFs: VFsMax, Driver: VFDriverVfioPci},
+		},
+		{
+			name:      "vfio-pci with the vf-only policy of the PF",
+			functions: FunctionsConfig{Policy: FunctionsAuto, PFs: []PFPolicy{{BDF: "3f:00.0", Policy: FunctionsVFOnly}}},
+			rule:      VFRule{DeviceMatch: DeviceMatch{BDF: "0000:3f:00.0"}, NumVFs: "4", Driver: VFDriverVfioPci},
+		},
+		{
+			name:      "vfio-pci with the vf-only policy of another PF",
+			functions: FunctionsConfig{Policy: FunctionsAuto, PFs: []PFPolicy{{BDF: "0000:3d:00.0", Policy: FunctionsVFOnly}}},
+			rule:      VFRule{DeviceMatch: DeviceMatch{BDF: "0000:3f:00.0"}, NumVFs: "4", Driver: VFDriverVfioPci},
+			valid:     true,
+		},
+		{
+			name:      "vfio-pci with the mixed policy",
+			functions: FunctionsConfig{Policy: FunctionsMixed},
+			rule:      VFRule{DeviceMatch: DeviceMatch{DevType: "4xxx"}, NumVFs: VFsMax, Driver: VFDriverVfioPci},
+			valid:     true,
+		},
+		{
+			name:      "QAT VF driver with the vf-only policy",
+			functions: FunctionsConfig{Policy: FunctionsVFOnly},
+			rule:      VFRule{DeviceMatch: DeviceMatch{DevType: "4xxx"}, NumVFs: VFsMax},
+			valid:     true,
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := DefaultPluginConfig()
+			config.Functions = tc.functions
+			config.SRIOV.PFs = []VFRule{tc.rule}
+
+			if err := config.validate(); (err == nil) != tc.valid {
+				t.Errorf("expected valid=%t, got %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+// newSRIOVTest returns a plugin on a host with the two VFs of testPF
+// enabled. The VFs are bound to the QAT VF driver unless unbound is set.
+func newSRIOVTest(t *testing.T, unbound bool) (*DevicePlugin, *qatfixture.Host) {
+	t.Helper()
+
+	tc := hostTestCases()[2]
+	host := tc.host(t.TempDir())
+
+	for i := range host.Devices {
+		if host.Devices[i].PhysFn != "" {
+			host.Devices[i].Unbound = unbound
+		}
+	}
+
+	if err := host.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	dp := newTestPlugin(host, DiscoveryAdfCtl, 1)
+	dp.config.SRIOV = SRIOVConfig{
+		Teardown: true,
+		PFs:      []VFRule{{DeviceMatch: DeviceMatch{BDF: testPF}, NumVFs: "1"}},
+	}
+
+	return dp, host
+}
+
+func readNumVFs(t *testing.T, host *qatfixture.Host) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(host.SysfsDir(), "bus", "pci", "devices", testPF, "sriov_numvfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+func TestProvisionVFs(t *testing.T) {
+	tcases := []struct {
+		name        string
+		driver      string
+		allocations AllocationLister
+		// err is a substring of the expected refusal, none if empty.
+		err    string
+		numVFs string
+	}{
+		{
+			name:        "VFs bound to another driver",
+			driver:      VFDriverVfioPci,
+			allocations: &fakeAllocations{allocations: []podresources.Allocation{}, updated: time.Now()},
+			err:         "is bound to c6xxvf",
+			numVFs:      "2",
+		},
+		{
+			name:   "allocations unknown",
+			err:    "allocations of containers are unknown",
+			numVFs: "2",
+		},
+		{
+			name: "VFs allocated",
+			allocations: &fakeAllocations{
+				allocations: []podresources.Allocation{{Resource: "cy1_dc0", DeviceID: "SSL_1"}},
+				updated:     time.Now(),
+			},
+			err:    "VFs are allocated to containers",
+			numVFs: "2",
+		},
+		{
+			name:        "unallocated VFs bound to the QAT VF driver",
+			allocations: &fakeAllocations{allocations: []podresources.Allocation{}, updated: time.Now()},
+			numVFs:      "1",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dp, host := newSRIOVTest(t, false)
+			dp.config.SRIOV.PFs[0].Driver = tc.driver
+
+			if _, err := dp.scan(); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.allocations != nil {
+				dp.SetAllocationLister(tc.allocations)
+			}
+
+			pfs, err := listPCIFunctions(host.SysfsDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			found := false
+
+			for _, pf := range pfs {
+				if pf.bsf != testPF {
+					continue
+				}
+
+				found = true
+
+				err := dp.provisionPF(pf, dp.config.vfRule(pf))
+
+				switch {
+				case tc.err == "" && err != nil:
+					t.Errorf("unexpected error: %+v", err)
+				case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+					t.Errorf("expected a refusal %q, got %v", tc.err, err)
+				}
+			}
+
+			if !found {
+				t.Fatalf("PF %s not listed", testPF)
+			}
+
+			if numVFs := readNumVFs(t, host); numVFs != tc.numVFs {
+				t.Errorf("expected %s VFs, got %s", tc.numVFs, numVFs)
+			}
+		})
+	}
+}
+
+func TestProvisionVFsRetries(t *testing.T) {
+	dp, host := newSRIOVTest(t, false)
+
+	if _, err := dp.scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The VFs can't be resized until the allocations are known.
+	if dp.provisionVFs() {
+		t.Error("provisioning succeeded with unknown allocations")
+	}
+
+	dp.SetAllocationLister(&fakeAllocations{allocations: []podresources.Allocation{}, updated: time.Now()})
+
+	for i := 0; i < 2; i++ {
+		if !dp.provisionVFs() {
+			t.Fatal("provisioning failed")
+		}
+
+		// Enable the VFs again to resize them twice.
+		if err := os.WriteFile(filepath.Join(host.SysfsDir(), "bus", "pci", "devices", testPF, "sriov_numvfs"), []byte("2"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(dp.provisionedPFs) != 1 || dp.provisionedPFs[0] != testPF {
+		t.Errorf("expected provisioned PFs [%s], got %v", testPF, dp.provisionedPFs)
+	}
+}
+
+func TestVFsInUse(t *testing.T) {
+	dp, _ := newSRIOVTest(t, true)
+
+	if reason := dp.vfsInUse(testPF, "c6xxvf"); reason != "" {
+		t.Errorf("unbound VFs in use: %s", reason)
+	}
+
+	if _, err := dp.scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	dp.SetAllocationLister(&fakeAllocations{
+		allocations: []podresources.Allocation{{Resource: "cy1_dc0", DeviceID: "SSL_1"}},
+		updated:     time.Now(),
+	})
+
+	if reason := dp.vfsInUse(testPF, "c6xxvf"); reason != "VFs are allocated to containers" {
+		t.Errorf("allocated VFs not in use: %q", reason)
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	tcases := []struct {
+		name        string
+		allocations AllocationLister
+		numVFs      string
+	}{
+		{
+			name:   "allocations unknown",
+			numVFs: "2",
+		},
+		{
+			name:        "allocations not updated yet",
+			allocations: &fakeAllocations{},
+			numVFs:      "2",
+		},
+		{
+			name: "VF allocated",
+			allocations: &fakeAllocations{
+				allocations: []podresources.Allocation{{Resource: "cy1_dc0", DeviceID: "SSL_2"}},
+				updated:     time.Now(),
+			},
+			numVFs: "2",
+		},
+		{
+			name: "allocated slot unknown",
+			allocations: &fakeAllocations{
+				allocations: []podresources.Allocation{{Resource: "cy1_dc0", DeviceID: "SSL_9"}},
+				updated:     time.Now(),
+			},
+			numVFs: "2",
+		},
+		{
+			name:        "no VFs allocated",
+			allocations: &fakeAllocations{allocations: []podresources.Allocation{}, updated: time.Now()},
+			numVFs:      "0",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			dp, host := newSRIOVTest(t, false)
+
+			if _, err := dp.scan(); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.allocations != nil {
+				dp.SetAllocationLister(tc.allocations)
+			}
+
+			dp.provisionedPFs = []string{testPF}
+			dp.Teardown()
+
+			if numVFs := readNumVFs(t, host); numVFs != tc.numVFs {
+				t.Errorf("expected %s VFs, got %s", tc.numVFs, numVFs)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package kerneldrv
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"k8s.io/klog/v2"
+)
+
+const vendorIntel = "8086"
+
+// QAT PCI device ID -> devtype as reported by adf_ctl. The devtype equals
+// the name of the kernel driver the device must be bound to.
+var qatDeviceTypes = map[string]string{
+	"0435": "dh895xcc",
+	"0443": "dh895xccvf",
+	"19e2": "c3xxx",
+	"19e3": "c3xxxvf",
+	"37c8": "c6xx",
+	"37c9": "c6xxvf",
+	"6f54": "d15xx",
+	"6f55": "d15xxvf",
+	"4940": "4xxx",
+	"4941": "4xxxvf",
+	"4942": "4xxx",
+	"4943": "4xxxvf",
+	"4944": "4xxx",
+	"4945": "4xxxvf",
+}
+
+// listPCIFunctions lists QAT devices bound to the QAT kernel driver by
+// reading PCI IDs and the driver binding. The state is read from the
+// qat/state attribute of gen4 devices and left empty for older devices.
+func listPCIFunctions(sysfs string) ([]device, error) {
+	pciDeviceDir := filepath.Join(sysfs, "bus", "pci", "devices")
+
+	pciDevs, err := os.ReadDir(pciDeviceDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't read %s", pciDeviceDir)
+	}
+
+	devices := []device{}
+
+	for _, pciDev := range pciDevs {
+		devDir := filepath.Join(pciDeviceDir, pciDev.Name())
+
+		vendor, err := readSysfsID(filepath.Join(devDir, "vendor"))
+		if err != nil || vendor != vendorIntel {
+			continue
+		}
+
+		devID, err := readSysfsID(filepath.Join(devDir, "device"))
+		if err != nil {
+			return nil, err
+		}
+
+		devtype, ok := qatDeviceTypes[devID]
+		if !ok {
+			continue
+		}
+
+		driver, err := filepath.EvalSymlinks(filepath.Join(devDir, "driver"))
+		if err != nil || filepath.Base(driver) != devtype {
+			klog.V(4).Infof("Skip %s %s not bound to the %s driver", devtype, pciDev.Name(), devtype)
+			continue
+		}
+
+		state := ""
+
+		if stateBytes, err := os.ReadFile(filepath.Join(devDir, "qat", "state")); err == nil {
+			state = string(bytes.TrimSpace(stateBytes))
+		} else if !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "Can't read state of %s", pciDev.Name())
+		}
+
+		devices = append(devices, device{
+			devtype: devtype,
+			bsf:     pciDev.Name(),
+			state:   state,
+		})
+	}
+
+	return devices, nil
+}
+
+// listDevicesSysfs lists QAT devices bound to the QAT kernel driver.
+// Devices without the qat/state attribute (pre-gen4 drivers) are reported
+// as up.
+//
+// The driver numbers the devices of each device type separately in probe
+// order, which is PFs followed by VFs, each in PCI address order. The device
+// IDs follow the same scheme so that they match the dev<N> suffix of the
+// configuration files.
+func listDevicesSysfs(sysfs string) ([]device, error) {
+	functions, err := listPCIFunctions(sysfs)
+	if err != nil {
+		return nil, err
+	}
+
+	pfs := []device{}
+	vfs := []device{}
+
+	for _, dev := range functions {
+		if dev.state == "" {
+			dev.state = "up"
+		}
+
+		if strings.HasSuffix(dev.devtype, "vf") {
+			vfs = append(vfs, dev)
+		} else {
+			pfs = append(pfs, dev)
+		}
+	}
+
+	sort.Slice(pfs, func(i, j int) bool { return pfs[i].bsf < pfs[j].bsf })
+	sort.Slice(vfs, func(i, j int) bool { return vfs[i].bsf < vfs[j].bsf })
+
+	devices := append(pfs, vfs...)
+	next := map[string]int{}
+
+	for i := range devices {
+		devices[i].id = fmt.Sprintf("dev%d", next[devices[i].devtype])
+		next[devices[i].devtype]++
+	}
+
+	return devices, nil
+}
+
+// readSysfsID reads a PCI ID attribute like vendor or device without the 0x prefix.
+func readSysfsID(path string) (string, error) {
+	id, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Can't read %s", path)
+	}
+
+	return strings.TrimPrefix(string(bytes.TrimSpace(id)), "0x"), nil
+}
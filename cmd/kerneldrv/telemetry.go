@@ -0,0 +1,72 @@
+package kerneldrv
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/metrics"
+	"github.com/shuoyanshen/qat_plugin/pkg/telemetry"
+)
+
+// EnableTelemetry exports telemetry of the devices found by the scans with
+// the plugin metrics. It's read from debugfs under the host sysfs. With
+// startSampling the plugin starts telemetry sampling of gen4 devices, which
+// is otherwise left to the administrator.
+func (dp *DevicePlugin) EnableTelemetry(startSampling bool) error {
+	collector := telemetry.NewCollector(dp.root.Sys("kernel", "debug"), startSampling)
+
+	if err := metrics.Registry.Register(collector); err != nil {
+		return errors.Wrap(err, "Failed to register telemetry collector")
+	}
+
+	dp.telemetry = collector
+
+	return nil
+}
+
+// telemetryDevices returns the devices with the resources whose slots use
+// them. Slots of pinned sections use their endpoint, the other slots use
+// all endpoints of their section.
+func telemetryDevices(sysfs string, devices []device, config map[string]section, slots map[string]slot) []telemetry.Device {
+	resources := map[string]map[string]bool{}
+
+	addResource := func(id, resource string) {
+		if resources[id] == nil {
+			resources[id] = map[string]bool{}
+		}
+
+		resources[id][resource] = true
+	}
+
+	for _, s := range slots {
+		if s.endpoint != "" {
+			addResource(s.endpoint, s.resource)
+			continue
+		}
+
+		for _, ep := range config[s.section].endpoints {
+			addResource(ep.id, s.resource)
+		}
+	}
+
+	telemetryDevs := make([]telemetry.Device, 0, len(devices))
+
+	for _, dev := range devices {
+		names := make([]string, 0, len(resources[dev.id]))
+		for name := range resources[dev.id] {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		telemetryDevs = append(telemetryDevs, telemetry.Device{
+			BDF:       fullBDF(dev.bsf),
+			DevType:   dev.devtype,
+			NUMANode:  getNUMANode(sysfs, dev.bsf),
+			Resources: names,
+		})
+	}
+
+	return telemetryDevs
+}
@@ -0,0 +1,224 @@
+package kerneldrv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-ini/ini"
+	"github.com/pkg/errors"
+)
+
+// confFileRegex matches the names of driver configuration files, e.g. c6xx_dev0.conf.
+var confFileRegex = regexp.MustCompile(`^([[:alnum:]]+)_(dev[0-9]+)\.conf$`)
+
+func confFileName(devtype, devID string) string {
+	return fmt.Sprintf("%s_%s.conf", devtype, devID)
+}
+
+// ConfigViolation is a problem found in a driver configuration file.
+type ConfigViolation struct {
+	File    string `json:"file"`
+	Section string `json:"section,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+func (v *ConfigViolation) Error() string {
+	if v.Section == "" {
+		return fmt.Sprintf("%s: %s", v.File, v.Message)
+	}
+
+	return fmt.Sprintf("%s: [%s]: %s", v.File, v.Section, v.Message)
+}
+
+// ConfigViolations are the problems found in a driver configuration section
+// or file.
+type ConfigViolations []*ConfigViolation
+
+func (v ConfigViolations) Error() string {
+	messages := make([]string, 0, len(v))
+	for _, violation := range v {
+		messages = append(messages, violation.Error())
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// ResourceSummary describes a resource the configuration files result in.
+type ResourceSummary struct {
+	Name     string   `json:"name"`
+	Slots    int      `json:"slots"`
+	Sections []string `json:"sections"`
+}
+
+// ValidationReport is the result of ValidateConfigs.
+type ValidationReport struct {
+	Files      []string           `json:"files"`
+	Violations []*ConfigViolation `json:"violations"`
+	Resources  []*ResourceSummary `json:"resources"`
+}
+
+// ValidateConfigs checks the driver configuration files in configDir like
+// the plugin does, but reports all violations instead of the first one. The
+// resources are summarized for the sections without violations.
+func ValidateConfigs(configDir string, pluginConfig *PluginConfig) (*ValidationReport, error) {
+	entries, err := os.ReadDir(configDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't read %s", configDir)
+	}
+
+	report := &ValidationReport{
+		Files:      []string{},
+		Violations: []*ConfigViolation{},
+		Resources:  []*ResourceSummary{},
+	}
+
+	drvConfig := make(driverConfig)
+	devtypes := map[string]string{}
+	invalidSections := map[string]bool{}
+	// loaded counts the files that could be parsed, the sections of the
+	// others are unknown.
+	loaded := 0
+
+	for _, entry := range entries {
+		matches := confFileRegex.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			continue
+		}
+
+		file := filepath.Join(configDir, entry.Name())
+		report.Files = append(report.Files, file)
+		devtypes[matches[2]] = matches[1]
+
+		config, err := ini.Load(file)
+		if err != nil {
+			report.Violations = append(report.Violations, &ConfigViolation{File: file, Message: err.Error()})
+			continue
+		}
+
+		loaded++
+
+		for _, section := range config.Sections() {
+			if section.Name() == ini.DefaultSection || !pluginConfig.sectionAllowed(section.Name()) {
+				continue
+			}
+
+			if err := drvConfig.update(file, matches[2], section); err != nil {
+				violations := ConfigViolations{}
+				if errors.As(err, &violations) {
+					report.Violations = append(report.Violations, violations...)
+					invalidSections[section.Name()] = true
+
+					continue
+				}
+
+				return nil, err
+			}
+		}
+	}
+
+	for sname, svalue := range drvConfig {
+		if svalue.pinned && len(svalue.endpoints) != loaded {
+			report.Violations = append(report.Violations, &ConfigViolation{
+				File:    configDir,
+				Section: sname,
+				Key:     "LimitDevAccess",
+				Message: "Section must be defined for all QAT devices since it contains LimitDevAccess=1",
+			})
+			invalidSections[sname] = true
+		}
+	}
+
+	resources := map[string]*ResourceSummary{}
+	instances := resourceInstances{}
+
+	// Summarize the sections in the order getDevTree creates their slots.
+	snames := make([]string, 0, len(drvConfig))
+	for sname := range drvConfig {
+		snames = append(snames, sname)
+	}
+
+	sort.Strings(snames)
+
+	for _, sname := range snames {
+		svalue := drvConfig[sname]
+		if invalidSections[sname] {
+			continue
+		}
+
+		if err := summarizeSection(resources, instances, sname, svalue, devtypes, pluginConfig); err != nil {
+			report.Violations = append(report.Violations, &ConfigViolation{File: configDir, Section: sname, Message: err.Error()})
+		}
+	}
+
+	for _, resource := range resources {
+		sort.Strings(resource.Sections)
+		report.Resources = append(report.Resources, resource)
+	}
+
+	sort.Slice(report.Resources, func(i, j int) bool { return report.Resources[i].Name < report.Resources[j].Name })
+	sort.SliceStable(report.Violations, func(i, j int) bool {
+		a, b := report.Violations[i], report.Violations[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+
+		return a.Section < b.Section
+	})
+
+	return report, nil
+}
+
+// summarizeSection adds the slots of the section to the resources the same
+// way getDevTree creates them.
+func summarizeSection(resources map[string]*ResourceSummary, instances resourceInstances, sname string, s section, devtypes map[string]string, pluginConfig *PluginConfig) error {
+	add := func(epDevtypes []string, slots int) error {
+		name, err := pluginConfig.resourceName(sname, s, epDevtypes)
+		if err != nil {
+			return err
+		}
+
+		if err := instances.add(name, sname, s); err != nil {
+			return err
+		}
+
+		resource, ok := resources[name]
+		if !ok {
+			resource = &ResourceSummary{Name: name, Sections: []string{}}
+			resources[name] = resource
+		}
+
+		resource.Slots += slots
+
+		for _, existing := range resource.Sections {
+			if existing == sname {
+				return nil
+			}
+		}
+
+		resource.Sections = append(resource.Sections, sname)
+
+		return nil
+	}
+
+	if !s.pinned {
+		sectionDevtypes := []string{}
+		for _, ep := range s.endpoints {
+			sectionDevtypes = append(sectionDevtypes, devtypes[ep.id])
+		}
+
+		return add(sectionDevtypes, s.endpoints[0].processes)
+	}
+
+	for _, ep := range s.endpoints {
+		if err := add([]string{devtypes[ep.id]}, ep.processes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package kerneldrv
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateConfigsReportsAllViolations(t *testing.T) {
+	configDir := t.TempDir()
+
+	files := map[string]string{
+		"c6xx_dev0.conf": `[SSL]
+NumProcesses = 2
+NumberCyInstances = 2
+NumberDcInstances = 0
+
+[BAD]
+NumProcesses = many
+NumberCyInstances = some
+NumberDcInstances = 0
+`,
+		"c6xx_dev1.conf": `[SSL]
+NumProcesses = 1
+NumberCyInstances = 1
+NumberDcInstances = 1
+LimitDevAccess = 0
+
+[BAD]
+NumProcesses = 1
+NumberCyInstances = 1
+NumberDcInstances = 0
+`,
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(configDir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := ValidateConfigs(configDir, DefaultPluginConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	violations := []string{}
+	for _, v := range report.Violations {
+		violations = append(violations, filepath.Base(v.File)+" "+v.Section+" "+v.Key)
+	}
+
+	expected := []string{
+		"c6xx_dev0.conf BAD NumProcesses",
+		"c6xx_dev0.conf BAD NumberCyInstances",
+		"c6xx_dev1.conf SSL NumProcesses",
+		"c6xx_dev1.conf SSL NumberCyInstances",
+		"c6xx_dev1.conf SSL NumberDcInstances",
+	}
+
+	if !reflect.DeepEqual(violations, expected) {
+		t.Errorf("expected violations\n%v\ngot\n%v", expected, violations)
+	}
+}
+
+func TestValidateConfigsBrokenFile(t *testing.T) {
+	configDir := t.TempDir()
+
+	pinned := `[PIN]
+NumProcesses = 2
+NumberCyInstances = 1
+NumberDcInstances = 0
+LimitDevAccess = 1
+`
+
+	files := map[string]string{
+		"c6xx_dev0.conf": pinned,
+		"c6xx_dev1.conf": pinned,
+		"c6xx_dev2.conf": "[PIN\nNumProcesses = 2\n",
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(configDir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := ValidateConfigs(configDir, DefaultPluginConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the broken file is reported, the pinned section is defined in
+	// all loaded files.
+	if len(report.Violations) != 1 || filepath.Base(report.Violations[0].File) != "c6xx_dev2.conf" {
+		t.Errorf("expected a violation of c6xx_dev2.conf only, got %+v", report.Violations)
+	}
+
+	expected := []*ResourceSummary{{Name: "cy1_dc0", Slots: 4, Sections: []string{"PIN"}}}
+	if !reflect.DeepEqual(report.Resources, expected) {
+		t.Errorf("expected resources\n%+v\ngot\n%+v", expected, report.Resources)
+	}
+}
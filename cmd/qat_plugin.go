@@ -1,34 +1,422 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
+
+	"github.com/shuoyanshen/qat_plugin/cmd/dpdkdrv"
 	"github.com/shuoyanshen/qat_plugin/cmd/kerneldrv"
+	"github.com/shuoyanshen/qat_plugin/pkg/debug"
 	"github.com/shuoyanshen/qat_plugin/pkg/deviceplugin"
+	"github.com/shuoyanshen/qat_plugin/pkg/hostroot"
+	"github.com/shuoyanshen/qat_plugin/pkg/metrics"
+	"github.com/shuoyanshen/qat_plugin/pkg/nfd"
+	"github.com/shuoyanshen/qat_plugin/pkg/podresources"
 	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
 )
 
 const (
 	namespace = "qat.intel.com"
 )
 
+var (
+	// namespaceRegex matches a DNS-1123 subdomain as required for the prefix of extended resource names.
+	namespaceRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// options holds the parsed command line flags.
+type options struct {
+	mode           string
+	configDir      string
+	hostRoot       string
+	sysfs          string
+	discovery      string
+	scanInterval   time.Duration
+	gracePeriod    time.Duration
+	policy         string
+	namespace      string
+	kubeletSocket  string
+	metricsAddr    string
+	response       string
+	cdiSpecDir     string
+	featureFile    string
+	pluginConfig   string
+	frontend       string
+	nodeName       string
+	draPluginDir   string
+	draRegistry    string
+	publishSlices  bool
+	telemetry      bool
+	startTelemetry bool
+	podResources   string
+	debugAddr      string
+
+	kernelVfDrivers string
+	maxDevices      int
+	rebindVfs       bool
+	splitServices   bool
+}
+
+func (o *options) validate() error {
+	if o.scanInterval <= 0 {
+		return errors.Errorf("-scan-interval must be positive, got %v", o.scanInterval)
+	}
+
+	if o.gracePeriod < 0 {
+		return errors.Errorf("-unhealthy-grace-period can't be negative, got %v", o.gracePeriod)
+	}
+
+	if len(o.namespace) > 253 || !namespaceRegex.MatchString(o.namespace) {
+		return errors.Errorf("-namespace %q is not a valid DNS subdomain", o.namespace)
+	}
+
+	if o.debugAddr != "" {
+		if err := debug.ValidateAddress(o.debugAddr); err != nil {
+			return errors.Wrap(err, "invalid -debug-address")
+		}
+	}
+
+	switch o.frontend {
+	case "deviceplugin":
+		for _, name := range []string{"node-name", "dra-plugin-dir", "dra-registry-dir", "publish-resource-slices"} {
+			if isFlagSet(name) {
+				return errors.Errorf("-%s requires -frontend=dra", name)
+			}
+		}
+	case "dra":
+		if isFlagSet("allocate-response") || isFlagSet("kubelet-socket") {
+			return errors.New("-allocate-response and -kubelet-socket can't be used with -frontend=dra, DRA always uses CDI")
+		}
+
+		if o.podResources != "" {
+			return errors.New("-pod-resources-socket can't be used with -frontend=dra")
+		}
+
+		if o.publishSlices && o.nodeName == "" {
+			return errors.New("-node-name or NODE_NAME is required to publish ResourceSlices")
+		}
+
+		if !filepath.IsAbs(o.draPluginDir) || !filepath.IsAbs(o.draRegistry) || !filepath.IsAbs(o.cdiSpecDir) {
+			return errors.New("-dra-plugin-dir, -dra-registry-dir and -cdi-spec-dir must be absolute paths")
+		}
+
+		return o.validateMode()
+	default:
+		return errors.Errorf("unknown -frontend %q, supported frontends: deviceplugin, dra", o.frontend)
+	}
+
+	switch o.response {
+	case "legacy":
+		if isFlagSet("cdi-spec-dir") {
+			return errors.New("-cdi-spec-dir requires -allocate-response=cdi")
+		}
+	case "cdi":
+		if !filepath.IsAbs(o.cdiSpecDir) {
+			return errors.Errorf("-cdi-spec-dir must be an absolute path, got %q", o.cdiSpecDir)
+		}
+	default:
+		return errors.Errorf("unknown -allocate-response %q, supported responses: legacy, cdi", o.response)
+	}
+
+	if !filepath.IsAbs(o.kubeletSocket) {
+		return errors.Errorf("-kubelet-socket must be an absolute path, got %q", o.kubeletSocket)
+	}
+
+	if o.podResources != "" && !filepath.IsAbs(o.podResources) {
+		return errors.Errorf("-pod-resources-socket must be an absolute path, got %q", o.podResources)
+	}
+
+	return o.validateMode()
+}
+
+// root returns the host root with the sysfs overridden by -sysfs.
+func (o *options) root() hostroot.Root {
+	root := hostroot.New(o.hostRoot)
+	root.Sysfs = o.sysfs
+
+	return root
+}
+
+func (o *options) validateMode() error {
+	if err := checkDir(o.hostRoot); err != nil {
+		return errors.Wrap(err, "invalid -host-root")
+	}
+
+	if err := checkDir(o.sysfs); err != nil {
+		return errors.Wrap(err, "invalid -sysfs")
+	}
+
+	switch o.mode {
+	case "kernel":
+		for _, name := range []string{"kernel-vf-drivers", "max-num-devices", "rebind-vfs", "split-services"} {
+			if isFlagSet(name) {
+				return errors.Errorf("-%s can't be used in kernel mode", name)
+			}
+		}
+
+		if err := checkDir(o.configDir); err != nil {
+			return errors.Wrap(err, "invalid -config-dir")
+		}
+
+		if o.policy != kerneldrv.PolicySpread && o.policy != kerneldrv.PolicyPack {
+			return errors.Errorf("unknown -allocation-policy %q, supported policies: %s, %s", o.policy, kerneldrv.PolicySpread, kerneldrv.PolicyPack)
+		}
+
+		if o.discovery != kerneldrv.DiscoverySysfs && o.discovery != kerneldrv.DiscoveryAdfCtl {
+			return errors.Errorf("unknown -discovery %q, supported backends: %s, %s", o.discovery, kerneldrv.DiscoverySysfs, kerneldrv.DiscoveryAdfCtl)
+		}
+
+		if o.featureFile != "" {
+			if err := checkDir(filepath.Dir(o.featureFile)); err != nil {
+				return errors.Wrap(err, "invalid -nfd-feature-file")
+			}
+		}
+
+		if o.telemetry && o.metricsAddr == "" {
+			return errors.New("-telemetry requires -metrics-address")
+		}
+
+		if o.startTelemetry && !o.telemetry {
+			return errors.New("-start-telemetry requires -telemetry")
+		}
+	case "dpdk":
+		for _, name := range []string{"config-dir", "discovery", "unhealthy-grace-period", "allocation-policy", "nfd-feature-file", "plugin-config", "telemetry", "start-telemetry"} {
+			if isFlagSet(name) {
+				return errors.Errorf("-%s can't be used in dpdk mode", name)
+			}
+		}
+
+		if o.maxDevices <= 0 {
+			return errors.Errorf("-max-num-devices must be positive, got %d", o.maxDevices)
+		}
+
+		if !o.rebindVfs && isFlagSet("kernel-vf-drivers") {
+			return errors.New("-kernel-vf-drivers requires -rebind-vfs")
+		}
+	default:
+		return errors.Errorf("unknown -mode %q, supported modes: kernel, dpdk", o.mode)
+	}
+
+	return nil
+}
+
+func isFlagSet(name string) bool {
+	set := false
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
+
+func checkDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !fi.IsDir() {
+		return errors.Errorf("%s is not a directory", dir)
+	}
+
+	return nil
+}
+
 func main() {
 	var (
-		plugin deviceplugin.Scanner
-		err    error
+		plugin       deviceplugin.Scanner
+		kernelPlugin *kerneldrv.DevicePlugin
+		opts         options
 	)
 
-	plugin = kerneldrv.NewDevicePlugin()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "generate":
+			os.Exit(generate(os.Args[2:]))
+		}
+	}
 
-	if err != nil {
+	flag.StringVar(&opts.mode, "mode", "kernel", "plugin mode which can be either kernel or dpdk")
+	flag.StringVar(&opts.configDir, "config-dir", "/etc", "directory with QAT driver configuration files (kernel mode)")
+	flag.StringVar(&opts.hostRoot, "host-root", "/", "directory the host /sys and /dev are mounted under, e.g. /host")
+	flag.StringVar(&opts.sysfs, "sysfs", "", "path to the mounted sysfs, defaults to sys under -host-root")
+	flag.StringVar(&opts.discovery, "discovery", kerneldrv.DiscoverySysfs, "device discovery backend, sysfs or adf_ctl (kernel mode)")
+	flag.DurationVar(&opts.scanInterval, "scan-interval", 5*time.Second, "interval between periodic device scans, 1m by default in kernel mode which also rescans on config and device events (at most 5s without device events)")
+	flag.DurationVar(&opts.gracePeriod, "unhealthy-grace-period", time.Minute, "report devices unhealthy when scans keep failing for this long, 0 disables it (kernel mode)")
+	flag.StringVar(&opts.policy, "allocation-policy", kerneldrv.PolicySpread, "preferred allocation policy, spread or pack (kernel mode)")
+	flag.StringVar(&opts.namespace, "namespace", namespace, "namespace of the advertised extended resources")
+	flag.StringVar(&opts.kubeletSocket, "kubelet-socket", pluginapi.KubeletSocket, "path to the kubelet registration socket")
+	flag.StringVar(&opts.debugAddr, "debug-address", "", "address to serve the plugin state as JSON at /debug/, loopback host:port or unix:<socket path>, disabled if empty")
+	flag.StringVar(&opts.podResources, "pod-resources-socket", "", "kubelet PodResources API socket to track the containers using the devices with, e.g. "+podresources.DefaultSocket+", disabled if empty")
+	flag.StringVar(&opts.metricsAddr, "metrics-address", "", "address to serve Prometheus metrics at, e.g. :9090, disabled if empty")
+	flag.StringVar(&opts.response, "allocate-response", "legacy", "allocate response type, legacy device nodes or cdi devices")
+	flag.StringVar(&opts.cdiSpecDir, "cdi-spec-dir", "/var/run/cdi", "directory to write CDI specs to (cdi allocate response)")
+	flag.StringVar(&opts.pluginConfig, "plugin-config", "", "YAML file with device and section allow/deny rules and SR-IOV provisioning (kernel mode)")
+	flag.StringVar(&opts.featureFile, "nfd-feature-file", "", "NFD feature file to write node labels to, e.g. "+nfd.FeatureDir+"/qat, disabled if empty (kernel mode)")
+	flag.BoolVar(&opts.telemetry, "telemetry", false, "export device telemetry read from debugfs with the metrics (kernel mode)")
+	flag.BoolVar(&opts.startTelemetry, "start-telemetry", false, "start telemetry sampling of gen4 devices where it's stopped, the devices keep sampling after the plugin exits (kernel mode)")
+	flag.StringVar(&opts.frontend, "frontend", "deviceplugin", "kubelet API to serve devices with, deviceplugin or dra")
+	flag.StringVar(&opts.nodeName, "node-name", os.Getenv("NODE_NAME"), "name of the node to publish ResourceSlices for (dra frontend)")
+	flag.StringVar(&opts.draPluginDir, "dra-plugin-dir", filepath.Join(deviceplugin.DRAPluginDir, namespace), "directory of the DRA plugin socket, defaults to a directory named after -namespace (dra frontend)")
+	flag.StringVar(&opts.draRegistry, "dra-registry-dir", deviceplugin.DRARegistryDir, "kubelet plugin registration directory (dra frontend)")
+	flag.BoolVar(&opts.publishSlices, "publish-resource-slices", true, "publish ResourceSlices through the API server (dra frontend)")
+	flag.StringVar(&opts.kernelVfDrivers, "kernel-vf-drivers", "dh895xccvf,c6xxvf,c3xxxvf,d15xxvf,4xxxvf", "comma separated list of kernel VF drivers to rebind from (dpdk mode)")
+	flag.IntVar(&opts.maxDevices, "max-num-devices", 64, "maximum number of QAT VFs to advertise (dpdk mode)")
+	flag.BoolVar(&opts.rebindVfs, "rebind-vfs", true, "rebind QAT VFs from kernel VF drivers to vfio-pci (dpdk mode)")
+	flag.BoolVar(&opts.splitServices, "split-services", false, "advertise VFs by the services configured on their PF instead of as generic (dpdk mode)")
+	flag.Parse()
+
+	if !isFlagSet("sysfs") {
+		opts.sysfs = filepath.Join(opts.hostRoot, "sys")
+	}
+
+	// Kernel mode rescans on events, the periodic scan is only a fallback.
+	if !isFlagSet("scan-interval") && opts.mode == "kernel" {
+		opts.scanInterval = time.Minute
+	}
+
+	if !isFlagSet("dra-plugin-dir") {
+		opts.draPluginDir = filepath.Join(deviceplugin.DRAPluginDir, opts.namespace)
+	}
+
+	if err := opts.validate(); err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 
-	klog.V(1).Infof("QAT device plugin started")
+	switch opts.mode {
+	case "kernel":
+		kernelPlugin = kerneldrv.NewDevicePlugin(opts.configDir, opts.root(), opts.discovery, opts.scanInterval, opts.gracePeriod, opts.policy)
+
+		if opts.pluginConfig != "" {
+			config, err := kerneldrv.LoadPluginConfig(opts.pluginConfig)
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+
+			kernelPlugin.SetConfig(config)
+		}
+
+		if opts.featureFile != "" {
+			kernelPlugin.EnableFeatureFile(opts.featureFile, opts.namespace)
+		}
+
+		if opts.telemetry {
+			if err := kernelPlugin.EnableTelemetry(opts.startTelemetry); err != nil {
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
+		}
+
+		plugin = kernelPlugin
+	case "dpdk":
+		plugin = dpdkdrv.NewDevicePlugin(opts.root(), opts.maxDevices, strings.Split(opts.kernelVfDrivers, ","),
+			opts.rebindVfs, opts.splitServices, opts.scanInterval)
+	}
+
+	klog.V(1).Infof("QAT device plugin started in %s mode", opts.mode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	manager := deviceplugin.NewManager(namespace, plugin)
+	if opts.metricsAddr != "" {
+		go func() {
+			if err := metrics.Serve(ctx, opts.metricsAddr); err != nil {
+				klog.Errorf("%+v", err)
+			}
+		}()
+	}
+
+	debugServer := debug.NewServer(opts.debugAddr)
+
+	if opts.debugAddr != "" {
+		go func() {
+			if err := debugServer.Serve(ctx); err != nil {
+				klog.Errorf("%+v", err)
+			}
+		}()
+	}
+
+	if kernelPlugin != nil {
+		debugServer.Register("plugin", kernelPlugin.DebugState)
+	}
+
+	if opts.podResources != "" {
+		client, err := podresources.Dial(opts.podResources)
+		if err != nil {
+			klog.Errorf("%+v", err)
+			os.Exit(1)
+		}
+
+		tracker := podresources.NewTracker(client, opts.namespace, podresources.DefaultInterval)
+		debugServer.Register("allocations", tracker.DebugState)
+
+		if kernelPlugin != nil {
+			tracker.SetResolver(kernelPlugin.SlotEndpoints)
+			kernelPlugin.SetAllocationLister(tracker)
+		}
+
+		go tracker.Run(ctx)
+	}
+
+	var err error
+
+	switch opts.frontend {
+	case "deviceplugin":
+		manager := deviceplugin.NewManager(opts.namespace, plugin)
+		manager.SetKubeletSocket(opts.kubeletSocket)
+		debugServer.Register("servers", manager.DebugState)
+
+		if opts.response == "cdi" {
+			manager.EnableCDI(opts.cdiSpecDir)
+		}
+
+		err = manager.Run(ctx)
+	case "dra":
+		draOpts := deviceplugin.DRAOptions{
+			DriverName:  opts.namespace,
+			NodeName:    opts.nodeName,
+			PluginDir:   opts.draPluginDir,
+			RegistryDir: opts.draRegistry,
+			CDISpecDir:  opts.cdiSpecDir,
+		}
+
+		if opts.publishSlices {
+			if draOpts.Publisher, err = deviceplugin.NewInClusterPublisher(); err != nil {
+				klog.Errorf("%+v", err)
+				os.Exit(1)
+			}
+		}
+
+		draPlugin := deviceplugin.NewDRAPlugin(plugin, draOpts)
+		debugServer.Register("dra", draPlugin.DebugState)
+
+		err = draPlugin.Run(ctx)
+	}
+
+	if kernelPlugin != nil {
+		kernelPlugin.Teardown()
+	}
+
+	if err != nil && !errors.Is(err, context.Canceled) {
+		klog.Errorf("%+v", err)
+		os.Exit(1)
+	}
 
-	manager.Run()
+	klog.V(1).Infof("QAT device plugin stopped")
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/shuoyanshen/qat_plugin/cmd/kerneldrv"
+)
+
+// validate implements the validate subcommand which checks the QAT driver
+// configuration files and prints the report as JSON. It returns the exit
+// code, 1 if violations were found.
+func validate(args []string) int {
+	var (
+		configDir    string
+		pluginConfig string
+		ns           string
+	)
+
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s validate [flags]\n\nCheck QAT driver configuration files before restarting qat_service.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&configDir, "config-dir", "/etc", "directory with QAT driver configuration files")
+	flags.StringVar(&pluginConfig, "plugin-config", "", "YAML file with the plugin config to apply")
+	flags.StringVar(&ns, "namespace", namespace, "namespace of the advertised extended resources")
+	_ = flags.Parse(args)
+
+	config := kerneldrv.DefaultPluginConfig()
+
+	if pluginConfig != "" {
+		var err error
+
+		if config, err = kerneldrv.LoadPluginConfig(pluginConfig); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+	}
+
+	report, err := kerneldrv.ValidateConfigs(configDir, config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	for _, resource := range report.Resources {
+		resource.Name = ns + "/" + resource.Name
+	}
+
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+
+	fmt.Println(string(output))
+
+	for _, violation := range report.Violations {
+		fmt.Fprintln(os.Stderr, violation.Error())
+	}
+
+	if len(report.Violations) > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,185 @@
+// Package debug serves the internal state of the plugin as JSON for
+// troubleshooting. Components register a function returning their state
+// under a name, GET /debug/<name> returns the state of one component and
+// GET /debug/ the states of all of them.
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// unixPrefix marks addresses of unix sockets, e.g. unix:/run/qat/debug.sock.
+const unixPrefix = "unix:"
+
+// StateFunc returns the state of a component. It must be safe to call
+// concurrently with the component.
+type StateFunc func() interface{}
+
+// Server serves the registered states.
+type Server struct {
+	addr string
+
+	mutex  sync.Mutex
+	states map[string]StateFunc
+}
+
+// ValidateAddress checks that addr is a loopback host:port or unix:<path>
+// with an absolute path. The state isn't protected, so it's not served on
+// addresses reachable from other hosts.
+func ValidateAddress(addr string) error {
+	if strings.HasPrefix(addr, unixPrefix) {
+		if !filepath.IsAbs(strings.TrimPrefix(addr, unixPrefix)) {
+			return errors.Errorf("Debug socket of %s must be an absolute path", addr)
+		}
+
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrapf(err, "Bad debug address %s", addr)
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.Errorf("Debug address %s must be a loopback address or %s<path>", addr, unixPrefix)
+	}
+
+	return nil
+}
+
+// NewServer returns a server listening at addr, either a loopback host:port
+// or unix:<path>.
+func NewServer(addr string) *Server {
+	return &Server{
+		addr:   addr,
+		states: map[string]StateFunc{},
+	}
+}
+
+// Register makes the state available at /debug/<name>.
+func (s *Server) Register(name string, state StateFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.states[name] = state
+}
+
+func (s *Server) listen() (net.Listener, error) {
+	if err := ValidateAddress(s.addr); err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(s.addr, unixPrefix) {
+		lis, err := net.Listen("tcp", s.addr)
+		return lis, errors.Wrapf(err, "Failed to listen to debug address %s", s.addr)
+	}
+
+	socket := strings.TrimPrefix(s.addr, unixPrefix)
+
+	// We don't care if the socket file doesn't exist.
+	_ = os.Remove(socket)
+
+	lis, err := net.Listen("unix", socket)
+
+	return lis, errors.Wrapf(err, "Failed to listen to debug socket %s", socket)
+}
+
+// Serve serves the states until ctx is cancelled.
+func (s *Server) Serve(ctx context.Context) error {
+	lis, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/", s.handle)
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		if err := srv.Close(); err != nil {
+			klog.Warningf("Failed to close debug server: %+v", err)
+		}
+	}()
+
+	klog.V(1).Infof("Serving debug state at %s", s.addr)
+
+	if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return errors.Wrap(err, "Failed to serve debug state")
+	}
+
+	return nil
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/debug/"), "/")
+
+	s.mutex.Lock()
+	states := make(map[string]StateFunc, len(s.states))
+
+	for n, state := range s.states {
+		states[n] = state
+	}
+	s.mutex.Unlock()
+
+	var out interface{}
+
+	if name == "" {
+		all := map[string]interface{}{}
+		for n, state := range states {
+			all[n] = state()
+		}
+
+		out = all
+	} else {
+		state, ok := states[name]
+		if !ok {
+			names := make([]string, 0, len(states))
+			for n := range states {
+				names = append(names, n)
+			}
+
+			sort.Strings(names)
+
+			http.Error(w, "Unknown state "+name+", available: "+strings.Join(names, ", "), http.StatusNotFound)
+
+			return
+		}
+
+		out = state()
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		klog.V(4).Infof("Failed to write debug state: %v", err)
+	}
+}
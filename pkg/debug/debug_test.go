@@ -0,0 +1,179 @@
+package debug
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateAddress(t *testing.T) {
+	tcases := []struct {
+		addr  string
+		valid bool
+	}{
+		{addr: "localhost:8081", valid: true},
+		{addr: "127.0.0.1:8081", valid: true},
+		{addr: "127.1.2.3:8081", valid: true},
+		{addr: "[::1]:8081", valid: true},
+		{addr: "unix:/run/qat/debug.sock", valid: true},
+		{addr: "unix:debug.sock"},
+		{addr: ":8081"},
+		{addr: "0.0.0.0:8081"},
+		{addr: "[::]:8081"},
+		{addr: "10.0.0.1:8081"},
+		{addr: "node.example.com:8081"},
+		{addr: "localhost"},
+	}
+
+	for _, tc := range tcases {
+		if err := ValidateAddress(tc.addr); (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid=%t, got %v", tc.addr, tc.valid, err)
+		}
+	}
+}
+
+func TestHandle(t *testing.T) {
+	s := NewServer("localhost:0")
+	s.Register("plugin", func() interface{} {
+		return map[string]int{"slots": 2}
+	})
+	s.Register("allocations", func() interface{} {
+		return []string{"SSL_1"}
+	})
+
+	tcases := []struct {
+		name     string
+		method   string
+		path     string
+		status   int
+		expected string
+	}{
+		{
+			name:   "all states",
+			method: http.MethodGet,
+			path:   "/debug/",
+			status: http.StatusOK,
+			expected: `{
+  "allocations": [
+    "SSL_1"
+  ],
+  "plugin": {
+    "slots": 2
+  }
+}
+`,
+		},
+		{
+			name:   "one state",
+			method: http.MethodGet,
+			path:   "/debug/plugin/",
+			status: http.StatusOK,
+			expected: `{
+  "slots": 2
+}
+`,
+		},
+		{
+			name:     "unknown state",
+			method:   http.MethodGet,
+			path:     "/debug/servers",
+			status:   http.StatusNotFound,
+			expected: "Unknown state servers, available: allocations, plugin\n",
+		},
+		{
+			name:     "POST",
+			method:   http.MethodPost,
+			path:     "/debug/",
+			status:   http.StatusMethodNotAllowed,
+			expected: "Only GET is supported\n",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			s.handle(recorder, httptest.NewRequest(tc.method, tc.path, nil))
+
+			if recorder.Code != tc.status {
+				t.Errorf("expected status %d, got %d", tc.status, recorder.Code)
+			}
+
+			if body := recorder.Body.String(); body != tc.expected {
+				t.Errorf("expected body\n%s\ngot\n%s", tc.expected, body)
+			}
+		})
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "debug.sock")
+
+	s := NewServer(unixPrefix + socket)
+	s.Register("plugin", func() interface{} { return "ok" })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(ctx)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	// The server may not listen yet.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if resp, err = client.Get("http://debug/debug/plugin"); err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "\"ok\"\n" {
+		t.Errorf("expected \"ok\", got %s", body)
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve() failed: %+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve() didn't return after the context was canceled")
+	}
+}
+
+func TestServeRejectsPublicAddress(t *testing.T) {
+	if err := NewServer(":0").Serve(context.Background()); err == nil {
+		t.Error("served on all interfaces")
+	}
+}
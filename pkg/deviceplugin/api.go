@@ -1,6 +1,9 @@
 package deviceplugin
 
 import (
+	"context"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/hostroot"
 	"github.com/shuoyanshen/qat_plugin/pkg/topology"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
@@ -14,6 +17,11 @@ type DeviceInfo struct {
 	topology    *pluginapi.TopologyInfo
 	state       string
 	nodes       []pluginapi.DeviceSpec
+	// attributes describe the device to the DRA frontend, they aren't
+	// exposed to containers.
+	attributes map[string]int64
+	// stableID names the device to the DRA frontend, see WithStableID.
+	stableID string
 }
 
 // UseDefaultMethodError allows the plugin to request running the default
@@ -32,6 +40,12 @@ func init() {
 // NewDeviceInfo makes DeviceInfo struct and adds topology information to it.
 // from          pluginapi.Healthy,    devs,                      nil,                        envs,                           nil)
 func NewDeviceInfo(state string, nodes []pluginapi.DeviceSpec, mounts []pluginapi.Mount, envs map[string]string, annotations map[string]string) DeviceInfo {
+	return NewDeviceInfoAt(hostroot.Default, state, nodes, mounts, envs, annotations)
+}
+
+// NewDeviceInfoAt makes DeviceInfo struct like NewDeviceInfo with the
+// topology of the device nodes looked up under the host root.
+func NewDeviceInfoAt(root hostroot.Root, state string, nodes []pluginapi.DeviceSpec, mounts []pluginapi.Mount, envs map[string]string, annotations map[string]string) DeviceInfo {
 	deviceInfo := DeviceInfo{
 		state:       state,
 		nodes:       nodes,
@@ -46,7 +60,7 @@ func NewDeviceInfo(state string, nodes []pluginapi.DeviceSpec, mounts []pluginap
 		devPaths = append(devPaths, node.HostPath)
 	}
 
-	topologyInfo, err := topology.GetTopologyInfo(devPaths)
+	topologyInfo, err := topology.GetTopologyInfo(root, devPaths)
 	if err == nil {
 		deviceInfo.topology = topologyInfo
 	} else {
@@ -69,6 +83,25 @@ func NewDeviceInfoWithTopologyHints(state string, nodes []pluginapi.DeviceSpec,
 	}
 }
 
+// WithAttributes returns a copy of the device with integer attributes
+// published by the DRA frontend, e.g. the number of crypto instances.
+func (info DeviceInfo) WithAttributes(attributes map[string]int64) DeviceInfo {
+	info.attributes = attributes
+
+	return info
+}
+
+// WithStableID returns a copy of the device with an ID which keeps naming
+// the same device across scans, unlike device IDs which are assigned in
+// scan order. The DRA frontend names instances by it because prepared
+// claims refer to instances by name across rescans and restarts. It
+// defaults to the device ID.
+func (info DeviceInfo) WithStableID(id string) DeviceInfo {
+	info.stableID = id
+
+	return info
+}
+
 // DeviceTree contains a tree-like structure of device type -> device ID -> device info.
 type DeviceTree map[string]map[string]DeviceInfo
 
@@ -86,6 +119,20 @@ func (tree DeviceTree) AddDevice(devType, id string, info DeviceInfo) {
 	tree[devType][id] = info
 }
 
+// WithState returns a copy of the tree with all devices in the given state.
+func (tree DeviceTree) WithState(state string) DeviceTree {
+	newTree := NewDeviceTree()
+
+	for devType, devices := range tree {
+		for id, info := range devices {
+			info.state = state
+			newTree.AddDevice(devType, id, info)
+		}
+	}
+
+	return newTree
+}
+
 // DeviceTypeCount returns number of device of given type.
 func (tree DeviceTree) DeviceTypeCount(devType string) int {
 	return len(tree[devType])
@@ -103,8 +150,8 @@ type Notifier interface {
 type Scanner interface {
 	// Scan scans the host for devices and sends all found devices to
 	// a Notifier instance. It's called only once for every device plugin by
-	// Manager in a goroutine and operates in an infinite loop.
-	Scan(Notifier) error
+	// Manager in a goroutine and operates in a loop until ctx is done.
+	Scan(ctx context.Context, notifier Notifier) error
 }
 
 // Allocator is an optional interface implemented by device plugins.
@@ -0,0 +1,173 @@
+package deviceplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+// cdiVersion is the CDI spec version required by the used features.
+const cdiVersion = "0.3.0"
+
+// cdiKind returns the CDI kind of devices of the given type, e.g. qat.intel.com/cy2_dc0.
+func cdiKind(namespace, devType string) string {
+	return namespace + "/" + devType
+}
+
+func cdiSpecPath(specDir, namespace, devType string) string {
+	return filepath.Join(specDir, fmt.Sprintf("%s-%s.json", namespace, devType))
+}
+
+func isUIONode(node pluginapi.DeviceSpec) bool {
+	return strings.HasPrefix(node.HostPath, "/dev/uio")
+}
+
+// uioContainerPath returns the container path of the n-th UIO node of a
+// container. UIO nodes are numbered from zero in every container.
+func uioContainerPath(n int) string {
+	return "/dev/uio" + strconv.Itoa(n)
+}
+
+// newContainerEdits returns the CDI container edits exposing the devices.
+// Device nodes shared by the devices are added only once, UIO nodes are
+// renumbered like in Allocate().
+func newContainerEdits(devices ...DeviceInfo) cdispec.ContainerEdits {
+	edits := cdispec.ContainerEdits{}
+	hostPaths := map[string]bool{}
+	envs := map[string]string{}
+	uioID := 0
+
+	for _, dev := range devices {
+		for _, node := range dev.nodes {
+			if hostPaths[node.HostPath] {
+				continue
+			}
+
+			hostPaths[node.HostPath] = true
+
+			path := node.ContainerPath
+			if isUIONode(node) {
+				path = uioContainerPath(uioID)
+				uioID++
+			}
+
+			edits.DeviceNodes = append(edits.DeviceNodes, &cdispec.DeviceNode{
+				Path:        path,
+				HostPath:    node.HostPath,
+				Permissions: node.Permissions,
+			})
+		}
+
+		for _, mount := range dev.mounts {
+			options := []string{"bind", "rw"}
+			if mount.ReadOnly {
+				options = []string{"bind", "ro"}
+			}
+
+			edits.Mounts = append(edits.Mounts, &cdispec.Mount{
+				HostPath:      mount.HostPath,
+				ContainerPath: mount.ContainerPath,
+				Options:       options,
+			})
+		}
+
+		for key, value := range dev.envs {
+			envs[key] = value
+		}
+	}
+
+	for key, value := range envs {
+		edits.Env = append(edits.Env, key+"="+value)
+	}
+
+	sort.Strings(edits.Env)
+
+	return edits
+}
+
+// cdiDeviceInfo returns the part of the device in the CDI spec of its type.
+// UIO nodes and env variables are returned by Allocate() instead, where they
+// are renumbered across the devices of the container.
+func cdiDeviceInfo(dev DeviceInfo) DeviceInfo {
+	nodes := []pluginapi.DeviceSpec{}
+
+	for _, node := range dev.nodes {
+		if !isUIONode(node) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	dev.nodes = nodes
+	dev.envs = nil
+
+	return dev
+}
+
+// newCDISpec returns a CDI spec with the device nodes and mounts of all
+// devices of the type.
+func newCDISpec(kind string, devices map[string]DeviceInfo) *cdispec.Spec {
+	spec := &cdispec.Spec{
+		Version: cdiVersion,
+		Kind:    kind,
+		Devices: []cdispec.Device{},
+	}
+
+	for id, dev := range devices {
+		spec.Devices = append(spec.Devices, cdispec.Device{
+			Name:           id,
+			ContainerEdits: newContainerEdits(cdiDeviceInfo(dev)),
+		})
+	}
+
+	sort.Slice(spec.Devices, func(i, j int) bool { return spec.Devices[i].Name < spec.Devices[j].Name })
+
+	return spec
+}
+
+// writeCDISpec atomically replaces the CDI spec file of the device type.
+func writeCDISpec(specDir, namespace, devType string, devices map[string]DeviceInfo) error {
+	return writeCDISpecFile(cdiSpecPath(specDir, namespace, devType), newCDISpec(cdiKind(namespace, devType), devices))
+}
+
+func writeCDISpecFile(specPath string, spec *cdispec.Spec) error {
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to marshal CDI spec %s", spec.Kind)
+	}
+
+	specDir := filepath.Dir(specPath)
+
+	if err := os.MkdirAll(specDir, 0755); err != nil {
+		return errors.Wrapf(err, "Failed to create %s", specDir)
+	}
+
+	tmpPath := specPath + ".tmp"
+
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.Wrapf(err, "Failed to write %s", tmpPath)
+	}
+
+	if err := os.Rename(tmpPath, specPath); err != nil {
+		return errors.Wrapf(err, "Failed to rename %s", tmpPath)
+	}
+
+	return nil
+}
+
+func removeCDISpec(specDir, namespace, devType string) error {
+	specPath := cdiSpecPath(specDir, namespace, devType)
+
+	if err := os.Remove(specPath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to remove %s", specPath)
+	}
+
+	return nil
+}
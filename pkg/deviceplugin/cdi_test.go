@@ -0,0 +1,76 @@
+package deviceplugin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func uioDevice(uio, section string) DeviceInfo {
+	return NewDeviceInfoWithTopologyHints(pluginapi.Healthy,
+		[]pluginapi.DeviceSpec{
+			{HostPath: "/dev/qat_adf_ctl", ContainerPath: "/dev/qat_adf_ctl", Permissions: "rw"},
+			{HostPath: "/dev/" + uio, ContainerPath: "/dev/" + uio, Permissions: "rw"},
+		},
+		nil,
+		map[string]string{"QAT_SECTION_NAME_cy2_dc0_" + section: "SSL"},
+		nil, nil)
+}
+
+func TestAllocateCDI(t *testing.T) {
+	kind := cdiKind(testNamespace, "cy2_dc0")
+	devices := map[string]DeviceInfo{
+		"SSL_0": uioDevice("uio3", "0"),
+		"SSL_1": uioDevice("uio5", "1"),
+	}
+
+	spec := newCDISpec(kind, devices)
+
+	for _, dev := range spec.Devices {
+		if len(dev.ContainerEdits.Env) != 0 {
+			t.Errorf("%s: env variables in the CDI spec: %v", dev.Name, dev.ContainerEdits.Env)
+		}
+
+		if len(dev.ContainerEdits.DeviceNodes) != 1 || dev.ContainerEdits.DeviceNodes[0].HostPath != "/dev/qat_adf_ctl" {
+			t.Errorf("%s: expected only the control node in the CDI spec, got %+v", dev.Name, dev.ContainerEdits.DeviceNodes)
+		}
+	}
+
+	srv := newServer("cy2_dc0", nil, nil, nil, nil, kind).(*server)
+	srv.devices = devices
+
+	resp, err := srv.Allocate(context.Background(), &pluginapi.AllocateRequest{
+		ContainerRequests: []*pluginapi.ContainerAllocateRequest{
+			{DevicesIDs: []string{"SSL_0", "SSL_1"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cresp := resp.ContainerResponses[0]
+
+	cdiDevices := []string{}
+	for _, dev := range cresp.CDIDevices {
+		cdiDevices = append(cdiDevices, dev.Name)
+	}
+
+	if expected := []string{kind + "=SSL_0", kind + "=SSL_1"}; !reflect.DeepEqual(cdiDevices, expected) {
+		t.Errorf("expected CDI devices %v, got %v", expected, cdiDevices)
+	}
+
+	nodes := map[string]string{}
+	for _, node := range cresp.Devices {
+		nodes[node.HostPath] = node.ContainerPath
+	}
+
+	if expected := map[string]string{"/dev/uio3": "/dev/uio0", "/dev/uio5": "/dev/uio1"}; !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("expected UIO nodes %v, got %v", expected, nodes)
+	}
+
+	if len(cresp.Envs) != 2 {
+		t.Errorf("expected the env variables of both devices, got %v", cresp.Envs)
+	}
+}
@@ -0,0 +1,157 @@
+package deviceplugin
+
+import (
+	"sort"
+	"time"
+)
+
+// DeviceState is a device as advertised to kubelet.
+type DeviceState struct {
+	ID          string            `json:"id"`
+	Health      string            `json:"health"`
+	DeviceNodes []string          `json:"deviceNodes,omitempty"`
+	Mounts      []string          `json:"mounts,omitempty"`
+	Envs        map[string]string `json:"envs,omitempty"`
+	NUMANodes   []int64           `json:"numaNodes,omitempty"`
+}
+
+// ServerState is the state of the server of a resource and its devices.
+type ServerState struct {
+	Resource      string        `json:"resource"`
+	State         string        `json:"state"`
+	Socket        string        `json:"socket,omitempty"`
+	RegisteredAt  *time.Time    `json:"registeredAt,omitempty"`
+	Registrations int           `json:"registrations"`
+	Devices       []DeviceState `json:"devices"`
+}
+
+// DRAInstanceState is a named resource instance published by the DRA plugin.
+type DRAInstanceState struct {
+	Name     string      `json:"name"`
+	Resource string      `json:"resource"`
+	Device   DeviceState `json:"device"`
+}
+
+// DRAClaimState is a prepared claim with the instances allocated to it.
+type DRAClaimState struct {
+	UID       string   `json:"uid"`
+	Instances []string `json:"instances"`
+}
+
+// DRAState is the state of the DRA plugin.
+type DRAState struct {
+	Socket    string             `json:"socket"`
+	Instances []DRAInstanceState `json:"instances"`
+	Claims    []DRAClaimState    `json:"claims"`
+}
+
+func (state serverState) String() string {
+	switch state {
+	case uninitialized:
+		return "uninitialized"
+	case serving:
+		return "serving"
+	case terminating:
+		return "terminating"
+	default:
+		return "unknown"
+	}
+}
+
+func (srv *server) debugState() ServerState {
+	srv.stateMutex.Lock()
+	defer srv.stateMutex.Unlock()
+
+	state := ServerState{
+		Resource:      srv.devType,
+		State:         srv.state.String(),
+		Socket:        srv.socket,
+		Registrations: srv.registrations,
+	}
+
+	if !srv.registeredAt.IsZero() {
+		registeredAt := srv.registeredAt
+		state.RegisteredAt = &registeredAt
+	}
+
+	return state
+}
+
+func newDeviceState(id string, info DeviceInfo) DeviceState {
+	dev := DeviceState{
+		ID:     id,
+		Health: info.state,
+		Envs:   info.envs,
+	}
+
+	for _, node := range info.nodes {
+		dev.DeviceNodes = append(dev.DeviceNodes, node.HostPath)
+	}
+
+	for _, mount := range info.mounts {
+		dev.Mounts = append(dev.Mounts, mount.HostPath+":"+mount.ContainerPath)
+	}
+
+	if info.topology != nil {
+		for _, node := range info.topology.Nodes {
+			dev.NUMANodes = append(dev.NUMANodes, node.ID)
+		}
+	}
+
+	return dev
+}
+
+// DebugState returns the state of the servers with the devices they advertise.
+func (m *Manager) DebugState() interface{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	states := []ServerState{}
+
+	for devType, srv := range m.servers {
+		state := srv.debugState()
+		state.Devices = []DeviceState{}
+
+		for id, info := range m.devices[devType] {
+			state.Devices = append(state.Devices, newDeviceState(id, info))
+		}
+
+		sort.Slice(state.Devices, func(i, j int) bool { return state.Devices[i].ID < state.Devices[j].ID })
+
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Resource < states[j].Resource })
+
+	return states
+}
+
+// DebugState returns the published instances and the prepared claims.
+func (p *DRAPlugin) DebugState() interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	state := DRAState{
+		Socket:    p.PluginSocket(),
+		Instances: []DRAInstanceState{},
+		Claims:    []DRAClaimState{},
+	}
+
+	for name, inst := range p.instances {
+		state.Instances = append(state.Instances, DRAInstanceState{
+			Name:     name,
+			Resource: inst.devType,
+			Device:   newDeviceState(inst.id, inst.info),
+		})
+	}
+
+	sort.Slice(state.Instances, func(i, j int) bool { return state.Instances[i].Name < state.Instances[j].Name })
+
+	for uid, instances := range p.claims {
+		state.Claims = append(state.Claims, DRAClaimState{UID: uid, Instances: instances})
+	}
+
+	sort.Slice(state.Claims, func(i, j int) bool { return state.Claims[i].UID < state.Claims[j].UID })
+
+	return state
+}
@@ -0,0 +1,557 @@
+package deviceplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+const (
+	// DRAPluginDir is the default parent directory of DRA plugin sockets.
+	DRAPluginDir = "/var/lib/kubelet/plugins"
+	// DRARegistryDir is the default kubelet plugin registration directory.
+	DRARegistryDir = "/var/lib/kubelet/plugins_registry"
+
+	// draClaimClass is the CDI class of the devices of prepared claims.
+	draClaimClass = "claim"
+
+	// draCheckpointName is the file in the plugin directory the prepared
+	// claims are kept in across restarts.
+	draCheckpointName = "checkpoint.json"
+)
+
+var (
+	// draSupportedVersions are the versions of the DRA kubelet plugin API served.
+	draSupportedVersions = []string{"1.0.0"}
+
+	instanceNameInvalidRe = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+// DRAOptions configures the DRA kubelet plugin frontend.
+type DRAOptions struct {
+	// DriverName is the name of the DRA driver, e.g. qat.intel.com.
+	DriverName string
+	// NodeName is the name of the node the ResourceSlice is published for.
+	NodeName string
+	// PluginDir is the directory of the plugin socket.
+	PluginDir string
+	// RegistryDir is the kubelet plugin registration directory.
+	RegistryDir string
+	// CDISpecDir is the directory to write CDI specs of prepared claims to.
+	CDISpecDir string
+	// Publisher publishes ResourceSlices, nil disables publishing.
+	Publisher SlicePublisher
+}
+
+// draInstance is a device advertised as a named resource instance.
+type draInstance struct {
+	devType string
+	id      string
+	info    DeviceInfo
+}
+
+// DRAPlugin serves the devices found by a Scanner through the Dynamic
+// Resource Allocation kubelet plugin API. Devices are published as named
+// resource instances of a ResourceSlice and prepared claims are exposed to
+// containers through CDI.
+type DRAPlugin struct {
+	opts         DRAOptions
+	devicePlugin Scanner
+
+	// instances and claims are guarded by mutex.
+	instances map[string]draInstance
+	// claims maps UIDs of prepared claims to their instance names.
+	claims map[string][]string
+	mutex  sync.Mutex
+}
+
+// NewDRAPlugin creates a new DRA kubelet plugin frontend for the Scanner.
+func NewDRAPlugin(devicePlugin Scanner, opts DRAOptions) *DRAPlugin {
+	return &DRAPlugin{
+		opts:         opts,
+		devicePlugin: devicePlugin,
+		instances:    make(map[string]draInstance),
+		claims:       make(map[string][]string),
+	}
+}
+
+// PluginSocket returns the path of the DRA plugin socket.
+func (p *DRAPlugin) PluginSocket() string {
+	return filepath.Join(p.opts.PluginDir, "plugin.sock")
+}
+
+// checkpointPath returns the path of the file the prepared claims are kept in.
+func (p *DRAPlugin) checkpointPath() string {
+	return filepath.Join(p.opts.PluginDir, draCheckpointName)
+}
+
+// loadClaims restores the prepared claims saved before a restart, kubelet
+// doesn't prepare them again.
+func (p *DRAPlugin) loadClaims() error {
+	data, err := os.ReadFile(p.checkpointPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "Failed to read prepared claims")
+	}
+
+	claims := map[string][]string{}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return errors.Wrapf(err, "Failed to parse prepared claims in %s", p.checkpointPath())
+	}
+
+	p.mutex.Lock()
+	p.claims = claims
+	p.mutex.Unlock()
+
+	klog.V(1).Infof("Restored %d prepared claims", len(claims))
+
+	return nil
+}
+
+// saveClaims atomically replaces the saved prepared claims. The mutex must be held.
+func (p *DRAPlugin) saveClaims() error {
+	data, err := json.Marshal(p.claims)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal prepared claims")
+	}
+
+	tmpPath := p.checkpointPath() + ".tmp"
+
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Wrapf(err, "Failed to write %s", tmpPath)
+	}
+
+	if err := os.Rename(tmpPath, p.checkpointPath()); err != nil {
+		return errors.Wrapf(err, "Failed to rename %s", tmpPath)
+	}
+
+	return nil
+}
+
+// RegistrationSocket returns the path of the plugin registration socket.
+func (p *DRAPlugin) RegistrationSocket() string {
+	return filepath.Join(p.opts.RegistryDir, p.opts.DriverName+".sock")
+}
+
+// treeNotifier implements Notifier interface passing whole device trees.
+type treeNotifier struct {
+	ctx    context.Context
+	treeCh chan<- DeviceTree
+}
+
+func (n *treeNotifier) Notify(tree DeviceTree) {
+	select {
+	case n.treeCh <- tree:
+	case <-n.ctx.Done():
+	}
+}
+
+// Run serves the DRA plugin and registration sockets and publishes the
+// scanned devices until ctx is cancelled, SIGTERM or SIGINT is received or
+// scanning or serving fails. The sockets are removed before it returns.
+func (p *DRAPlugin) Run(ctx context.Context) error {
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	if err := p.loadClaims(); err != nil {
+		return err
+	}
+
+	pluginServer, err := serveUnix(p.PluginSocket(), func(s *grpc.Server) {
+		drapb.RegisterNodeServer(s, p)
+	})
+	if err != nil {
+		return err
+	}
+	defer stopUnix(pluginServer, p.PluginSocket())
+
+	registrationServer, err := serveUnix(p.RegistrationSocket(), func(s *grpc.Server) {
+		registerapi.RegisterRegistrationServer(s, p)
+	})
+	if err != nil {
+		return err
+	}
+	defer stopUnix(registrationServer, p.RegistrationSocket())
+
+	treeCh := make(chan DeviceTree)
+	errCh := make(chan error, 1)
+
+	var lastSlice *ResourceSlice
+
+	go func() {
+		if err := p.devicePlugin.Scan(ctx, &treeNotifier{ctx: ctx, treeCh: treeCh}); err != nil {
+			errCh <- errors.Wrap(err, "Device scan failed")
+		}
+	}()
+
+	for {
+		select {
+		case tree := <-treeCh:
+			slice := p.update(tree)
+
+			if p.opts.Publisher == nil || reflect.DeepEqual(slice, lastSlice) {
+				continue
+			}
+
+			if err := p.opts.Publisher.PublishResourceSlice(ctx, slice); err != nil {
+				klog.Errorf("Unable to publish ResourceSlice: %+v", err)
+				continue
+			}
+
+			lastSlice = slice
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			klog.V(1).Info("Shutting down DRA plugin")
+			return ctx.Err()
+		}
+	}
+}
+
+// update replaces the advertised instances and returns the ResourceSlice describing them.
+func (p *DRAPlugin) update(tree DeviceTree) *ResourceSlice {
+	instances := make(map[string]draInstance)
+
+	for devType, devices := range tree {
+		for id, info := range devices {
+			name := id
+			if info.stableID != "" {
+				name = info.stableID
+			}
+
+			instances[draInstanceName(devType, name)] = draInstance{
+				devType: devType,
+				id:      id,
+				info:    info,
+			}
+		}
+	}
+
+	p.mutex.Lock()
+	p.instances = instances
+	p.mutex.Unlock()
+
+	slice := NewResourceSlice(p.opts.NodeName, p.opts.DriverName)
+
+	for name, instance := range instances {
+		// Unhealthy devices must not be allocated.
+		if instance.info.state != pluginapi.Healthy {
+			continue
+		}
+
+		slice.NamedResources.Instances = append(slice.NamedResources.Instances, NamedResourcesInstance{
+			Name:       name,
+			Attributes: draAttributes(instance),
+		})
+	}
+
+	sort.Slice(slice.NamedResources.Instances, func(i, j int) bool {
+		return slice.NamedResources.Instances[i].Name < slice.NamedResources.Instances[j].Name
+	})
+
+	return slice
+}
+
+// draInstanceName returns a DNS label naming the device, e.g. cy2-dc0-ssl-1.
+func draInstanceName(devType, id string) string {
+	name := instanceNameInvalidRe.ReplaceAllString(strings.ToLower(devType+"-"+id), "-")
+
+	return strings.Trim(name, "-")
+}
+
+// draAttributes describes the device for structured parameters. The QAT
+// specific attributes are set by the Scanner, e.g. the instance counts of
+// the section of kernel mode devices, and the section is read from the
+// QAT_SECTION_NAME_* variable.
+func draAttributes(instance draInstance) []NamedResourcesAttribute {
+	attrs := []NamedResourcesAttribute{
+		stringAttribute("resource", instance.devType),
+	}
+
+	names := make([]string, 0, len(instance.info.attributes))
+	for name := range instance.info.attributes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		attrs = append(attrs, intAttribute(name, instance.info.attributes[name]))
+	}
+
+	for key, section := range instance.info.envs {
+		if strings.HasPrefix(key, "QAT_SECTION_NAME_") {
+			attrs = append(attrs, stringAttribute("section", section))
+			break
+		}
+	}
+
+	if instance.info.topology != nil && len(instance.info.topology.Nodes) > 0 {
+		attrs = append(attrs, intAttribute("numaNode", instance.info.topology.Nodes[0].ID))
+	}
+
+	return attrs
+}
+
+// GetInfo implements the plugin registration API.
+func (p *DRAPlugin) GetInfo(ctx context.Context, req *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DRAPlugin,
+		Name:              p.opts.DriverName,
+		Endpoint:          p.PluginSocket(),
+		SupportedVersions: draSupportedVersions,
+	}, nil
+}
+
+// NotifyRegistrationStatus implements the plugin registration API.
+func (p *DRAPlugin) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	if !status.PluginRegistered {
+		klog.Errorf("DRA plugin %s registration failed: %s", p.opts.DriverName, status.Error)
+	} else {
+		klog.V(1).Infof("DRA plugin %s registered", p.opts.DriverName)
+	}
+
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
+
+// draResourceHandle is the resource handle of an allocated claim. It lists
+// the named resource instances allocated from the ResourceSlice.
+type draResourceHandle struct {
+	Results []struct {
+		NamedResources *struct {
+			Name string `json:"name"`
+		} `json:"namedResources"`
+	} `json:"results"`
+}
+
+// NodePrepareResources implements the DRA kubelet plugin API.
+func (p *DRAPlugin) NodePrepareResources(ctx context.Context, req *drapb.NodePrepareResourcesRequest) (*drapb.NodePrepareResourcesResponse, error) {
+	resp := &drapb.NodePrepareResourcesResponse{
+		Claims: make(map[string]*drapb.NodePrepareResourceResponse),
+	}
+
+	for _, claim := range req.Claims {
+		cdiDevices, err := p.prepareClaim(claim)
+		if err != nil {
+			klog.Errorf("Unable to prepare claim %s/%s: %+v", claim.Namespace, claim.Name, err)
+
+			resp.Claims[claim.Uid] = &drapb.NodePrepareResourceResponse{Error: err.Error()}
+
+			continue
+		}
+
+		resp.Claims[claim.Uid] = &drapb.NodePrepareResourceResponse{CDIDevices: cdiDevices}
+	}
+
+	return resp, nil
+}
+
+func (p *DRAPlugin) prepareClaim(claim *drapb.Claim) ([]string, error) {
+	cdiDevice := cdiKind(p.opts.DriverName, draClaimClass) + "=" + claim.Uid
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.claims[claim.Uid]; ok {
+		return []string{cdiDevice}, nil
+	}
+
+	handle := draResourceHandle{}
+	if err := json.Unmarshal([]byte(claim.ResourceHandle), &handle); err != nil {
+		return nil, errors.Wrap(err, "Invalid resource handle")
+	}
+
+	names := []string{}
+	devices := []DeviceInfo{}
+
+	for _, result := range handle.Results {
+		if result.NamedResources == nil {
+			return nil, errors.New("Resource handle contains no named resource")
+		}
+
+		name := result.NamedResources.Name
+
+		instance, ok := p.instances[name]
+		if !ok {
+			return nil, errors.Errorf("Unknown instance %s", name)
+		}
+
+		if instance.info.state != pluginapi.Healthy {
+			return nil, errors.Errorf("Instance %s is unhealthy", name)
+		}
+
+		if owner := p.claimOf(name); owner != "" {
+			return nil, errors.Errorf("Instance %s is already prepared for claim %s", name, owner)
+		}
+
+		names = append(names, name)
+		devices = append(devices, instance.info)
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New("Resource handle contains no instances")
+	}
+
+	edits := newContainerEdits(devices...)
+	if err := p.postAllocate(&edits); err != nil {
+		return nil, err
+	}
+
+	spec := &cdispec.Spec{
+		Version: cdiVersion,
+		Kind:    cdiKind(p.opts.DriverName, draClaimClass),
+		Devices: []cdispec.Device{
+			{
+				Name:           claim.Uid,
+				ContainerEdits: edits,
+			},
+		},
+	}
+
+	if err := writeCDISpecFile(p.claimSpecPath(claim.Uid), spec); err != nil {
+		return nil, err
+	}
+
+	p.claims[claim.Uid] = names
+
+	if err := p.saveClaims(); err != nil {
+		delete(p.claims, claim.Uid)
+		_ = os.Remove(p.claimSpecPath(claim.Uid))
+
+		return nil, err
+	}
+
+	return []string{cdiDevice}, nil
+}
+
+// postAllocate passes the env variables of a claim through the PostAllocator
+// of the Scanner, if any, so that they are renumbered across the devices of
+// the claim like those returned by Allocate().
+func (p *DRAPlugin) postAllocate(edits *cdispec.ContainerEdits) error {
+	postAllocator, ok := p.devicePlugin.(PostAllocator)
+	if !ok {
+		return nil
+	}
+
+	cresp := &pluginapi.ContainerAllocateResponse{Envs: map[string]string{}}
+
+	for _, env := range edits.Env {
+		kv := strings.SplitN(env, "=", 2)
+		cresp.Envs[kv[0]] = kv[1]
+	}
+
+	response := &pluginapi.AllocateResponse{ContainerResponses: []*pluginapi.ContainerAllocateResponse{cresp}}
+	if err := postAllocator.PostAllocate(response); err != nil {
+		return errors.Wrap(err, "Failed to renumber env variables")
+	}
+
+	edits.Env = []string{}
+	for key, value := range cresp.Envs {
+		edits.Env = append(edits.Env, key+"="+value)
+	}
+
+	sort.Strings(edits.Env)
+
+	return nil
+}
+
+// claimOf returns UID of the claim the instance is prepared for. The mutex must be held.
+func (p *DRAPlugin) claimOf(name string) string {
+	for uid, names := range p.claims {
+		for _, n := range names {
+			if n == name {
+				return uid
+			}
+		}
+	}
+
+	return ""
+}
+
+func (p *DRAPlugin) claimSpecPath(uid string) string {
+	return cdiSpecPath(p.opts.CDISpecDir, p.opts.DriverName, draClaimClass+"-"+uid)
+}
+
+// NodeUnprepareResources implements the DRA kubelet plugin API.
+func (p *DRAPlugin) NodeUnprepareResources(ctx context.Context, req *drapb.NodeUnprepareResourcesRequest) (*drapb.NodeUnprepareResourcesResponse, error) {
+	resp := &drapb.NodeUnprepareResourcesResponse{
+		Claims: make(map[string]*drapb.NodeUnprepareResourceResponse),
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, claim := range req.Claims {
+		resp.Claims[claim.Uid] = &drapb.NodeUnprepareResourceResponse{}
+
+		if err := os.Remove(p.claimSpecPath(claim.Uid)); err != nil && !os.IsNotExist(err) {
+			resp.Claims[claim.Uid].Error = err.Error()
+			continue
+		}
+
+		delete(p.claims, claim.Uid)
+
+		if err := p.saveClaims(); err != nil {
+			resp.Claims[claim.Uid].Error = err.Error()
+		}
+	}
+
+	return resp, nil
+}
+
+// serveUnix starts a gRPC server on a unix socket replacing a stale socket.
+func serveUnix(socket string, register func(*grpc.Server)) (*grpc.Server, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0750); err != nil {
+		return nil, errors.Wrapf(err, "Failed to create directory of %s", socket)
+	}
+
+	// We don't care if the socket file doesn't exist.
+	_ = os.Remove(socket)
+
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to listen to %s", socket)
+	}
+
+	grpcServer := grpc.NewServer()
+	register(grpcServer)
+
+	go func() {
+		klog.V(1).Infof("Start server at: %s", socket)
+
+		if serveErr := grpcServer.Serve(lis); serveErr != nil {
+			klog.Errorf("unable to start gRPC server: %+v", serveErr)
+		}
+	}()
+
+	return grpcServer, nil
+}
+
+func stopUnix(grpcServer *grpc.Server, socket string) {
+	grpcServer.Stop()
+
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Failed to remove %s: %+v", socket, err)
+	}
+}
@@ -0,0 +1,217 @@
+package deviceplugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	resourceSliceAPIVersion = "resource.k8s.io/v1alpha2"
+	resourceSlicesPath      = "/apis/resource.k8s.io/v1alpha2/resourceslices"
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// ResourceSlice mirrors the resource.k8s.io/v1alpha2 ResourceSlice object
+// with the named resources model.
+type ResourceSlice struct {
+	APIVersion     string                  `json:"apiVersion"`
+	Kind           string                  `json:"kind"`
+	Metadata       ObjectMeta              `json:"metadata"`
+	NodeName       string                  `json:"nodeName"`
+	DriverName     string                  `json:"driverName"`
+	NamedResources NamedResourcesResources `json:"namedResources"`
+}
+
+// ObjectMeta holds the metadata fields of a ResourceSlice used by the plugin.
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// NamedResourcesResources lists the instances of a ResourceSlice.
+type NamedResourcesResources struct {
+	Instances []NamedResourcesInstance `json:"instances"`
+}
+
+// NamedResourcesInstance is a single allocatable device.
+type NamedResourcesInstance struct {
+	Name       string                    `json:"name"`
+	Attributes []NamedResourcesAttribute `json:"attributes,omitempty"`
+}
+
+// NamedResourcesAttribute is an attribute of an instance claims can select on.
+type NamedResourcesAttribute struct {
+	Name        string  `json:"name"`
+	IntValue    *int64  `json:"int,omitempty"`
+	StringValue *string `json:"string,omitempty"`
+}
+
+func intAttribute(name string, value int64) NamedResourcesAttribute {
+	return NamedResourcesAttribute{Name: name, IntValue: &value}
+}
+
+func stringAttribute(name, value string) NamedResourcesAttribute {
+	return NamedResourcesAttribute{Name: name, StringValue: &value}
+}
+
+// NewResourceSlice returns an empty ResourceSlice of the driver on the node.
+func NewResourceSlice(nodeName, driverName string) *ResourceSlice {
+	return &ResourceSlice{
+		APIVersion: resourceSliceAPIVersion,
+		Kind:       "ResourceSlice",
+		Metadata: ObjectMeta{
+			Name: nodeName + "-" + driverName,
+		},
+		NodeName:   nodeName,
+		DriverName: driverName,
+		NamedResources: NamedResourcesResources{
+			Instances: []NamedResourcesInstance{},
+		},
+	}
+}
+
+// SlicePublisher publishes the ResourceSlice of the node to the cluster.
+type SlicePublisher interface {
+	PublishResourceSlice(ctx context.Context, slice *ResourceSlice) error
+}
+
+// apiPublisher publishes ResourceSlices through the Kubernetes REST API.
+type apiPublisher struct {
+	client *http.Client
+	host   string
+	// tokenPath is read on every request, projected tokens are rotated.
+	tokenPath string
+}
+
+// NewInClusterPublisher returns a SlicePublisher using the service account of the pod.
+func NewInClusterPublisher() (SlicePublisher, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running in a cluster, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT not set")
+	}
+
+	tokenPath := serviceAccountDir + "/token"
+
+	if _, err := readToken(tokenPath); err != nil {
+		return nil, err
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read service account CA")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("Failed to parse service account CA")
+	}
+
+	return &apiPublisher{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs:    pool,
+					MinVersion: tls.VersionTLS12,
+				},
+			},
+		},
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenPath: tokenPath,
+	}, nil
+}
+
+func readToken(path string) (string, error) {
+	token, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read service account token")
+	}
+
+	return string(bytes.TrimSpace(token)), nil
+}
+
+// PublishResourceSlice creates the ResourceSlice or replaces the existing one.
+func (p *apiPublisher) PublishResourceSlice(ctx context.Context, slice *ResourceSlice) error {
+	existing := ResourceSlice{}
+
+	status, err := p.do(ctx, http.MethodGet, resourceSlicesPath+"/"+slice.Metadata.Name, nil, &existing)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case http.StatusNotFound:
+		_, err = p.do(ctx, http.MethodPost, resourceSlicesPath, slice, nil)
+	case http.StatusOK:
+		update := *slice
+		update.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+		_, err = p.do(ctx, http.MethodPut, resourceSlicesPath+"/"+slice.Metadata.Name, &update, nil)
+	default:
+		err = errors.Errorf("Unexpected status %d getting ResourceSlice %s", status, slice.Metadata.Name)
+	}
+
+	return err
+}
+
+// do sends the request and decodes a successful response into out. Statuses
+// other than 404 outside of the 2xx range are returned as errors.
+func (p *apiPublisher) do(ctx context.Context, method, path string, in, out interface{}) (int, error) {
+	var body io.Reader
+
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, errors.Wrap(err, "Failed to marshal request")
+		}
+
+		body = bytes.NewReader(data)
+	}
+
+	token, err := readToken(p.tokenPath)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.host+path, body)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to create request")
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s %s failed", method, path)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp.StatusCode, errors.Errorf("%s %s failed with status %d: %s", method, path, resp.StatusCode, msg)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, errors.Wrap(err, "Failed to decode response")
+		}
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,429 @@
+package deviceplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/deviceplugin/fakekubelet"
+)
+
+// treeScanner passes the device trees sent to it to the notifier until the
+// channel is closed or ctx is done.
+type treeScanner struct {
+	trees chan DeviceTree
+}
+
+func newTreeScanner() *treeScanner {
+	return &treeScanner{trees: make(chan DeviceTree)}
+}
+
+func (s *treeScanner) Scan(ctx context.Context, notifier Notifier) error {
+	for {
+		select {
+		case tree, ok := <-s.trees:
+			if !ok {
+				return nil
+			}
+
+			notifier.Notify(tree)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// slicePublisher passes the published ResourceSlices to a channel.
+type slicePublisher struct {
+	slices chan *ResourceSlice
+}
+
+func (p *slicePublisher) PublishResourceSlice(ctx context.Context, slice *ResourceSlice) error {
+	select {
+	case p.slices <- slice:
+	case <-ctx.Done():
+	}
+
+	return nil
+}
+
+// renumberingScanner renumbers the QAT_SECTION_NAME_<resource>_<n>
+// variables of every container from zero like the kernel mode plugin.
+type renumberingScanner struct {
+	*treeScanner
+}
+
+func (s renumberingScanner) PostAllocate(response *pluginapi.AllocateResponse) error {
+	for _, cresp := range response.ContainerResponses {
+		keys := []string{}
+
+		for key := range cresp.Envs {
+			if strings.HasPrefix(key, "QAT_SECTION_NAME_") {
+				keys = append(keys, key)
+			}
+		}
+
+		sort.Strings(keys)
+
+		envs := map[string]string{}
+
+		for i, key := range keys {
+			envs[fmt.Sprintf("%s_%d", key[:strings.LastIndex(key, "_")], i)] = cresp.Envs[key]
+			delete(cresp.Envs, key)
+		}
+
+		for key, value := range envs {
+			cresp.Envs[key] = value
+		}
+	}
+
+	return nil
+}
+
+// testDRATree returns two devices of the SSL section numbered after the
+// devices of another resource, each with its own UIO node.
+func testDRATree() DeviceTree {
+	tree := NewDeviceTree()
+
+	for i, id := range []string{"SSL_0", "SSL_1"} {
+		tree.AddDevice("asym", id, NewDeviceInfoWithTopologyHints(pluginapi.Healthy,
+			[]pluginapi.DeviceSpec{
+				{HostPath: "/dev/qat_adf_ctl", ContainerPath: "/dev/qat_adf_ctl", Permissions: "rw"},
+				{HostPath: fmt.Sprintf("/dev/uio%d", i+4), ContainerPath: fmt.Sprintf("/dev/uio%d", i+4), Permissions: "rw"},
+			},
+			nil,
+			map[string]string{fmt.Sprintf("QAT_SECTION_NAME_asym_%d", i+4): "SSL"},
+			nil,
+			&pluginapi.TopologyInfo{Nodes: []*pluginapi.NUMANode{{ID: 1}}},
+		).WithAttributes(map[string]int64{"cryptoInstances": 2, "compressionInstances": 0}))
+	}
+
+	return tree
+}
+
+func testClaim(uid string, instances ...string) *drapb.Claim {
+	handle := `{"results":[`
+
+	for i, name := range instances {
+		if i > 0 {
+			handle += ","
+		}
+
+		handle += `{"namedResources":{"name":"` + name + `"}}`
+	}
+
+	return &drapb.Claim{
+		Namespace:      "default",
+		Uid:            uid,
+		Name:           "claim-" + uid,
+		ResourceHandle: handle + "]}",
+	}
+}
+
+type draTest struct {
+	t       *testing.T
+	kubelet *fakekubelet.Kubelet
+	opts    DRAOptions
+	scanner *treeScanner
+	slices  chan *ResourceSlice
+	cancel  context.CancelFunc
+	runErr  chan error
+	ctx     context.Context
+	driver  string
+	specDir string
+}
+
+func newDRATest(t *testing.T) *draTest {
+	kubelet := newTestKubelet(t)
+	specDir := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	return &draTest{
+		t:       t,
+		kubelet: kubelet,
+		ctx:     ctx,
+		driver:  testNamespace,
+		specDir: specDir,
+		opts: DRAOptions{
+			DriverName:  testNamespace,
+			NodeName:    "node",
+			PluginDir:   filepath.Join(kubelet.Dir(), "plugins", testNamespace),
+			RegistryDir: kubelet.PluginRegistryDir(),
+			CDISpecDir:  specDir,
+		},
+	}
+}
+
+// start runs a new plugin instance and registers it with the kubelet.
+func (d *draTest) start() *ResourceSlice {
+	d.t.Helper()
+
+	d.scanner = newTreeScanner()
+	d.slices = make(chan *ResourceSlice)
+	d.opts.Publisher = &slicePublisher{slices: d.slices}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.cancel = cancel
+	d.runErr = make(chan error, 1)
+
+	plugin := NewDRAPlugin(renumberingScanner{d.scanner}, d.opts)
+
+	go func() {
+		d.runErr <- plugin.Run(ctx)
+	}()
+
+	info, err := d.kubelet.RegisterDRAPlugin(d.ctx, d.driver)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+
+	if info.Type != registerapi.DRAPlugin || info.Endpoint != plugin.PluginSocket() {
+		d.t.Errorf("unexpected plugin info %+v", info)
+	}
+
+	d.scanner.trees <- testDRATree()
+
+	select {
+	case slice := <-d.slices:
+		return slice
+	case <-d.ctx.Done():
+		d.t.Fatal("ResourceSlice not published")
+	}
+
+	return nil
+}
+
+func (d *draTest) stop() {
+	d.t.Helper()
+
+	d.cancel()
+
+	if err := <-d.runErr; err != context.Canceled {
+		d.t.Errorf("Run() failed: %+v", err)
+	}
+}
+
+func (d *draTest) prepare(claim *drapb.Claim) *drapb.NodePrepareResourceResponse {
+	d.t.Helper()
+
+	resp, err := d.kubelet.NodePrepareResources(d.ctx, d.driver, claim)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+
+	return resp.Claims[claim.Uid]
+}
+
+func TestDRAPlugin(t *testing.T) {
+	d := newDRATest(t)
+
+	slice := d.start()
+
+	if len(slice.NamedResources.Instances) != 2 {
+		t.Fatalf("expected 2 instances, got %+v", slice.NamedResources.Instances)
+	}
+
+	attrs := map[string]interface{}{}
+
+	for _, attr := range slice.NamedResources.Instances[0].Attributes {
+		switch {
+		case attr.IntValue != nil:
+			attrs[attr.Name] = *attr.IntValue
+		case attr.StringValue != nil:
+			attrs[attr.Name] = *attr.StringValue
+		}
+	}
+
+	expected := map[string]interface{}{
+		"resource":             "asym",
+		"cryptoInstances":      int64(2),
+		"compressionInstances": int64(0),
+		"section":              "SSL",
+		"numaNode":             int64(1),
+	}
+
+	if len(attrs) != len(expected) {
+		t.Errorf("expected attributes %v, got %v", expected, attrs)
+	}
+
+	for name, value := range expected {
+		if attrs[name] != value {
+			t.Errorf("expected attribute %s=%v, got %v", name, value, attrs[name])
+		}
+	}
+
+	claim := testClaim("uid-1", "asym-ssl-0")
+
+	prepared := d.prepare(claim)
+	if prepared.Error != "" || len(prepared.CDIDevices) != 1 || prepared.CDIDevices[0] != testNamespace+"/claim=uid-1" {
+		t.Fatalf("unexpected prepare response %+v", prepared)
+	}
+
+	if _, err := os.Stat(filepath.Join(d.specDir, testNamespace+"-claim-uid-1.json")); err != nil {
+		t.Errorf("CDI spec of the claim not written: %v", err)
+	}
+
+	// The prepared claims survive a restart.
+	d.stop()
+	d.start()
+
+	if prepared := d.prepare(testClaim("uid-2", "asym-ssl-0")); prepared.Error == "" {
+		t.Errorf("instance of a claim prepared before the restart prepared again: %+v", prepared)
+	}
+
+	if prepared := d.prepare(claim); prepared.Error != "" {
+		t.Errorf("preparing the claim again failed: %s", prepared.Error)
+	}
+
+	resp, err := d.kubelet.NodeUnprepareResources(d.ctx, d.driver, claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if unprepared := resp.Claims[claim.Uid]; unprepared.Error != "" {
+		t.Errorf("unprepare failed: %s", unprepared.Error)
+	}
+
+	d.stop()
+	d.start()
+
+	if prepared := d.prepare(testClaim("uid-2", "asym-ssl-0")); prepared.Error != "" {
+		t.Errorf("instance of an unprepared claim can't be prepared: %s", prepared.Error)
+	}
+
+	d.stop()
+}
+
+func TestAPIPublisherToken(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	tokens := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("Authorization"))
+
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{})
+	}))
+	defer server.Close()
+
+	publisher := &apiPublisher{client: server.Client(), host: server.URL, tokenPath: tokenPath}
+
+	for _, token := range []string{"first", "rotated"} {
+		if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := publisher.PublishResourceSlice(context.Background(), NewResourceSlice("node", testNamespace)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"Bearer first", "Bearer first", "Bearer rotated", "Bearer rotated"}
+
+	if len(tokens) != len(expected) {
+		t.Fatalf("expected requests with %v, got %v", expected, tokens)
+	}
+
+	for i := range expected {
+		if tokens[i] != expected[i] {
+			t.Errorf("request %d: expected %q, got %q", i, expected[i], tokens[i])
+		}
+	}
+}
+
+func TestDRAPluginRenumbersClaims(t *testing.T) {
+	d := newDRATest(t)
+	d.start()
+
+	if prepared := d.prepare(testClaim("uid-1", "asym-ssl-1", "asym-ssl-0")); prepared.Error != "" {
+		t.Fatalf("prepare failed: %s", prepared.Error)
+	}
+
+	d.stop()
+
+	data, err := os.ReadFile(filepath.Join(d.specDir, testNamespace+"-claim-uid-1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &cdispec.Spec{}
+	if err := json.Unmarshal(data, spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spec.Devices) != 1 {
+		t.Fatalf("expected the device of the claim, got %+v", spec.Devices)
+	}
+
+	edits := spec.Devices[0].ContainerEdits
+
+	// The variables and UIO nodes are numbered from zero in the container.
+	expectedEnv := []string{"QAT_SECTION_NAME_asym_0=SSL", "QAT_SECTION_NAME_asym_1=SSL"}
+	if !reflect.DeepEqual(edits.Env, expectedEnv) {
+		t.Errorf("expected env %v, got %v", expectedEnv, edits.Env)
+	}
+
+	uio := map[string]string{}
+
+	for _, node := range edits.DeviceNodes {
+		if strings.HasPrefix(node.HostPath, "/dev/uio") {
+			uio[node.Path] = node.HostPath
+		}
+	}
+
+	expectedUIO := map[string]string{"/dev/uio0": "/dev/uio5", "/dev/uio1": "/dev/uio4"}
+	if !reflect.DeepEqual(uio, expectedUIO) {
+		t.Errorf("expected UIO nodes %v, got %v", expectedUIO, uio)
+	}
+}
+
+func TestDRAInstanceNames(t *testing.T) {
+	tree := NewDeviceTree()
+	tree.AddDevice("cy1_dc0", "SSL_1", NewDeviceInfoWithTopologyHints(pluginapi.Healthy, nil, nil, nil, nil, nil))
+	tree.AddDevice("cy1_dc0", "SSL_2", NewDeviceInfoWithTopologyHints(pluginapi.Healthy, nil, nil, nil, nil, nil).WithStableID("SSL_0000:3d:00.0_0"))
+
+	plugin := NewDRAPlugin(newTreeScanner(), DRAOptions{})
+	slice := plugin.update(tree)
+
+	names := []string{}
+	for _, instance := range slice.NamedResources.Instances {
+		names = append(names, instance.Name)
+	}
+
+	expected := []string{"cy1-dc0-ssl-0000-3d-00-0-0", "cy1-dc0-ssl-1"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected instances %v, got %v", expected, names)
+	}
+
+	// The debug state lists the same instances with their device IDs.
+	state, _ := plugin.DebugState().(DRAState)
+
+	debugNames := []string{}
+	for _, instance := range state.Instances {
+		debugNames = append(debugNames, instance.Name+"="+instance.Resource+"/"+instance.Device.ID)
+	}
+
+	expected = []string{"cy1-dc0-ssl-0000-3d-00-0-0=cy1_dc0/SSL_2", "cy1-dc0-ssl-1=cy1_dc0/SSL_1"}
+	if !reflect.DeepEqual(debugNames, expected) {
+		t.Errorf("expected debug state instances %v, got %v", expected, debugNames)
+	}
+}
@@ -0,0 +1,147 @@
+package fakekubelet
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/klog/v2"
+	drapb "k8s.io/kubelet/pkg/apis/dra/v1alpha3"
+	registerapi "k8s.io/kubelet/pkg/apis/pluginregistration/v1"
+)
+
+// PluginRegistryDirName is the name of the plugin registration directory in
+// the plugin directory.
+const PluginRegistryDirName = "plugins_registry"
+
+// draPlugin is a registered DRA kubelet plugin.
+type draPlugin struct {
+	info   *registerapi.PluginInfo
+	conn   *grpc.ClientConn
+	client drapb.NodeClient
+}
+
+func (p *draPlugin) close() {
+	if err := p.conn.Close(); err != nil {
+		klog.V(4).Infof("Failed to close connection to %s: %v", p.info.Endpoint, err)
+	}
+}
+
+// PluginRegistryDir returns the directory DRA plugins create their
+// registration sockets in.
+func (k *Kubelet) PluginRegistryDir() string {
+	return filepath.Join(k.dir, PluginRegistryDirName)
+}
+
+// dialUnix connects to the socket, waiting for it to appear until ctx is done.
+func dialUnix(ctx context.Context, socket string) (*grpc.ClientConn, error) {
+	conn, err := grpc.DialContext(ctx, socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}))
+
+	return conn, errors.Wrapf(err, "Cannot connect to %s", socket)
+}
+
+// RegisterDRAPlugin registers the DRA plugin of the driver like the kubelet
+// plugin watcher: it gets the plugin info from the registration socket of the
+// driver in the plugin registry directory, connects to the plugin endpoint
+// and reports the registration status. It waits for the registration socket
+// until ctx is done.
+func (k *Kubelet) RegisterDRAPlugin(ctx context.Context, driverName string) (*registerapi.PluginInfo, error) {
+	regConn, err := dialUnix(ctx, filepath.Join(k.PluginRegistryDir(), driverName+".sock"))
+	if err != nil {
+		return nil, err
+	}
+	defer regConn.Close()
+
+	regClient := registerapi.NewRegistrationClient(regConn)
+
+	info, err := regClient.GetInfo(ctx, &registerapi.InfoRequest{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetInfo failed for %s", driverName)
+	}
+
+	status := &registerapi.RegistrationStatus{PluginRegistered: true}
+
+	switch {
+	case info.Type != registerapi.DRAPlugin:
+		status = &registerapi.RegistrationStatus{Error: "unsupported plugin type " + info.Type}
+	case info.Name != driverName:
+		status = &registerapi.RegistrationStatus{Error: "plugin name " + info.Name + " doesn't match the socket"}
+	case len(info.SupportedVersions) == 0:
+		status = &registerapi.RegistrationStatus{Error: "no supported versions"}
+	}
+
+	var conn *grpc.ClientConn
+
+	if status.PluginRegistered {
+		if conn, err = dialUnix(ctx, info.Endpoint); err != nil {
+			status = &registerapi.RegistrationStatus{Error: err.Error()}
+		}
+	}
+
+	if _, err := regClient.NotifyRegistrationStatus(ctx, status); err != nil {
+		if conn != nil {
+			_ = conn.Close()
+		}
+
+		return nil, errors.Wrapf(err, "NotifyRegistrationStatus failed for %s", driverName)
+	}
+
+	if !status.PluginRegistered {
+		return nil, errors.Errorf("Registration of %s failed: %s", driverName, status.Error)
+	}
+
+	k.mutex.Lock()
+	if old, ok := k.draPlugins[driverName]; ok {
+		old.close()
+	}
+
+	k.draPlugins[driverName] = &draPlugin{
+		info:   info,
+		conn:   conn,
+		client: drapb.NewNodeClient(conn),
+	}
+	k.notify()
+	k.mutex.Unlock()
+
+	return info, nil
+}
+
+func (k *Kubelet) draClient(driverName string) (drapb.NodeClient, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	p, ok := k.draPlugins[driverName]
+	if !ok {
+		return nil, errors.Errorf("DRA plugin %s is not registered", driverName)
+	}
+
+	return p.client, nil
+}
+
+// NodePrepareResources prepares the claims with the DRA plugin of the driver.
+func (k *Kubelet) NodePrepareResources(ctx context.Context, driverName string, claims ...*drapb.Claim) (*drapb.NodePrepareResourcesResponse, error) {
+	client, err := k.draClient(driverName)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.NodePrepareResources(ctx, &drapb.NodePrepareResourcesRequest{Claims: claims})
+}
+
+// NodeUnprepareResources unprepares the claims with the DRA plugin of the driver.
+func (k *Kubelet) NodeUnprepareResources(ctx context.Context, driverName string, claims ...*drapb.Claim) (*drapb.NodeUnprepareResourcesResponse, error) {
+	client, err := k.draClient(driverName)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.NodeUnprepareResources(ctx, &drapb.NodeUnprepareResourcesRequest{Claims: claims})
+}
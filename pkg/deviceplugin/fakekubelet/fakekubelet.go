@@ -0,0 +1,454 @@
+// Package fakekubelet provides an in-process kubelet for testing device
+// plugins without a cluster. It serves the device plugin Registration API on
+// a unix socket, connects back to registered plugins, keeps their ListAndWatch
+// streams open and forwards Allocate, GetPreferredAllocation and
+// PreStartContainer calls to them. It also serves the PodResources API with
+// pod resources set by the test and registers DRA kubelet plugins through
+// the plugin registration API.
+package fakekubelet
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/klog/v2"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+const (
+	// SocketName is the name of the registration socket in the plugin directory.
+	SocketName = "kubelet.sock"
+	// PodResourcesSocketName is the name of the PodResources API socket in
+	// the plugin directory.
+	PodResourcesSocketName = "pod-resources.sock"
+)
+
+// plugin is a registered device plugin.
+type plugin struct {
+	request *pluginapi.RegisterRequest
+	conn    *grpc.ClientConn
+	client  pluginapi.DevicePluginClient
+	cancel  context.CancelFunc
+	devices []*pluginapi.Device
+	// streaming is true while the ListAndWatch stream is open.
+	streaming bool
+}
+
+// Kubelet is a fake kubelet serving the Registration API.
+type Kubelet struct {
+	dir                string
+	grpcServer         *grpc.Server
+	podResourcesServer *grpc.Server
+
+	mutex         sync.Mutex
+	registrations []*pluginapi.RegisterRequest
+	plugins       map[string]*plugin
+	draPlugins    map[string]*draPlugin
+	podResources  []*podresourcesapi.PodResources
+	// changed is closed and replaced whenever the state changes.
+	changed chan struct{}
+}
+
+// New starts a fake kubelet serving the Registration API at dir/kubelet.sock
+// and the PodResources API at dir/pod-resources.sock. Device plugins are
+// expected to create their sockets in the same directory.
+func New(dir string) (*Kubelet, error) {
+	k := &Kubelet{
+		dir:        dir,
+		plugins:    map[string]*plugin{},
+		draPlugins: map[string]*draPlugin{},
+		changed:    make(chan struct{}),
+	}
+
+	if err := k.serve(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Dir returns the device plugin directory of the kubelet.
+func (k *Kubelet) Dir() string {
+	return k.dir
+}
+
+// Socket returns the path of the registration socket.
+func (k *Kubelet) Socket() string {
+	return filepath.Join(k.dir, SocketName)
+}
+
+// PodResourcesSocket returns the path of the PodResources API socket.
+func (k *Kubelet) PodResourcesSocket() string {
+	return filepath.Join(k.dir, PodResourcesSocketName)
+}
+
+func (k *Kubelet) serve() error {
+	k.grpcServer = grpc.NewServer()
+	pluginapi.RegisterRegistrationServer(k.grpcServer, k)
+
+	if err := listenAndServe(k.grpcServer, k.Socket()); err != nil {
+		return err
+	}
+
+	k.podResourcesServer = grpc.NewServer()
+	podresourcesapi.RegisterPodResourcesListerServer(k.podResourcesServer, &podResourcesLister{k: k})
+
+	if err := listenAndServe(k.podResourcesServer, k.PodResourcesSocket()); err != nil {
+		k.grpcServer.Stop()
+		return err
+	}
+
+	return nil
+}
+
+func listenAndServe(grpcServer *grpc.Server, socket string) error {
+	// We don't care if the socket file doesn't exist.
+	_ = os.Remove(socket)
+
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to listen to %s", socket)
+	}
+
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			klog.Errorf("Fake kubelet failed to serve %s: %+v", socket, err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the servers and disconnects from all plugins.
+func (k *Kubelet) Stop() {
+	k.grpcServer.Stop()
+	k.podResourcesServer.Stop()
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	for name, p := range k.plugins {
+		p.close()
+		delete(k.plugins, name)
+	}
+
+	for name, p := range k.draPlugins {
+		p.close()
+		delete(k.draPlugins, name)
+	}
+
+	k.notify()
+}
+
+// Restart simulates a kubelet restart: the registration server is restarted,
+// connections to plugins are dropped and all plugin sockets are deleted, which
+// makes the plugins register again.
+func (k *Kubelet) Restart() error {
+	k.Stop()
+
+	if err := k.serve(); err != nil {
+		return err
+	}
+
+	sockets, err := filepath.Glob(filepath.Join(k.dir, "*.sock"))
+	if err != nil {
+		return errors.Wrap(err, "Failed to list plugin sockets")
+	}
+
+	for _, socket := range sockets {
+		if name := filepath.Base(socket); name == SocketName || name == PodResourcesSocketName {
+			continue
+		}
+
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Failed to remove %s", socket)
+		}
+	}
+
+	return nil
+}
+
+// notify wakes up waiters. The mutex must be held.
+func (k *Kubelet) notify() {
+	close(k.changed)
+	k.changed = make(chan struct{})
+}
+
+// Register implements pluginapi.RegistrationServer. It records the request,
+// connects to the plugin endpoint and opens a ListAndWatch stream.
+func (k *Kubelet) Register(ctx context.Context, req *pluginapi.RegisterRequest) (*pluginapi.Empty, error) {
+	k.mutex.Lock()
+	k.registrations = append(k.registrations, req)
+	k.notify()
+	k.mutex.Unlock()
+
+	if req.Version != pluginapi.Version {
+		return nil, errors.Errorf("Unsupported device plugin API version %s", req.Version)
+	}
+
+	socket := filepath.Join(k.dir, req.Endpoint)
+
+	conn, err := grpc.DialContext(ctx, socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cannot connect to %s", socket)
+	}
+
+	streamCtx, cancel := context.WithCancel(context.Background())
+	p := &plugin{
+		request: req,
+		conn:    conn,
+		client:  pluginapi.NewDevicePluginClient(conn),
+		cancel:  cancel,
+	}
+
+	stream, err := p.client.ListAndWatch(streamCtx, &pluginapi.Empty{})
+	if err != nil {
+		p.close()
+		return nil, errors.Wrapf(err, "ListAndWatch failed for %s", req.ResourceName)
+	}
+
+	k.mutex.Lock()
+	if old, ok := k.plugins[req.ResourceName]; ok {
+		old.close()
+	}
+
+	p.streaming = true
+	k.plugins[req.ResourceName] = p
+	k.notify()
+	k.mutex.Unlock()
+
+	go k.watch(p, stream)
+
+	return &pluginapi.Empty{}, nil
+}
+
+// watch stores the devices sent by the plugin until the stream ends.
+func (k *Kubelet) watch(p *plugin, stream pluginapi.DevicePlugin_ListAndWatchClient) {
+	for {
+		resp, err := stream.Recv()
+
+		k.mutex.Lock()
+
+		if err != nil {
+			klog.V(4).Infof("ListAndWatch stream of %s ended: %v", p.request.ResourceName, err)
+			p.streaming = false
+			k.notify()
+			k.mutex.Unlock()
+
+			return
+		}
+
+		p.devices = resp.Devices
+		k.notify()
+		k.mutex.Unlock()
+	}
+}
+
+// podResourcesLister serves the pod resources set by SetPodResources.
+type podResourcesLister struct {
+	podresourcesapi.UnimplementedPodResourcesListerServer
+	k *Kubelet
+}
+
+// List implements podresourcesapi.PodResourcesListerServer.
+func (l *podResourcesLister) List(ctx context.Context, req *podresourcesapi.ListPodResourcesRequest) (*podresourcesapi.ListPodResourcesResponse, error) {
+	l.k.mutex.Lock()
+	defer l.k.mutex.Unlock()
+
+	return &podresourcesapi.ListPodResourcesResponse{PodResources: l.k.podResources}, nil
+}
+
+// SetPodResources replaces the pod resources listed by the PodResources API.
+func (k *Kubelet) SetPodResources(pods ...*podresourcesapi.PodResources) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.podResources = pods
+}
+
+func (p *plugin) close() {
+	p.cancel()
+
+	if err := p.conn.Close(); err != nil {
+		klog.V(4).Infof("Failed to close connection to %s: %v", p.request.Endpoint, err)
+	}
+}
+
+// Registrations returns all registration requests received so far, including
+// the ones received before restarts.
+func (k *Kubelet) Registrations() []*pluginapi.RegisterRequest {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	return append([]*pluginapi.RegisterRequest{}, k.registrations...)
+}
+
+// Devices returns the devices last sent by the plugin of the resource.
+func (k *Kubelet) Devices(resourceName string) []*pluginapi.Device {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if p, ok := k.plugins[resourceName]; ok {
+		return p.devices
+	}
+
+	return nil
+}
+
+// Resources returns the names of the connected resources.
+func (k *Kubelet) Resources() []string {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	names := []string{}
+	for name := range k.plugins {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// wait blocks until cond returns true or ctx is done. cond is called with the
+// mutex held.
+func (k *Kubelet) wait(ctx context.Context, cond func() bool) error {
+	for {
+		k.mutex.Lock()
+		ok := cond()
+		changed := k.changed
+		k.mutex.Unlock()
+
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WaitForRegistrations waits until at least n registration requests for the
+// resource have been received.
+func (k *Kubelet) WaitForRegistrations(ctx context.Context, resourceName string, n int) error {
+	err := k.wait(ctx, func() bool {
+		count := 0
+
+		for _, req := range k.registrations {
+			if req.ResourceName == resourceName {
+				count++
+			}
+		}
+
+		return count >= n
+	})
+
+	return errors.Wrapf(err, "Waiting for %d registrations of %s", n, resourceName)
+}
+
+// WaitForDevices waits until the devices of the resource satisfy cond and
+// returns them.
+func (k *Kubelet) WaitForDevices(ctx context.Context, resourceName string, cond func([]*pluginapi.Device) bool) ([]*pluginapi.Device, error) {
+	var devices []*pluginapi.Device
+
+	err := k.wait(ctx, func() bool {
+		p, ok := k.plugins[resourceName]
+		if !ok || !p.streaming {
+			return false
+		}
+
+		devices = p.devices
+
+		return cond(devices)
+	})
+
+	return devices, errors.Wrapf(err, "Waiting for devices of %s", resourceName)
+}
+
+// WaitForDisconnect waits until the ListAndWatch stream of the resource is closed.
+func (k *Kubelet) WaitForDisconnect(ctx context.Context, resourceName string) error {
+	err := k.wait(ctx, func() bool {
+		p, ok := k.plugins[resourceName]
+		return !ok || !p.streaming
+	})
+
+	return errors.Wrapf(err, "Waiting for %s to disconnect", resourceName)
+}
+
+func (k *Kubelet) client(resourceName string) (pluginapi.DevicePluginClient, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	p, ok := k.plugins[resourceName]
+	if !ok {
+		return nil, errors.Errorf("Resource %s is not registered", resourceName)
+	}
+
+	return p.client, nil
+}
+
+// Options returns the device plugin options of the resource.
+func (k *Kubelet) Options(ctx context.Context, resourceName string) (*pluginapi.DevicePluginOptions, error) {
+	client, err := k.client(resourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.GetDevicePluginOptions(ctx, &pluginapi.Empty{})
+}
+
+// Allocate allocates the devices of the resource, one device ID list per container.
+func (k *Kubelet) Allocate(ctx context.Context, resourceName string, containerDeviceIDs ...[]string) (*pluginapi.AllocateResponse, error) {
+	client, err := k.client(resourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &pluginapi.AllocateRequest{}
+	for _, ids := range containerDeviceIDs {
+		req.ContainerRequests = append(req.ContainerRequests, &pluginapi.ContainerAllocateRequest{DevicesIDs: ids})
+	}
+
+	return client.Allocate(ctx, req)
+}
+
+// GetPreferredAllocation asks the plugin which size devices of the available
+// ones it prefers for a single container.
+func (k *Kubelet) GetPreferredAllocation(ctx context.Context, resourceName string, available, mustInclude []string, size int) (*pluginapi.PreferredAllocationResponse, error) {
+	client, err := k.client(resourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.GetPreferredAllocation(ctx, &pluginapi.PreferredAllocationRequest{
+		ContainerRequests: []*pluginapi.ContainerPreferredAllocationRequest{
+			{
+				AvailableDeviceIDs:   available,
+				MustIncludeDeviceIDs: mustInclude,
+				AllocationSize:       int32(size),
+			},
+		},
+	})
+}
+
+// PreStartContainer calls PreStartContainer of the plugin with the devices.
+func (k *Kubelet) PreStartContainer(ctx context.Context, resourceName string, deviceIDs []string) (*pluginapi.PreStartContainerResponse, error) {
+	client, err := k.client(resourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.PreStartContainer(ctx, &pluginapi.PreStartContainerRequest{DevicesIDs: deviceIDs})
+}
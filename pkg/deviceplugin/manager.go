@@ -1,11 +1,17 @@
 package deviceplugin
 
 import (
-	"os"
+	"context"
+	"os/signal"
 	"reflect"
+	"sync"
+	"syscall"
 
+	"github.com/pkg/errors"
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/metrics"
 )
 
 type allocateFunc func(*pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error)
@@ -22,12 +28,14 @@ type updateInfo struct {
 
 // notifier implements Notifier interface.
 type notifier struct {
+	ctx        context.Context
 	deviceTree DeviceTree
 	updatesCh  chan<- updateInfo
 }
 
-func newNotifier(updatesCh chan<- updateInfo) *notifier {
+func newNotifier(ctx context.Context, updatesCh chan<- updateInfo) *notifier {
 	return &notifier{
+		ctx:       ctx,
 		updatesCh: updatesCh,
 	}
 }
@@ -49,10 +57,14 @@ func (n *notifier) Notify(newDeviceTree DeviceTree) {
 	}
 
 	if len(added) > 0 || len(updated) > 0 || len(n.deviceTree) > 0 {
-		n.updatesCh <- updateInfo{
+		select {
+		case n.updatesCh <- updateInfo{
 			Added:   added,
 			Updated: updated,
 			Removed: n.deviceTree,
+		}:
+		case <-n.ctx.Done():
+			// Manager is shutting down, nobody reads updates anymore.
 		}
 	}
 
@@ -62,89 +74,258 @@ func (n *notifier) Notify(newDeviceTree DeviceTree) {
 // Manager manages life cycle of device plugins and handles the scan results
 // received from them.
 type Manager struct {
-	devicePlugin Scanner
-	servers      map[string]devicePluginServer
-	createServer func(string, postAllocateFunc, preStartContainerFunc, getPreferredAllocationFunc, allocateFunc) devicePluginServer
-	namespace    string
+	devicePlugin  Scanner
+	servers       map[string]devicePluginServer
+	createServer  func(string, postAllocateFunc, preStartContainerFunc, getPreferredAllocationFunc, allocateFunc, string) devicePluginServer
+	namespace     string
+	kubeletSocket string
+	cdiSpecDir    string
+	errCh         chan error
+	serveWg       sync.WaitGroup
+
+	// mutex guards servers and devices against readers of the debug state.
+	mutex   sync.Mutex
+	devices DeviceTree
 }
 
 // NewManager creates a new instance of Manager.
 func NewManager(namespace string, devicePlugin Scanner) *Manager {
 	return &Manager{
-		devicePlugin: devicePlugin,
-		namespace:    namespace,
-		servers:      make(map[string]devicePluginServer),
-		createServer: newServer,
+		devicePlugin:  devicePlugin,
+		namespace:     namespace,
+		kubeletSocket: pluginapi.KubeletSocket,
+		servers:       make(map[string]devicePluginServer),
+		createServer:  newServer,
+		devices:       NewDeviceTree(),
 	}
 }
 
-// Run prepares and launches event loop for updates from Scanner.
-func (m *Manager) Run() {
+// SetKubeletSocket overrides the path to the kubelet registration socket.
+// Plugin sockets are created in the same directory.
+func (m *Manager) SetKubeletSocket(kubeletSocket string) {
+	m.kubeletSocket = kubeletSocket
+}
+
+// EnableCDI makes the Manager write CDI specs of all devices to specDir and
+// return CDI device names instead of device nodes from Allocate().
+func (m *Manager) EnableCDI(specDir string) {
+	m.cdiSpecDir = specDir
+}
+
+// Run prepares and launches event loop for updates from Scanner. It returns
+// when ctx is cancelled, SIGTERM or SIGINT is received, or scanning or
+// serving fails. All servers are stopped and their sockets removed before
+// it returns.
+func (m *Manager) Run(ctx context.Context) error {
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
 	updatesCh := make(chan updateInfo)
+	m.errCh = make(chan error, 1)
 
 	go func() {
-		err := m.devicePlugin.Scan(newNotifier(updatesCh))
+		err := m.devicePlugin.Scan(ctx, newNotifier(ctx, updatesCh))
 		if err != nil {
-			klog.Errorf("Device scan failed: %+v", err)
-			os.Exit(1)
+			m.fail(errors.Wrap(err, "Device scan failed"))
+			return
 		}
 
 		close(updatesCh)
 	}()
 
-	for update := range updatesCh {
-		m.handleUpdate(update)
+	var err error
+
+loop:
+	for {
+		select {
+		case update, ok := <-updatesCh:
+			if !ok {
+				break loop
+			}
+
+			m.handleUpdate(update)
+		case err = <-m.errCh:
+			break loop
+		case <-ctx.Done():
+			klog.V(1).Info("Shutting down device plugin servers")
+
+			err = ctx.Err()
+
+			break loop
+		}
+	}
+
+	m.stopServers()
+
+	return err
+}
+
+// fail reports the first fatal error to Run.
+func (m *Manager) fail(err error) {
+	select {
+	case m.errCh <- err:
+	default:
 	}
 }
 
+func (m *Manager) stopServers() {
+	for devType, srv := range m.servers {
+		if err := srv.Stop(); err != nil {
+			klog.Errorf("Unable to stop gRPC server for %q: %+v", devType, err)
+		}
+
+		m.mutex.Lock()
+		delete(m.servers, devType)
+		delete(m.devices, devType)
+		m.mutex.Unlock()
+	}
+
+	m.serveWg.Wait()
+}
+
 func (m *Manager) handleUpdate(update updateInfo) {
 	klog.V(4).Info("Received dev updates:", update)
 
 	for devType, devices := range update.Added {
-		var (
-			allocate               allocateFunc
-			postAllocate           postAllocateFunc
-			preStartContainer      preStartContainerFunc
-			getPreferredAllocation getPreferredAllocationFunc
-		)
-
-		if postAllocator, ok := m.devicePlugin.(PostAllocator); ok {
-			postAllocate = postAllocator.PostAllocate
-		}
+		m.addServer(devType, devices)
+	}
 
-		if containerPreStarter, ok := m.devicePlugin.(ContainerPreStarter); ok {
-			preStartContainer = containerPreStarter.PreStartContainer
+	for devType, devices := range update.Updated {
+		srv, ok := m.servers[devType]
+		if !ok {
+			// The CDI spec couldn't be written before, try again.
+			m.addServer(devType, devices)
+			continue
 		}
 
-		if preferredAllocator, ok := m.devicePlugin.(PreferredAllocator); ok {
-			getPreferredAllocation = preferredAllocator.GetPreferredAllocation
-		}
+		if err := m.writeCDISpec(devType, devices); err != nil {
+			klog.Errorf("Stop advertising %q: unable to write CDI spec: %+v", devType, err)
+			m.removeServer(devType)
 
-		if allocator, ok := m.devicePlugin.(Allocator); ok {
-			allocate = allocator.Allocate
+			continue
 		}
 
-		m.servers[devType] = m.createServer(devType, postAllocate, preStartContainer, getPreferredAllocation, allocate)
+		m.mutex.Lock()
+		m.devices[devType] = devices
+		m.mutex.Unlock()
 
-		go func(dt string) {
-			err := m.servers[dt].Serve(m.namespace)
-			if err != nil {
-				klog.Errorf("Failed to serve %s/%s: %+v", m.namespace, dt, err)
-				os.Exit(1)
-			}
-		}(devType)
-		m.servers[devType].Update(devices)
+		srv.Update(devices)
+		setDeviceMetrics(devType, devices)
 	}
 
-	for devType, devices := range update.Updated {
-		m.servers[devType].Update(devices)
+	for devType := range update.Removed {
+		m.removeServer(devType)
 	}
+}
 
-	for devType := range update.Removed {
-		if err := m.servers[devType].Stop(); err != nil {
+// addServer starts advertising the devices of the type. Resources whose CDI
+// spec can't be written aren't advertised until their devices change.
+func (m *Manager) addServer(devType string, devices map[string]DeviceInfo) {
+	var (
+		allocate               allocateFunc
+		postAllocate           postAllocateFunc
+		preStartContainer      preStartContainerFunc
+		getPreferredAllocation getPreferredAllocationFunc
+	)
+
+	if postAllocator, ok := m.devicePlugin.(PostAllocator); ok {
+		postAllocate = postAllocator.PostAllocate
+	}
+
+	if containerPreStarter, ok := m.devicePlugin.(ContainerPreStarter); ok {
+		preStartContainer = containerPreStarter.PreStartContainer
+	}
+
+	if preferredAllocator, ok := m.devicePlugin.(PreferredAllocator); ok {
+		getPreferredAllocation = preferredAllocator.GetPreferredAllocation
+	}
+
+	if allocator, ok := m.devicePlugin.(Allocator); ok {
+		allocate = allocator.Allocate
+	}
+
+	if err := m.writeCDISpec(devType, devices); err != nil {
+		klog.Errorf("Not advertising %q: unable to write CDI spec: %+v", devType, err)
+		return
+	}
+
+	cdiKindName := ""
+	if m.cdiSpecDir != "" {
+		cdiKindName = cdiKind(m.namespace, devType)
+	}
+
+	srv := m.createServer(devType, postAllocate, preStartContainer, getPreferredAllocation, allocate, cdiKindName)
+
+	m.mutex.Lock()
+	m.servers[devType] = srv
+	m.devices[devType] = devices
+	m.mutex.Unlock()
+
+	m.serveWg.Add(1)
+
+	go func() {
+		defer m.serveWg.Done()
+
+		err := srv.Serve(m.namespace, m.kubeletSocket)
+		if err != nil {
+			m.fail(errors.Wrapf(err, "Failed to serve %s/%s", m.namespace, devType))
+		}
+	}()
+	srv.Update(devices)
+	setDeviceMetrics(devType, devices)
+}
+
+// removeServer stops advertising the devices of the type.
+func (m *Manager) removeServer(devType string) {
+	metrics.Devices.DeletePartialMatch(map[string]string{"resource": devType})
+
+	if srv, ok := m.servers[devType]; ok {
+		if err := srv.Stop(); err != nil {
 			klog.Errorf("Unable to stop gRPC server for %q: %+v", devType, err)
 		}
+	}
 
-		delete(m.servers, devType)
+	m.removeCDISpec(devType)
+
+	m.mutex.Lock()
+	delete(m.servers, devType)
+	delete(m.devices, devType)
+	m.mutex.Unlock()
+}
+
+// writeCDISpec updates the CDI spec of the device type if CDI is enabled.
+// It's written before the devices are advertised so that allocated devices
+// are always resolvable.
+func (m *Manager) writeCDISpec(devType string, devices map[string]DeviceInfo) error {
+	if m.cdiSpecDir == "" {
+		return nil
+	}
+
+	return writeCDISpec(m.cdiSpecDir, m.namespace, devType, devices)
+}
+
+func (m *Manager) removeCDISpec(devType string) {
+	if m.cdiSpecDir == "" {
+		return
+	}
+
+	if err := removeCDISpec(m.cdiSpecDir, m.namespace, devType); err != nil {
+		klog.Errorf("Unable to remove CDI spec for %q: %+v", devType, err)
+	}
+}
+
+// setDeviceMetrics exports the number of devices of the type by health.
+func setDeviceMetrics(devType string, devices map[string]DeviceInfo) {
+	counts := map[string]int{
+		pluginapi.Healthy:   0,
+		pluginapi.Unhealthy: 0,
+	}
+
+	for _, device := range devices {
+		counts[device.state]++
+	}
+
+	for health, count := range counts {
+		metrics.Devices.WithLabelValues(devType, health).Set(float64(count))
 	}
 }
@@ -0,0 +1,125 @@
+package deviceplugin
+
+import (
+	"context"
+	"testing"
+
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+)
+
+func testManagerTree(health string) DeviceTree {
+	tree := NewDeviceTree()
+
+	for _, id := range []string{"SSL_0", "SSL_1"} {
+		tree.AddDevice("cy2_dc0", id, NewDeviceInfoWithTopologyHints(health,
+			[]pluginapi.DeviceSpec{{HostPath: "/dev/qat_adf_ctl", ContainerPath: "/dev/qat_adf_ctl", Permissions: "rw"}},
+			nil,
+			map[string]string{"QAT_SECTION_NAME": "SSL"},
+			nil, nil))
+	}
+
+	return tree
+}
+
+func allInState(state string, n int) func([]*pluginapi.Device) bool {
+	return func(devices []*pluginapi.Device) bool {
+		if len(devices) != n {
+			return false
+		}
+
+		for _, dev := range devices {
+			if dev.Health != state {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+func TestManager(t *testing.T) {
+	kubelet := newTestKubelet(t)
+	scanner := newTreeScanner()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	manager := NewManager(testNamespace, scanner)
+	manager.SetKubeletSocket(kubelet.Socket())
+
+	runCtx, stop := context.WithCancel(ctx)
+	runErr := make(chan error, 1)
+
+	go func() {
+		runErr <- manager.Run(runCtx)
+	}()
+
+	resourceName := testNamespace + "/cy2_dc0"
+
+	scanner.trees <- testManagerTree(pluginapi.Healthy)
+
+	if err := kubelet.WaitForRegistrations(ctx, resourceName, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kubelet.WaitForDevices(ctx, resourceName, allInState(pluginapi.Healthy, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := kubelet.Allocate(ctx, resourceName, []string{"SSL_0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cresp := resp.ContainerResponses[0]
+	if len(cresp.Devices) != 1 || cresp.Devices[0].HostPath != "/dev/qat_adf_ctl" || cresp.Envs["QAT_SECTION_NAME"] != "SSL" {
+		t.Errorf("unexpected allocate response %+v", cresp)
+	}
+
+	// ListAndWatch sends updated devices.
+	scanner.trees <- testManagerTree(pluginapi.Unhealthy)
+
+	if _, err := kubelet.WaitForDevices(ctx, resourceName, allInState(pluginapi.Unhealthy, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kubelet.Allocate(ctx, resourceName, []string{"SSL_0"}); err == nil {
+		t.Error("unhealthy device allocated")
+	}
+
+	// The plugin registers again after kubelet restarts.
+	if err := kubelet.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kubelet.WaitForRegistrations(ctx, resourceName, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kubelet.WaitForDevices(ctx, resourceName, allInState(pluginapi.Unhealthy, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner.trees <- testManagerTree(pluginapi.Healthy)
+
+	if _, err := kubelet.WaitForDevices(ctx, resourceName, allInState(pluginapi.Healthy, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kubelet.Allocate(ctx, resourceName, []string{"SSL_1"}); err != nil {
+		t.Errorf("allocate after restart failed: %+v", err)
+	}
+
+	// Removed resources are disconnected.
+	scanner.trees <- NewDeviceTree()
+
+	if err := kubelet.WaitForDisconnect(ctx, resourceName); err != nil {
+		t.Fatal(err)
+	}
+
+	stop()
+
+	if err := <-runErr; err != context.Canceled {
+		t.Errorf("Run() failed: %+v", err)
+	}
+}
@@ -1,7 +1,6 @@
 package deviceplugin
 
 import (
-	"fmt"
 	"context"
 	"net"
 	"os"
@@ -9,8 +8,6 @@ import (
 	"path/filepath"
 	"sync"
 	"time"
-	"strings"
-	"strconv"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
@@ -19,6 +16,8 @@ import (
 
 	"k8s.io/klog/v2"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/metrics"
 )
 
 type serverState int
@@ -34,34 +33,44 @@ const (
 // pluginapi.PluginInterfaceServer interfaces.
 // This internal unexposed interface simplifies unit testing.
 type devicePluginServer interface {
-	Serve(namespace string) error
+	Serve(namespace, kubeletSocket string) error
 	Stop() error
 	Update(devices map[string]DeviceInfo)
+	debugState() ServerState
 }
 
 // server implements devicePluginServer and pluginapi.PluginInterfaceServer interfaces.
 type server struct {
 	grpcServer             *grpc.Server
 	updatesCh              chan map[string]DeviceInfo
+	stopCh                 chan struct{}
 	devices                map[string]DeviceInfo
 	allocate               allocateFunc
 	postAllocate           postAllocateFunc
 	preStartContainer      preStartContainerFunc
 	getPreferredAllocation getPreferredAllocationFunc
 	devType                string
+	cdiKind                string
+	socket                 string
 	state                  serverState
+	registeredAt           time.Time
+	registrations          int
 	stateMutex             sync.Mutex
 }
 
 // newServer creates a new server satisfying the devicePluginServer interface.
+// If cdiKind is set, allocated devices are returned as CDI devices of that kind.
 func newServer(devType string,
 	postAllocate postAllocateFunc,
 	preStartContainer preStartContainerFunc,
 	getPreferredAllocation getPreferredAllocationFunc,
-	allocate allocateFunc) devicePluginServer {
+	allocate allocateFunc,
+	cdiKind string) devicePluginServer {
 	return &server{
 		devType:                devType,
+		cdiKind:                cdiKind,
 		updatesCh:              make(chan map[string]DeviceInfo, 1), // TODO: is 1 needed?
+		stopCh:                 make(chan struct{}),
 		devices:                make(map[string]DeviceInfo),
 		allocate:               allocate,
 		postAllocate:           postAllocate,
@@ -95,7 +104,6 @@ func (srv *server) sendDevices(stream pluginapi.DevicePlugin_ListAndWatchServer)
 	klog.V(4).Info("Sending to kubelet", resp.Devices)
 
 	if err := stream.Send(resp); err != nil {
-		_ = srv.Stop()
 		return errors.Wrapf(err, "Cannot update device list")
 	}
 
@@ -105,24 +113,41 @@ func (srv *server) sendDevices(stream pluginapi.DevicePlugin_ListAndWatchServer)
 func (srv *server) ListAndWatch(empty *pluginapi.Empty, stream pluginapi.DevicePlugin_ListAndWatchServer) error {
 	klog.V(4).Info("Started ListAndWatch for", srv.devType)
 
+	streams := metrics.ListAndWatchStreams.WithLabelValues(srv.devType)
+	streams.Inc()
+	defer streams.Dec()
+
 	if err := srv.sendDevices(stream); err != nil {
 		return err
 	}
 
-	for srv.devices = range srv.updatesCh {
-		if err := srv.sendDevices(stream); err != nil {
-			return err
+	for {
+		select {
+		case srv.devices = <-srv.updatesCh:
+			if err := srv.sendDevices(stream); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			// Kubelet restarted, the next stream takes over the updates.
+			return nil
+		case <-srv.stopCh:
+			return nil
 		}
 	}
-
-	return nil
 }
 
-func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest) (*pluginapi.AllocateResponse, error) {
-	fmt.Printf("********** [server.go] Allocate func start! *********\n")
-	fmt.Printf("~~~~~~~~~ rqt = %+v\n", rqt)
+func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest) (resp *pluginapi.AllocateResponse, err error) {
+	klog.V(4).Infof("Allocate request for %s: %+v", srv.devType, rqt)
+
+	metrics.AllocateRequests.WithLabelValues(srv.devType).Inc()
+
+	defer func() {
+		if err != nil {
+			metrics.AllocateFailures.WithLabelValues(srv.devType).Inc()
+		}
+	}()
+
 	if srv.allocate != nil {
-		fmt.Printf("###### srv.allocate if condition \n")
 		response, err := srv.allocate(rqt)
 
 		if _, ok := err.(*UseDefaultMethodError); !ok {
@@ -139,6 +164,7 @@ func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest)
 		cresp.Annotations = map[string]string{}
 
 		uioID := 0
+		hostPaths := map[string]bool{}
 
 		for _, id := range crqt.DevicesIDs {
 			dev, ok := srv.devices[id]
@@ -149,33 +175,53 @@ func (srv *server) Allocate(ctx context.Context, rqt *pluginapi.AllocateRequest)
 			if dev.state != pluginapi.Healthy {
 				return nil, errors.Errorf("Invalid allocation request with unhealthy device %s", id)
 			}
-			
-			fmt.Printf("###### [server.go] dev  = %+v", dev)
+
+			for key, value := range dev.annotations {
+				cresp.Annotations[key] = value
+			}
+
+			// The CDI spec has the device nodes and mounts. UIO nodes and env
+			// variables depend on the other allocated devices, they are
+			// returned here to be renumbered like without CDI.
+			if srv.cdiKind != "" {
+				cresp.CDIDevices = append(cresp.CDIDevices, &pluginapi.CDIDevice{
+					Name: srv.cdiKind + "=" + id,
+				})
+			}
 
 			for i := range dev.nodes {
+				if srv.cdiKind != "" && !isUIONode(dev.nodes[i]) {
+					continue
+				}
+
+				// Devices may share nodes, e.g. the control nodes of the driver.
+				if hostPaths[dev.nodes[i].HostPath] {
+					continue
+				}
+
+				hostPaths[dev.nodes[i].HostPath] = true
+
 				node := new(pluginapi.DeviceSpec)
 				node.ContainerPath = dev.nodes[i].ContainerPath
 				node.HostPath = dev.nodes[i].HostPath
 				node.Permissions = dev.nodes[i].Permissions
-				if strings.HasPrefix(dev.nodes[i].HostPath, "/dev/uio") {
-					node.ContainerPath = "/dev/uio" + strconv.Itoa(uioID)
+				if isUIONode(dev.nodes[i]) {
+					node.ContainerPath = uioContainerPath(uioID)
 					uioID++
 				}
 				//cresp.Devices = append(cresp.Devices, &dev.nodes[i])
 				cresp.Devices = append(cresp.Devices, node)
 			}
 
-			for i := range dev.mounts {
-				cresp.Mounts = append(cresp.Mounts, &dev.mounts[i])
+			if srv.cdiKind == "" {
+				for i := range dev.mounts {
+					cresp.Mounts = append(cresp.Mounts, &dev.mounts[i])
+				}
 			}
 
 			for key, value := range dev.envs {
 				cresp.Envs[key] = value
 			}
-
-			for key, value := range dev.annotations {
-				cresp.Annotations[key] = value
-			}
 		}
 
 		response.ContainerResponses = append(response.ContainerResponses, cresp)
@@ -208,32 +254,63 @@ func (srv *server) GetPreferredAllocation(ctx context.Context, rqt *pluginapi.Pr
 }
 
 // Serve starts a gRPC server to serve pluginapi.PluginInterfaceServer interface.
-func (srv *server) Serve(namespace string) error {
-	return srv.setupAndServe(namespace, pluginapi.DevicePluginPath, pluginapi.KubeletSocket)
+// The plugin socket is created in the directory of kubeletSocket.
+func (srv *server) Serve(namespace, kubeletSocket string) error {
+	return srv.setupAndServe(namespace, filepath.Dir(kubeletSocket), kubeletSocket)
 }
 
-// Stop stops serving pluginapi.PluginInterfaceServer interface.
+// Stop stops serving pluginapi.PluginInterfaceServer interface and removes the plugin socket.
+// A pending or running Serve() returns once the server is stopped.
 func (srv *server) Stop() error {
-	if srv.grpcServer == nil {
-		return errors.New("Can't stop non-existing gRPC server. Calling Stop() before Serve()?")
+	srv.stateMutex.Lock()
+
+	if srv.state == terminating {
+		srv.stateMutex.Unlock()
+		return nil
+	}
+
+	srv.state = terminating
+	close(srv.stopCh)
+
+	grpcServer := srv.grpcServer
+	socket := srv.socket
+	srv.stateMutex.Unlock()
+
+	if grpcServer == nil {
+		return nil
 	}
 
-	srv.setState(terminating)
-	srv.grpcServer.Stop()
-	close(srv.updatesCh)
+	grpcServer.Stop()
+
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to remove %s", socket)
+	}
 
 	return nil
 }
 
 // Update sends updates from Manager to ListAndWatch's event loop.
+// Updates of a stopped server are dropped.
 func (srv *server) Update(devices map[string]DeviceInfo) {
-	srv.updatesCh <- devices
+	select {
+	case srv.updatesCh <- devices:
+	case <-srv.stopCh:
+	}
 }
 
-func (srv *server) setState(state serverState) {
+// setState changes the state unless the server is terminating and reports
+// whether it did.
+func (srv *server) setState(state serverState) bool {
 	srv.stateMutex.Lock()
 	defer srv.stateMutex.Unlock()
+
+	if srv.state == terminating {
+		return false
+	}
+
 	srv.state = state
+
+	return true
 }
 
 func (srv *server) getState() serverState {
@@ -247,13 +324,20 @@ func (srv *server) getState() serverState {
 func (srv *server) setupAndServe(namespace string, devicePluginPath string, kubeletSocket string) error {
 	resourceName := namespace + "/" + srv.devType
 	pluginPrefix := namespace + "-" + srv.devType
-	srv.setState(serving)
+
+	if !srv.setState(serving) {
+		return nil
+	}
 
 	for srv.getState() == serving {
 		pluginEndpoint := pluginPrefix + ".sock"
 		pluginSocket := path.Join(devicePluginPath, pluginEndpoint)
 
-		if err := waitForServer(pluginSocket, time.Second); err == nil {
+		srv.stateMutex.Lock()
+		srv.socket = pluginSocket
+		srv.stateMutex.Unlock()
+
+		if err := waitForServer(pluginSocket, time.Second, srv.stopCh); err == nil {
 			return errors.Errorf("Socket %s is already in use", pluginSocket)
 		}
 		// We don't care if the plugin's socket file doesn't exist.
@@ -264,39 +348,65 @@ func (srv *server) setupAndServe(namespace string, devicePluginPath string, kube
 			return errors.Wrap(err, "Failed to listen to plugin socket")
 		}
 
-		srv.grpcServer = grpc.NewServer()
-		pluginapi.RegisterDevicePluginServer(srv.grpcServer, srv)
+		// Stop() stops the server created here or, if it ran first, no server is created.
+		srv.stateMutex.Lock()
+		if srv.state == terminating {
+			srv.stateMutex.Unlock()
+			_ = lis.Close()
+
+			return nil
+		}
+
+		grpcServer := grpc.NewServer()
+		srv.grpcServer = grpcServer
+		srv.stateMutex.Unlock()
+
+		pluginapi.RegisterDevicePluginServer(grpcServer, srv)
 
 		// Starts device plugin service.
 		go func() {
 			klog.V(1).Infof("Start server for %s at: %s", srv.devType, pluginSocket)
 
-			if serveErr := srv.grpcServer.Serve(lis); serveErr != nil {
+			if serveErr := grpcServer.Serve(lis); serveErr != nil {
 				klog.Errorf("unable to start gRPC server: %+v", serveErr)
 			}
 		}()
 
 		// Wait for the server to start
-		if err = waitForServer(pluginSocket, 10*time.Second); err != nil {
+		if err = waitForServer(pluginSocket, 10*time.Second, srv.stopCh); err != nil {
+			if srv.getState() == terminating {
+				return nil
+			}
+
 			return err
 		}
 
 		// Register with Kubelet.
 		err = srv.registerWithKubelet(kubeletSocket, pluginEndpoint, resourceName)
 		if err != nil {
+			if srv.getState() == terminating {
+				return nil
+			}
+
 			return err
 		}
 
+		srv.stateMutex.Lock()
+		srv.registeredAt = time.Now()
+		srv.registrations++
+		srv.stateMutex.Unlock()
+
 		klog.V(1).Infof("Device plugin for %s registered", srv.devType)
 
 		// Kubelet removes plugin socket when it (re)starts
 		// plugin must restart in this case
-		if err = watchFile(pluginSocket); err != nil {
+		if err = watchFile(pluginSocket, srv.stopCh); err != nil {
 			return err
 		}
 
 		if srv.getState() == serving {
-			srv.grpcServer.Stop()
+			grpcServer.Stop()
+			metrics.KubeletReregistrations.WithLabelValues(srv.devType).Inc()
 			klog.V(1).Infof("Socket %s removed, restarting", pluginSocket)
 		} else {
 			klog.V(1).Infof("Socket %s shut down", pluginSocket)
@@ -306,7 +416,8 @@ func (srv *server) setupAndServe(namespace string, devicePluginPath string, kube
 	return nil
 }
 
-func watchFile(file string) error {
+// watchFile returns when the file is removed or stop is closed.
+func watchFile(file string, stop <-chan struct{}) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return errors.Wrapf(err, "Failed to create watcher for %s", file)
@@ -326,6 +437,8 @@ func watchFile(file string) error {
 			}
 		case err := <-watcher.Errors:
 			return errors.WithStack(err)
+		case <-stop:
+			return nil
 		}
 	}
 }
@@ -362,11 +475,20 @@ func (srv *server) registerWithKubelet(kubeletSocket, pluginEndPoint, resourceNa
 
 // waitForServer checks if grpc server is alive
 // by making grpc blocking connection to the server socket.
-func waitForServer(socket string, timeout time.Duration) error {
+// It gives up early when stop is closed.
+func waitForServer(socket string, timeout time.Duration, stop <-chan struct{}) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 
 	defer cancel()
 
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	conn, err := grpc.DialContext(ctx, socket,
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithBlock(),
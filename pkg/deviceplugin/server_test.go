@@ -0,0 +1,185 @@
+package deviceplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/deviceplugin/fakekubelet"
+	"github.com/shuoyanshen/qat_plugin/pkg/metrics"
+)
+
+const (
+	testNamespace = "qat.intel.com"
+	testTimeout   = 10 * time.Second
+)
+
+func testDevices() map[string]DeviceInfo {
+	return map[string]DeviceInfo{
+		"SSL_0": NewDeviceInfoWithTopologyHints(pluginapi.Healthy, nil, nil, nil, nil, nil),
+	}
+}
+
+func newTestKubelet(t *testing.T) *fakekubelet.Kubelet {
+	t.Helper()
+
+	kubelet, err := fakekubelet.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(kubelet.Stop)
+
+	return kubelet
+}
+
+func serveInBackground(srv devicePluginServer, kubeletSocket string) <-chan error {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- srv.Serve(testNamespace, kubeletSocket)
+	}()
+
+	return done
+}
+
+func waitForServe(t *testing.T, done <-chan error) {
+	t.Helper()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve() failed: %+v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Serve() didn't return after Stop()")
+	}
+}
+
+func TestStopDuringServe(t *testing.T) {
+	tcases := []struct {
+		name  string
+		delay time.Duration
+	}{
+		{name: "immediately"},
+		{name: "while starting", delay: time.Millisecond},
+		{name: "while registering", delay: 20 * time.Millisecond},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			kubelet := newTestKubelet(t)
+			srv := newServer("cy2_dc0", nil, nil, nil, nil, "")
+			srv.Update(testDevices())
+
+			done := serveInBackground(srv, kubelet.Socket())
+
+			time.Sleep(tc.delay)
+
+			if err := srv.Stop(); err != nil {
+				t.Errorf("Stop() failed: %+v", err)
+			}
+
+			waitForServe(t, done)
+
+			// Updates of stopped servers are dropped.
+			srv.Update(testDevices())
+			srv.Update(testDevices())
+		})
+	}
+}
+
+func TestStopAfterRegistration(t *testing.T) {
+	kubelet := newTestKubelet(t)
+	srv := newServer("cy2_dc0", nil, nil, nil, nil, "")
+	srv.Update(testDevices())
+
+	done := serveInBackground(srv, kubelet.Socket())
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	resourceName := testNamespace + "/cy2_dc0"
+
+	if _, err := kubelet.WaitForDevices(ctx, resourceName, func(devices []*pluginapi.Device) bool { return len(devices) == 1 }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.Stop(); err != nil {
+		t.Errorf("Stop() failed: %+v", err)
+	}
+
+	waitForServe(t, done)
+
+	if err := kubelet.WaitForDisconnect(ctx, resourceName); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(kubelet.Dir(), testNamespace+"-cy2_dc0.sock")); !os.IsNotExist(err) {
+		t.Errorf("Plugin socket not removed: %v", err)
+	}
+
+	srv.Update(testDevices())
+
+	if err := srv.Stop(); err != nil {
+		t.Errorf("Second Stop() failed: %+v", err)
+	}
+}
+
+func TestStopBeforeServe(t *testing.T) {
+	kubelet := newTestKubelet(t)
+	srv := newServer("cy2_dc0", nil, nil, nil, nil, "")
+
+	if err := srv.Stop(); err != nil {
+		t.Errorf("Stop() failed: %+v", err)
+	}
+
+	waitForServe(t, serveInBackground(srv, kubelet.Socket()))
+
+	if registrations := kubelet.Registrations(); len(registrations) != 0 {
+		t.Errorf("Stopped server registered: %v", registrations)
+	}
+}
+
+func TestReregistration(t *testing.T) {
+	kubelet := newTestKubelet(t)
+	srv := newServer("cy2_dc0", nil, nil, nil, nil, "")
+	srv.Update(testDevices())
+
+	reregistrations := metrics.KubeletReregistrations.WithLabelValues("cy2_dc0")
+	before := testutil.ToFloat64(reregistrations)
+
+	done := serveInBackground(srv, kubelet.Socket())
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	resourceName := testNamespace + "/cy2_dc0"
+
+	if _, err := kubelet.WaitForDevices(ctx, resourceName, func(devices []*pluginapi.Device) bool { return len(devices) == 1 }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kubelet.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kubelet.WaitForRegistrations(ctx, resourceName, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := testutil.ToFloat64(reregistrations) - before; n != 1 {
+		t.Errorf("expected 1 re-registration, got %v", n)
+	}
+
+	if err := srv.Stop(); err != nil {
+		t.Errorf("Stop() failed: %+v", err)
+	}
+
+	waitForServe(t, done)
+}
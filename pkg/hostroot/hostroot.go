@@ -0,0 +1,50 @@
+// Package hostroot locates host filesystems in the mount namespace of the
+// plugin. The host sysfs and /dev may be mounted elsewhere, e.g. at /host/sys,
+// or be fake trees in tests, while device nodes handed to kubelet keep their
+// host paths.
+package hostroot
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Root holds the directories the host filesystems are mounted at.
+type Root struct {
+	// Sysfs is the directory the host /sys is mounted at.
+	Sysfs string
+	// Dev is the directory the host /dev is mounted at.
+	Dev string
+}
+
+// Default is the root of a plugin running in the host mount namespace or
+// with the host filesystems mounted at their usual places.
+var Default = Root{
+	Sysfs: "/sys",
+	Dev:   "/dev",
+}
+
+// New returns the root with the host filesystems mounted under dir,
+// e.g. /host gives /host/sys and /host/dev.
+func New(dir string) Root {
+	return Root{
+		Sysfs: filepath.Join(dir, "sys"),
+		Dev:   filepath.Join(dir, "dev"),
+	}
+}
+
+// Sys returns the path of the sysfs entry, e.g. Sys("class", "iommu").
+func (r Root) Sys(elem ...string) string {
+	return filepath.Join(append([]string{r.Sysfs}, elem...)...)
+}
+
+// DevPath returns where the host device node, e.g. /dev/uio0, can be
+// accessed. Paths outside of /dev are returned as is.
+func (r Root) DevPath(hostPath string) string {
+	rel, err := filepath.Rel("/dev", hostPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return hostPath
+	}
+
+	return filepath.Join(r.Dev, rel)
+}
@@ -0,0 +1,146 @@
+// Package metrics defines the Prometheus metrics of the device plugin and
+// serves them over HTTP.
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const namespace = "qat_plugin"
+
+var (
+	// Registry holds all metrics of the device plugin.
+	Registry = prometheus.NewRegistry()
+
+	// Devices is the number of advertised devices per resource and health.
+	Devices = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "devices",
+		Help:      "Number of devices advertised to kubelet.",
+	}, []string{"resource", "health"})
+
+	// AllocateRequests counts Allocate calls per resource.
+	AllocateRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "allocate_requests_total",
+		Help:      "Number of Allocate calls.",
+	}, []string{"resource"})
+
+	// AllocateFailures counts failed Allocate calls per resource.
+	AllocateFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "allocate_failures_total",
+		Help:      "Number of failed Allocate calls.",
+	}, []string{"resource"})
+
+	// ScanDuration observes the duration of device scans.
+	ScanDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "scan_duration_seconds",
+		Help:      "Duration of device scans.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+
+	// ScanErrors counts failed device scans.
+	ScanErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scan_errors_total",
+		Help:      "Number of failed device scans.",
+	})
+
+	// KubeletReregistrations counts registrations repeated after kubelet removed the plugin socket.
+	KubeletReregistrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kubelet_reregistrations_total",
+		Help:      "Number of re-registrations with kubelet after the plugin socket was removed.",
+	}, []string{"resource"})
+
+	// ListAndWatchStreams is the number of open ListAndWatch streams per resource.
+	ListAndWatchStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "list_and_watch_streams",
+		Help:      "Number of open ListAndWatch streams.",
+	}, []string{"resource"})
+
+	// Endpoints is 1 for the selection decision of each QAT endpoint and its reason.
+	Endpoints = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "endpoints",
+		Help:      "QAT endpoints found by the last scan with the decision to use them and its reason.",
+	}, []string{"bdf", "devtype", "decision", "reason"})
+
+	// Allocations is 1 for each device assigned to a container according to
+	// kubelet. The endpoint label lists the PCI addresses of the endpoints
+	// the device uses, separated by commas. Pods and containers aren't
+	// labeled to keep the number of series bounded by the number of devices.
+	Allocations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "allocations",
+		Help:      "Devices assigned to containers as reported by the kubelet PodResources API.",
+	}, []string{"resource", "device", "endpoint", "namespace"})
+
+	// PodResourcesErrors counts failed queries of the kubelet PodResources API.
+	PodResourcesErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pod_resources_errors_total",
+		Help:      "Number of failed kubelet PodResources API queries.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Devices,
+		AllocateRequests,
+		AllocateFailures,
+		ScanDuration,
+		ScanErrors,
+		KubeletReregistrations,
+		ListAndWatchStreams,
+		Endpoints,
+		Allocations,
+		PodResourcesErrors,
+	)
+}
+
+// Serve serves the metrics at /metrics on addr until ctx is cancelled.
+func Serve(ctx context.Context, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to listen to metrics address %s", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		if err := srv.Close(); err != nil {
+			klog.Warningf("Failed to close metrics server: %+v", err)
+		}
+	}()
+
+	klog.V(1).Infof("Serving metrics at %s", lis.Addr())
+
+	if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return errors.Wrap(err, "Failed to serve metrics")
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+// Package nfd writes feature files for the local source of Node Feature
+// Discovery, which turns the lines of the files into node labels.
+package nfd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FeatureDir is the directory NFD reads local feature files from.
+const FeatureDir = "/etc/kubernetes/node-feature-discovery/features.d"
+
+// maxLabelLength is the maximum length of a label name or value.
+const maxLabelLength = 63
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// LabelValue returns s sanitized to a valid label name or value: invalid
+// characters are replaced with dashes and the result is limited to 63
+// characters starting and ending with an alphanumeric character.
+func LabelValue(s string) string {
+	s = invalidLabelChars.ReplaceAllString(s, "-")
+
+	if len(s) > maxLabelLength {
+		s = s[:maxLabelLength]
+	}
+
+	return strings.Trim(s, "._-")
+}
+
+// Features maps label names to their values.
+type Features map[string]string
+
+// Equal returns true if both have the same labels.
+func (f Features) Equal(other Features) bool {
+	if len(f) != len(other) {
+		return false
+	}
+
+	for name, value := range f {
+		if v, ok := other[name]; !ok || v != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// WriteFeatureFile atomically replaces the feature file with the features
+// sorted by their names.
+func WriteFeatureFile(path string, features Features) error {
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var content strings.Builder
+
+	fmt.Fprintf(&content, "# Generated by the QAT device plugin, do not edit.\n")
+
+	for _, name := range names {
+		fmt.Fprintf(&content, "%s=%s\n", name, features[name])
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	if err := os.WriteFile(tmpPath, []byte(content.String()), 0644); err != nil {
+		return errors.Wrapf(err, "Failed to write %s", tmpPath)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return errors.Wrapf(err, "Failed to rename %s", tmpPath)
+	}
+
+	return nil
+}
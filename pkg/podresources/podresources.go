@@ -0,0 +1,202 @@
+// Package podresources tracks which containers hold the devices of the
+// plugin. Allocate only sees device IDs, so the assignments are read back
+// from the kubelet PodResources API.
+package podresources
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/klog/v2"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/metrics"
+)
+
+const (
+	// DefaultSocket is the PodResources API socket of kubelet.
+	DefaultSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+	// DefaultInterval is the default interval between PodResources queries.
+	DefaultInterval = 10 * time.Second
+
+	listTimeout = 10 * time.Second
+)
+
+// Allocation is a device of the plugin assigned to a container.
+type Allocation struct {
+	// Resource is the resource name without the namespace, e.g. cy2_dc0.
+	Resource  string `json:"resource"`
+	DeviceID  string `json:"deviceID"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	// Endpoints are the PCI addresses of the QAT endpoints the device uses
+	// as told by the resolver, empty if they are unknown.
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// Resolver returns the PCI addresses of the endpoints the device of the
+// resource uses or nil if they are unknown.
+type Resolver func(resource, deviceID string) []string
+
+// Tracker periodically lists the pod resources of the node and keeps the
+// allocations of the devices of the plugin.
+type Tracker struct {
+	client    podresourcesapi.PodResourcesListerClient
+	namespace string
+	interval  time.Duration
+	resolver  Resolver
+
+	mutex       sync.Mutex
+	allocations []Allocation
+	updated     time.Time
+}
+
+// Dial returns a client of the PodResources API served at socket. The
+// connection is established lazily.
+func Dial(socket string) (podresourcesapi.PodResourcesListerClient, error) {
+	conn, err := grpc.Dial(socket,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to %s", socket)
+	}
+
+	return podresourcesapi.NewPodResourcesListerClient(conn), nil
+}
+
+// NewTracker returns a tracker of the resources in namespace, e.g.
+// qat.intel.com, querying the client every interval.
+func NewTracker(client podresourcesapi.PodResourcesListerClient, namespace string, interval time.Duration) *Tracker {
+	return &Tracker{
+		client:    client,
+		namespace: namespace,
+		interval:  interval,
+	}
+}
+
+// SetResolver sets the resolver of the endpoints of the allocated devices.
+func (t *Tracker) SetResolver(resolver Resolver) {
+	t.resolver = resolver
+}
+
+// Run updates the allocations until ctx is cancelled. Failed queries are
+// logged and retried at the next interval.
+func (t *Tracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := t.Update(ctx); err != nil {
+			metrics.PodResourcesErrors.Inc()
+			klog.Warningf("Failed to update allocations: %+v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Update lists the pod resources once and replaces the allocations.
+func (t *Tracker) Update(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, listTimeout)
+	defer cancel()
+
+	// Wait for the connection to come back after kubelet restarts.
+	resp, err := t.client.List(ctx, &podresourcesapi.ListPodResourcesRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		return errors.Wrap(err, "Failed to list pod resources")
+	}
+
+	prefix := t.namespace + "/"
+	allocations := []Allocation{}
+
+	for _, pod := range resp.GetPodResources() {
+		for _, container := range pod.GetContainers() {
+			for _, devices := range container.GetDevices() {
+				if !strings.HasPrefix(devices.GetResourceName(), prefix) {
+					continue
+				}
+
+				resource := strings.TrimPrefix(devices.GetResourceName(), prefix)
+
+				for _, id := range devices.GetDeviceIds() {
+					allocation := Allocation{
+						Resource:  resource,
+						DeviceID:  id,
+						Namespace: pod.GetNamespace(),
+						Pod:       pod.GetName(),
+						Container: container.GetName(),
+					}
+
+					if t.resolver != nil {
+						allocation.Endpoints = t.resolver(resource, id)
+					}
+
+					allocations = append(allocations, allocation)
+				}
+			}
+		}
+	}
+
+	sort.Slice(allocations, func(i, j int) bool {
+		if allocations[i].Resource != allocations[j].Resource {
+			return allocations[i].Resource < allocations[j].Resource
+		}
+
+		return allocations[i].DeviceID < allocations[j].DeviceID
+	})
+
+	t.mutex.Lock()
+	t.allocations = allocations
+	t.updated = time.Now()
+	t.mutex.Unlock()
+
+	metrics.Allocations.Reset()
+
+	for _, a := range allocations {
+		metrics.Allocations.WithLabelValues(a.Resource, a.DeviceID, strings.Join(a.Endpoints, ","), a.Namespace).Set(1)
+	}
+
+	return nil
+}
+
+// Allocations returns the allocations of the last successful update and
+// the time of the update, zero if there was none.
+func (t *Tracker) Allocations() ([]Allocation, time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return append([]Allocation{}, t.allocations...), t.updated
+}
+
+// State is the allocations of the last successful update.
+type State struct {
+	Updated     *time.Time   `json:"updated,omitempty"`
+	Allocations []Allocation `json:"allocations"`
+}
+
+// DebugState returns the allocations of the last successful update.
+func (t *Tracker) DebugState() interface{} {
+	allocations, updated := t.Allocations()
+	state := State{Allocations: allocations}
+
+	if !updated.IsZero() {
+		state.Updated = &updated
+	}
+
+	return state
+}
@@ -0,0 +1,109 @@
+package podresources
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/deviceplugin/fakekubelet"
+	"github.com/shuoyanshen/qat_plugin/pkg/metrics"
+)
+
+const testNamespace = "qat.intel.com"
+
+func testPod(name string, containers ...*podresourcesapi.ContainerResources) *podresourcesapi.PodResources {
+	return &podresourcesapi.PodResources{Name: name, Namespace: "default", Containers: containers}
+}
+
+func testContainer(name, resourceName string, ids ...string) *podresourcesapi.ContainerResources {
+	return &podresourcesapi.ContainerResources{
+		Name: name,
+		Devices: []*podresourcesapi.ContainerDevices{
+			{ResourceName: resourceName, DeviceIds: ids},
+		},
+	}
+}
+
+func TestTracker(t *testing.T) {
+	kubelet, err := fakekubelet.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kubelet.Stop()
+
+	client, err := Dial(kubelet.PodResourcesSocket())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tracker := NewTracker(client, testNamespace, DefaultInterval)
+
+	if _, updated := tracker.Allocations(); !updated.IsZero() {
+		t.Errorf("allocations updated before the first update: %v", updated)
+	}
+
+	// The pinned slot PIN_1 uses one endpoint, the unpinned SSL_3 all
+	// endpoints of its section.
+	tracker.SetResolver(func(resource, deviceID string) []string {
+		return map[string][]string{
+			"cy1_dc1/PIN_1": {"0000:3d:00.0"},
+			"cy2_dc0/SSL_3": {"0000:3d:00.0", "0000:3f:00.0"},
+		}[resource+"/"+deviceID]
+	})
+
+	kubelet.SetPodResources(
+		testPod("crypto",
+			testContainer("app", testNamespace+"/cy2_dc0", "SSL_3"),
+			testContainer("sidecar", "gpu.example.com/gpu", "gpu0")),
+		testPod("pinned", testContainer("app", testNamespace+"/cy1_dc1", "PIN_1", "PIN_9")),
+	)
+
+	if err := tracker.Update(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	allocations, updated := tracker.Allocations()
+	if updated.IsZero() {
+		t.Error("update time not set")
+	}
+
+	expected := []Allocation{
+		{Resource: "cy1_dc1", DeviceID: "PIN_1", Namespace: "default", Pod: "pinned", Container: "app", Endpoints: []string{"0000:3d:00.0"}},
+		{Resource: "cy1_dc1", DeviceID: "PIN_9", Namespace: "default", Pod: "pinned", Container: "app"},
+		{Resource: "cy2_dc0", DeviceID: "SSL_3", Namespace: "default", Pod: "crypto", Container: "app", Endpoints: []string{"0000:3d:00.0", "0000:3f:00.0"}},
+	}
+
+	if !reflect.DeepEqual(allocations, expected) {
+		t.Errorf("expected allocations\n%+v\ngot\n%+v", expected, allocations)
+	}
+
+	if n := testutil.CollectAndCount(metrics.Allocations); n != len(expected) {
+		t.Errorf("expected %d allocation metrics, got %d", len(expected), n)
+	}
+
+	if v := testutil.ToFloat64(metrics.Allocations.WithLabelValues("cy2_dc0", "SSL_3", "0000:3d:00.0,0000:3f:00.0", "default")); v != 1 {
+		t.Errorf("expected the allocation metric of SSL_3 with its endpoints, got %v", v)
+	}
+
+	// Released devices disappear with the next update.
+	kubelet.SetPodResources()
+
+	if err := tracker.Update(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if allocations, _ := tracker.Allocations(); len(allocations) != 0 {
+		t.Errorf("expected no allocations, got %+v", allocations)
+	}
+
+	if n := testutil.CollectAndCount(metrics.Allocations); n != 0 {
+		t.Errorf("expected no allocation metrics, got %d", n)
+	}
+}
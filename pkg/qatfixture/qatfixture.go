@@ -0,0 +1,584 @@
+// Package qatfixture builds fake QAT hosts for testing the kernel mode plugin.
+// A host is a directory tree with the sysfs attributes, device nodes and
+// driver configuration files the plugin reads, and the adf_ctl status of the
+// same devices.
+package qatfixture
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/shuoyanshen/qat_plugin/pkg/hostroot"
+)
+
+// QAT PCI device IDs of the device types.
+var deviceIDs = map[string]string{
+	"dh895xcc":   "0435",
+	"dh895xccvf": "0443",
+	"c3xxx":      "19e2",
+	"c3xxxvf":    "19e3",
+	"c6xx":       "37c8",
+	"c6xxvf":     "37c9",
+	"d15xx":      "6f54",
+	"d15xxvf":    "6f55",
+	"4xxx":       "4940",
+	"4xxxvf":     "4941",
+}
+
+// Major numbers of the device nodes. The control nodes take consecutive
+// major numbers from controlMajor. The UIO minor numbers are the numbers in
+// the UIO device names, the VFIO minor numbers the IOMMU groups.
+const (
+	uioMajor     = 240
+	controlMajor = 241
+	vfioMajor    = 250
+	miscMajor    = 10
+	vfioMinor    = 196
+)
+
+// vfioPci is the driver of devices assigned to userspace through VFIO.
+const vfioPci = "vfio-pci"
+
+// controlNodes are the device nodes of the driver shared by all devices.
+var controlNodes = []string{"qat_adf_ctl", "qat_dev_processes", "usdm_drv"}
+
+// Device is a QAT PF or VF of the fake host.
+type Device struct {
+	// BDF is the PCI address with the domain, e.g. 0000:3d:00.0.
+	BDF string
+	// DevType is the device type as reported by adf_ctl, e.g. c6xx or 4xxxvf.
+	DevType string
+	// Driver is the driver the device is bound to. It defaults to DevType,
+	// Unbound leaves the device without a driver.
+	Driver  string
+	Unbound bool
+	// State is written to qat/state unless empty, as with pre-gen4 drivers.
+	// The adf_ctl status reports "up" for an empty State.
+	State string
+	// Services is written to qat/cfg_services unless empty, e.g. sym;dc
+	// for a gen4 PF.
+	Services string
+	// NUMANode is written to numa_node, LocalCPUList to local_cpulist.
+	NUMANode     int
+	LocalCPUList string
+	// UIO lists the names of the UIO devices of the device, e.g. uio0.
+	UIO []string
+	// PhysFn is the BDF of the PF of a VF.
+	PhysFn string
+	// TotalVFs is written to sriov_totalvfs of a PF. It defaults to the
+	// number of VFs of the PF.
+	TotalVFs int
+	// Conf is the content of the driver configuration file of the device.
+	// No file is written if it's empty.
+	Conf string
+}
+
+// Host is a fake QAT host rooted at a directory. With IOMMU enabled every
+// device is in its own IOMMU group, numbered by the order of the devices,
+// and the vfio-pci driver and VFIO device nodes exist.
+type Host struct {
+	Root    string
+	IOMMU   bool
+	Devices []Device
+
+	// charDevices is set by Build if the device nodes are character devices.
+	charDevices bool
+}
+
+// New returns an empty host rooted at root. Build creates the files.
+func New(root string) *Host {
+	return &Host{
+		Root: root,
+	}
+}
+
+// HostRoot returns the host root of the fake host.
+func (h *Host) HostRoot() hostroot.Root {
+	return hostroot.New(h.Root)
+}
+
+// SysfsDir returns the path of the fake sysfs.
+func (h *Host) SysfsDir() string {
+	return h.HostRoot().Sysfs
+}
+
+// ConfigDir returns the directory with the driver configuration files.
+func (h *Host) ConfigDir() string {
+	return filepath.Join(h.Root, "etc")
+}
+
+// DevDir returns the directory with the device nodes.
+func (h *Host) DevDir() string {
+	return h.HostRoot().Dev
+}
+
+// AddDevice adds a device to the host.
+func (h *Host) AddDevice(dev Device) *Host {
+	h.Devices = append(h.Devices, dev)
+	return h
+}
+
+// AddPF adds a PF with the UIO devices and configuration on the NUMA node.
+func (h *Host) AddPF(bdf, devType string, numaNode int, conf string, uio ...string) *Host {
+	return h.AddDevice(Device{
+		BDF:      bdf,
+		DevType:  devType,
+		NUMANode: numaNode,
+		UIO:      uio,
+		Conf:     conf,
+	})
+}
+
+// AddVF adds a VF of the PF. The VF inherits the NUMA node of the PF.
+func (h *Host) AddVF(bdf, pfBDF string, conf string, uio ...string) *Host {
+	dev := Device{
+		BDF:      bdf,
+		NUMANode: -1,
+		UIO:      uio,
+		PhysFn:   pfBDF,
+		Conf:     conf,
+	}
+
+	if pf := h.device(pfBDF); pf != nil {
+		dev.DevType = pf.DevType + "vf"
+		dev.NUMANode = pf.NUMANode
+		dev.LocalCPUList = pf.LocalCPUList
+	}
+
+	return h.AddDevice(dev)
+}
+
+// WithIOMMU enables the IOMMU of the host.
+func (h *Host) WithIOMMU() *Host {
+	h.IOMMU = true
+	return h
+}
+
+func (h *Host) device(bdf string) *Device {
+	for i := range h.Devices {
+		if h.Devices[i].BDF == bdf {
+			return &h.Devices[i]
+		}
+	}
+
+	return nil
+}
+
+// ordered returns the devices in the order the QAT driver probes them: PFs
+// followed by VFs, each in PCI address order. The index of a device is its
+// accelerator number, the N of qat_devN in the adf_ctl status.
+func (h *Host) ordered() []Device {
+	pfs := []Device{}
+	vfs := []Device{}
+
+	for _, dev := range h.Devices {
+		if strings.HasSuffix(dev.DevType, "vf") {
+			vfs = append(vfs, dev)
+		} else {
+			pfs = append(pfs, dev)
+		}
+	}
+
+	sort.Slice(pfs, func(i, j int) bool { return pfs[i].BDF < pfs[j].BDF })
+	sort.Slice(vfs, func(i, j int) bool { return vfs[i].BDF < vfs[j].BDF })
+
+	return append(pfs, vfs...)
+}
+
+// instanceIDs returns the instance IDs of the devices by PCI address. The
+// driver numbers the devices of each device type separately in probe order.
+func (h *Host) instanceIDs() map[string]int {
+	ids := map[string]int{}
+	next := map[string]int{}
+
+	for _, dev := range h.ordered() {
+		ids[dev.BDF] = next[dev.DevType]
+		next[dev.DevType]++
+	}
+
+	return ids
+}
+
+// IOMMUGroup returns the IOMMU group of the device or an empty string if
+// the IOMMU is disabled.
+func (h *Host) IOMMUGroup(bdf string) string {
+	if !h.IOMMU {
+		return ""
+	}
+
+	for i, dev := range h.Devices {
+		if dev.BDF == bdf {
+			return strconv.Itoa(i)
+		}
+	}
+
+	return ""
+}
+
+// ID returns the dev<N> ID the driver assigns to the device, N being the
+// instance ID reported by adf_ctl and used in the configuration file name.
+func (h *Host) ID(bdf string) string {
+	id, ok := h.instanceIDs()[bdf]
+	if !ok {
+		return ""
+	}
+
+	return fmt.Sprintf("dev%d", id)
+}
+
+// CharDevices returns true if Build created the device nodes as character
+// devices linked to their sysfs devices. This requires CAP_MKNOD, without it
+// the nodes are regular files and the topology of the devices is unknown.
+func (h *Host) CharDevices() bool {
+	return h.charDevices
+}
+
+// Build creates the files of the host.
+func (h *Host) Build() error {
+	sysfs := h.SysfsDir()
+
+	for _, dir := range []string{
+		filepath.Join(sysfs, "bus", "pci", "devices"),
+		filepath.Join(sysfs, "bus", "pci", "drivers"),
+		filepath.Join(sysfs, "class", "iommu"),
+		filepath.Join(sysfs, "class", "uio"),
+		filepath.Join(sysfs, "kernel", "iommu_groups"),
+		h.ConfigDir(),
+		h.DevDir(),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.Wrapf(err, "Can't create %s", dir)
+		}
+	}
+
+	h.charDevices = true
+
+	if h.IOMMU {
+		if err := h.buildIOMMU(); err != nil {
+			return err
+		}
+	}
+
+	for i, node := range controlNodes {
+		sysfsDev := filepath.Join(sysfs, "devices", "virtual", node, node)
+
+		if err := os.MkdirAll(sysfsDev, 0755); err != nil {
+			return errors.Wrapf(err, "Can't create %s", sysfsDev)
+		}
+
+		if err := h.mknod(node, controlMajor+uint32(i), 0, sysfsDev); err != nil {
+			return err
+		}
+	}
+
+	for _, dev := range h.ordered() {
+		if err := h.buildDevice(h.ID(dev.BDF), dev); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildIOMMU creates the IOMMU, the vfio-pci driver and the VFIO container
+// node.
+func (h *Host) buildIOMMU() error {
+	sysfs := h.SysfsDir()
+
+	if err := os.MkdirAll(filepath.Join(sysfs, "class", "iommu", "dmar0"), 0755); err != nil {
+		return errors.Wrap(err, "Can't create IOMMU")
+	}
+
+	if err := h.buildDriver(vfioPci); err != nil {
+		return err
+	}
+
+	sysfsDev := filepath.Join(sysfs, "devices", "virtual", "misc", "vfio")
+
+	if err := os.MkdirAll(sysfsDev, 0755); err != nil {
+		return errors.Wrapf(err, "Can't create %s", sysfsDev)
+	}
+
+	return h.mknod(filepath.Join("vfio", "vfio"), miscMajor, vfioMinor, sysfsDev)
+}
+
+// buildDriver creates the driver with its bind and unbind attributes.
+func (h *Host) buildDriver(driver string) error {
+	driverPath := filepath.Join(h.SysfsDir(), "bus", "pci", "drivers", driver)
+
+	for _, name := range []string{"bind", "unbind"} {
+		if err := writeFile(filepath.Join(driverPath, name), ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// buildIOMMUGroup puts the device into the IOMMU group and creates the VFIO
+// node of the group.
+func (h *Host) buildIOMMUGroup(group, bdf, devPath string) error {
+	groupPath := filepath.Join(h.SysfsDir(), "kernel", "iommu_groups", group)
+
+	if err := symlink(devPath, filepath.Join(groupPath, "devices", bdf)); err != nil {
+		return err
+	}
+
+	if err := symlink(groupPath, filepath.Join(devPath, "iommu_group")); err != nil {
+		return err
+	}
+
+	sysfsDev := filepath.Join(h.SysfsDir(), "devices", "virtual", "vfio", group)
+
+	if err := os.MkdirAll(sysfsDev, 0755); err != nil {
+		return errors.Wrapf(err, "Can't create %s", sysfsDev)
+	}
+
+	minor, err := strconv.ParseUint(group, 10, 32)
+	if err != nil {
+		return errors.Errorf("Bad IOMMU group %s", group)
+	}
+
+	return h.mknod(filepath.Join("vfio", group), vfioMajor, uint32(minor), sysfsDev)
+}
+
+// mknod creates the device node linked to the sysfs device through
+// /sys/dev/char. It falls back to a regular file if device nodes can't be
+// created.
+func (h *Host) mknod(name string, major, minor uint32, sysfsDev string) error {
+	path := filepath.Join(h.DevDir(), name)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "Can't create %s", filepath.Dir(path))
+	}
+
+	if h.charDevices {
+		err := unix.Mknod(path, unix.S_IFCHR|0600, int(unix.Mkdev(major, minor)))
+		if err == nil {
+			return symlink(sysfsDev, filepath.Join(h.SysfsDir(), "dev", "char", fmt.Sprintf("%d:%d", major, minor)))
+		}
+
+		if !errors.Is(err, unix.EPERM) {
+			return errors.Wrapf(err, "Can't create %s", path)
+		}
+
+		h.charDevices = false
+	}
+
+	return writeFile(path, "")
+}
+
+func (h *Host) devicePath(bdf string) string {
+	parts := strings.Split(bdf, ":")
+	return filepath.Join(h.SysfsDir(), "devices", "pci"+parts[0]+":"+parts[1], bdf)
+}
+
+func (h *Host) buildDevice(id string, dev Device) error {
+	deviceID, ok := deviceIDs[dev.DevType]
+	if !ok {
+		return errors.Errorf("Unknown device type %s", dev.DevType)
+	}
+
+	sysfs := h.SysfsDir()
+	devPath := h.devicePath(dev.BDF)
+
+	files := map[string]string{
+		"vendor":          "0x8086",
+		"device":          "0x" + deviceID,
+		"numa_node":       fmt.Sprintf("%d", dev.NUMANode),
+		"driver_override": "(null)",
+	}
+
+	if dev.LocalCPUList != "" {
+		files["local_cpulist"] = dev.LocalCPUList
+	}
+
+	if dev.State != "" {
+		files[filepath.Join("qat", "state")] = dev.State
+	}
+
+	if dev.Services != "" {
+		files[filepath.Join("qat", "cfg_services")] = dev.Services
+	}
+
+	if dev.PhysFn == "" {
+		numVFs := 0
+
+		for _, vf := range h.Devices {
+			if vf.PhysFn == dev.BDF {
+				if err := symlink(h.devicePath(vf.BDF), filepath.Join(devPath, fmt.Sprintf("virtfn%d", numVFs))); err != nil {
+					return err
+				}
+
+				numVFs++
+			}
+		}
+
+		totalVFs := dev.TotalVFs
+		if totalVFs < numVFs {
+			totalVFs = numVFs
+		}
+
+		files["sriov_numvfs"] = fmt.Sprintf("%d", numVFs)
+		files["sriov_totalvfs"] = fmt.Sprintf("%d", totalVFs)
+	} else if err := symlink(h.devicePath(dev.PhysFn), filepath.Join(devPath, "physfn")); err != nil {
+		return err
+	}
+
+	for name, content := range files {
+		if err := writeFile(filepath.Join(devPath, name), content+"\n"); err != nil {
+			return err
+		}
+	}
+
+	if err := symlink(devPath, filepath.Join(sysfs, "bus", "pci", "devices", dev.BDF)); err != nil {
+		return err
+	}
+
+	if !dev.Unbound {
+		driver := dev.Driver
+		if driver == "" {
+			driver = dev.DevType
+		}
+
+		driverPath := filepath.Join(sysfs, "bus", "pci", "drivers", driver)
+
+		if err := h.buildDriver(driver); err != nil {
+			return err
+		}
+
+		if err := symlink(driverPath, filepath.Join(devPath, "driver")); err != nil {
+			return err
+		}
+
+		if err := symlink(devPath, filepath.Join(driverPath, dev.BDF)); err != nil {
+			return err
+		}
+	}
+
+	if group := h.IOMMUGroup(dev.BDF); group != "" {
+		if err := h.buildIOMMUGroup(group, dev.BDF, devPath); err != nil {
+			return err
+		}
+	}
+
+	for _, uio := range dev.UIO {
+		uioPath := filepath.Join(devPath, "uio", uio)
+
+		if err := os.MkdirAll(uioPath, 0755); err != nil {
+			return errors.Wrapf(err, "Can't create %s", uioPath)
+		}
+
+		if err := symlink(uioPath, filepath.Join(sysfs, "class", "uio", uio)); err != nil {
+			return err
+		}
+
+		minor, err := strconv.ParseUint(strings.TrimPrefix(uio, "uio"), 10, 32)
+		if err != nil {
+			return errors.Errorf("Bad UIO device name %s", uio)
+		}
+
+		if err := h.mknod(uio, uioMajor, uint32(minor), uioPath); err != nil {
+			return err
+		}
+	}
+
+	if dev.Conf != "" {
+		if err := writeFile(filepath.Join(h.ConfigDir(), fmt.Sprintf("%s_%s.conf", dev.DevType, id)), dev.Conf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AdfCtlStatus returns the output of "adf_ctl status" for the devices.
+func (h *Host) AdfCtlStatus() string {
+	devices := h.ordered()
+	ids := h.instanceIDs()
+	lines := []string{fmt.Sprintf("There is %d QAT acceleration device(s) in the system:", len(devices))}
+
+	for i, dev := range devices {
+		state := dev.State
+		if state == "" {
+			state = "up"
+		}
+
+		lines = append(lines, fmt.Sprintf(" qat_dev%d - type: %s,  inst_id: %d,  node_id: %d,  bsf: %s,  #accel: 5 #engines: 10 state: %s",
+			i, dev.DevType, ids[dev.BDF], dev.NUMANode, dev.BDF, state))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Section is a section of a driver configuration file.
+type Section struct {
+	Name           string
+	NumProcesses   int
+	CyInstances    int
+	DcInstances    int
+	LimitDevAccess bool
+}
+
+// Conf returns a driver configuration file with the GENERAL and KERNEL
+// sections and the user space sections.
+func Conf(sections ...Section) string {
+	conf := []string{
+		"[GENERAL]",
+		"ServicesEnabled = cy;dc",
+		"ConfigVersion = 2",
+		"",
+		"[KERNEL]",
+		"NumberCyInstances = 0",
+		"NumberDcInstances = 0",
+	}
+
+	for _, s := range sections {
+		limitDevAccess := 0
+		if s.LimitDevAccess {
+			limitDevAccess = 1
+		}
+
+		conf = append(conf,
+			"",
+			"["+s.Name+"]",
+			fmt.Sprintf("NumberCyInstances = %d", s.CyInstances),
+			fmt.Sprintf("NumberDcInstances = %d", s.DcInstances),
+			fmt.Sprintf("NumProcesses = %d", s.NumProcesses),
+			fmt.Sprintf("LimitDevAccess = %d", limitDevAccess),
+		)
+	}
+
+	return strings.Join(conf, "\n") + "\n"
+}
+
+func writeFile(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "Can't create %s", filepath.Dir(path))
+	}
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return errors.Wrapf(err, "Can't write %s", path)
+	}
+
+	return nil
+}
+
+func symlink(target, link string) error {
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return errors.Wrapf(err, "Can't create %s", filepath.Dir(link))
+	}
+
+	if err := os.Symlink(target, link); err != nil {
+		return errors.Wrapf(err, "Can't link %s to %s", link, target)
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+// Package telemetry exports QAT device telemetry read from debugfs as
+// Prometheus metrics. Gen4 devices provide utilization, bandwidth and
+// latency samples in telemetry/device_data, all generations provide
+// firmware request counters per acceleration engine in fw_counters.
+package telemetry
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+)
+
+const (
+	namespace = "qat_plugin"
+	subsystem = "telemetry"
+
+	// telemetryOn is written to telemetry/control to start sampling. The
+	// device keeps sampling until "0" is written, which costs some device
+	// bandwidth, so sampling is started only on request.
+	telemetryOn = "1"
+)
+
+var (
+	deviceLabels = []string{"bdf", "devtype", "numa_node", "resources"}
+
+	upDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "up"),
+		"Whether telemetry of the device could be read.", deviceLabels, nil)
+
+	deviceDataDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "device_data"),
+		"Gen4 telemetry sample of the device, e.g. util_cpr0 or bw_in.", append(deviceLabels, "counter"), nil)
+
+	fwCountersDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "fw_counters_total"),
+		"Firmware counter of an acceleration engine of the device.", append(deviceLabels, "counter", "ae"), nil)
+
+	// | Firmware Requests [AE  0]:                   0 |
+	fwCounterRegex = regexp.MustCompile(`^\|\s*([A-Za-z ]+?)\s*\[AE\s*(\d+)\]:\s*(\d+)\s*\|$`)
+)
+
+// Device is a QAT device telemetry is collected for.
+type Device struct {
+	// BDF is the PCI address with the domain, e.g. 0000:3d:00.0.
+	BDF     string
+	DevType string
+	// NUMANode is the NUMA node of the device, -1 if unknown.
+	NUMANode int
+	// Resources are the names of the resources with slots on the device.
+	Resources []string
+}
+
+// Collector is a prometheus.Collector reading telemetry of the devices
+// on each scrape.
+type Collector struct {
+	debugfs       string
+	startSampling bool
+
+	mutex   sync.Mutex
+	devices []Device
+	// enabled holds the devices telemetry sampling was started for.
+	enabled map[string]bool
+}
+
+// NewCollector returns a collector reading debugfs mounted at debugfs. With
+// startSampling it starts telemetry sampling of gen4 devices where it's
+// stopped, otherwise sampling is left to the administrator.
+func NewCollector(debugfs string, startSampling bool) *Collector {
+	return &Collector{
+		debugfs:       debugfs,
+		startSampling: startSampling,
+		enabled:       map[string]bool{},
+	}
+}
+
+// deviceDir returns the debugfs directory of the device, e.g. qat_4xxx_0000:3d:00.0.
+func (c *Collector) deviceDir(dev Device) string {
+	return filepath.Join(c.debugfs, "qat_"+dev.DevType+"_"+dev.BDF)
+}
+
+// SetDevices replaces the devices to collect telemetry for and starts
+// telemetry sampling of gen4 devices where it's stopped if requested.
+func (c *Collector) SetDevices(devices []Device) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.devices = devices
+
+	if !c.startSampling {
+		return
+	}
+
+	for _, dev := range devices {
+		if c.enabled[dev.BDF] {
+			continue
+		}
+
+		control := filepath.Join(c.deviceDir(dev), "telemetry", "control")
+
+		state, err := os.ReadFile(control)
+		if err != nil {
+			// Telemetry isn't supported by the device or the driver.
+			continue
+		}
+
+		if string(bytes.TrimSpace(state)) == "0" {
+			if err := os.WriteFile(control, []byte(telemetryOn), 0600); err != nil {
+				klog.Warningf("Failed to start telemetry of %s: %v", dev.BDF, err)
+				continue
+			}
+
+			klog.V(1).Infof("Started telemetry of %s", dev.BDF)
+		}
+
+		c.enabled[dev.BDF] = true
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upDesc
+	ch <- deviceDataDesc
+	ch <- fwCountersDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	devices := c.devices
+	c.mutex.Unlock()
+
+	for _, dev := range devices {
+		labels := []string{dev.BDF, dev.DevType, strconv.Itoa(dev.NUMANode), strings.Join(dev.Resources, ",")}
+		dir := c.deviceDir(dev)
+		up := 0.0
+
+		if data, err := readDeviceData(filepath.Join(dir, "telemetry", "device_data")); err == nil {
+			up = 1
+
+			for _, name := range sortedKeys(data) {
+				ch <- prometheus.MustNewConstMetric(deviceDataDesc, prometheus.GaugeValue, data[name], append(labels, name)...)
+			}
+		} else if !os.IsNotExist(errors.Cause(err)) {
+			klog.V(4).Infof("Can't read telemetry of %s: %v", dev.BDF, err)
+		}
+
+		if counters, err := readFwCounters(filepath.Join(dir, "fw_counters")); err == nil {
+			up = 1
+
+			for _, counter := range counters {
+				ch <- prometheus.MustNewConstMetric(fwCountersDesc, prometheus.CounterValue, counter.value, append(labels, counter.name, counter.ae)...)
+			}
+		} else if !os.IsNotExist(errors.Cause(err)) {
+			klog.V(4).Infof("Can't read firmware counters of %s: %v", dev.BDF, err)
+		}
+
+		ch <- prometheus.MustNewConstMetric(upDesc, prometheus.GaugeValue, up, labels...)
+	}
+}
+
+// readDeviceData parses "name value" lines of the gen4 telemetry samples.
+// Lines without a numeric value are skipped.
+func readDeviceData(path string) (map[string]float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't read %s", path)
+	}
+
+	values := map[string]float64{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+
+		values[fields[0]] = value
+	}
+
+	return values, nil
+}
+
+type fwCounter struct {
+	name  string
+	ae    string
+	value float64
+}
+
+// readFwCounters parses the firmware counter table, e.g.
+//
+//	| Firmware Requests [AE  0]:                   0 |
+//
+// gives the counter firmware_requests of AE 0.
+func readFwCounters(path string) ([]fwCounter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't read %s", path)
+	}
+
+	counters := []fwCounter{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		matches := fwCounterRegex.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if matches == nil {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(matches[3], 64)
+		if err != nil {
+			continue
+		}
+
+		counters = append(counters, fwCounter{
+			name:  strings.ToLower(strings.Join(strings.Fields(matches[1]), "_")),
+			ae:    matches[2],
+			value: value,
+		})
+	}
+
+	return counters, nil
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,192 @@
+package telemetry
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadDeviceData(t *testing.T) {
+	tcases := []struct {
+		name     string
+		data     string
+		expected map[string]float64
+	}{
+		{
+			name: "4xxx samples",
+			data: `sample_cnt 2458
+pci_trans_cnt 1024
+max_rd_lat 1350
+rd_lat_acc_avg 512
+bw_in 5
+bw_out 3
+util_cpr0 12
+exec_cpr0 40
+util_ath1 0
+`,
+			expected: map[string]float64{
+				"sample_cnt":     2458,
+				"pci_trans_cnt":  1024,
+				"max_rd_lat":     1350,
+				"rd_lat_acc_avg": 512,
+				"bw_in":          5,
+				"bw_out":         3,
+				"util_cpr0":      12,
+				"exec_cpr0":      40,
+				"util_ath1":      0,
+			},
+		},
+		{
+			name: "malformed lines",
+			data: `sample_cnt 10
+
+util_cpr0 n/a
+bw_in 1 2
+   bw_out    7
+`,
+			expected: map[string]float64{"sample_cnt": 10, "bw_out": 7},
+		},
+		{
+			name:     "empty",
+			expected: map[string]float64{},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "device_data")
+			writeFile(t, path, tc.data)
+
+			values, err := readDeviceData(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(values, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, values)
+			}
+		})
+	}
+}
+
+func TestReadFwCounters(t *testing.T) {
+	tcases := []struct {
+		name     string
+		data     string
+		expected []fwCounter
+	}{
+		{
+			name: "c6xx counters",
+			data: `+------------------------------------------------+
+| FW Statistics for Qat Device                   |
++------------------------------------------------+
+| Firmware Requests [AE  0]:                  12 |
++------------------------------------------------+
+| Firmware Responses[AE  0]:                  11 |
++------------------------------------------------+
+| Firmware Requests [AE 10]:             4294967 |
++------------------------------------------------+
+| Firmware Responses[AE 10]:             4294967 |
++------------------------------------------------+
+`,
+			expected: []fwCounter{
+				{name: "firmware_requests", ae: "0", value: 12},
+				{name: "firmware_responses", ae: "0", value: 11},
+				{name: "firmware_requests", ae: "10", value: 4294967},
+				{name: "firmware_responses", ae: "10", value: 4294967},
+			},
+		},
+		{
+			name: "4xxx counters with RAS errors",
+			data: `+------------------------------------------------+
+| FW Statistics for Qat Device                   |
++------------------------------------------------+
+| Firmware Requests [AE  0]:                   5 |
++------------------------------------------------+
+| Firmware Responses[AE  0]:                   5 |
++------------------------------------------------+
+| RAS Events                                     |
++------------------------------------------------+
+| Correctable Errors:                          0 |
++------------------------------------------------+
+`,
+			expected: []fwCounter{
+				{name: "firmware_requests", ae: "0", value: 5},
+				{name: "firmware_responses", ae: "0", value: 5},
+			},
+		},
+		{
+			name: "malformed lines",
+			data: `| Firmware Requests [AE  x]:                   5 |
+| Firmware Requests [AE  1]:                     |
+| Firmware Requests [AE  2]:                   7
+  | Firmware Requests [AE  3]:                   9 |
+`,
+			expected: []fwCounter{
+				{name: "firmware_requests", ae: "3", value: 9},
+			},
+		},
+		{
+			name:     "empty",
+			expected: []fwCounter{},
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fw_counters")
+			writeFile(t, path, tc.data)
+
+			counters, err := readFwCounters(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(counters, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, counters)
+			}
+		})
+	}
+}
+
+func TestSetDevicesStartsSampling(t *testing.T) {
+	dev := Device{BDF: "0000:6b:00.0", DevType: "4xxx"}
+
+	for _, start := range []bool{false, true} {
+		debugfs := t.TempDir()
+		collector := NewCollector(debugfs, start)
+		control := filepath.Join(collector.deviceDir(dev), "telemetry", "control")
+
+		writeFile(t, control, "0\n")
+
+		collector.SetDevices([]Device{dev})
+
+		data, err := os.ReadFile(control)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "0"
+		if start {
+			expected = telemetryOn
+		}
+
+		if state := strings.TrimSpace(string(data)); state != expected {
+			t.Errorf("startSampling=%t: expected control %q, got %q", start, expected, state)
+		}
+	}
+}
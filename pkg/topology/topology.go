@@ -12,11 +12,8 @@ import (
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 	pluginapi "k8s.io/kubelet/pkg/apis/deviceplugin/v1beta1"
-)
 
-// Path to the directory to mock in tests.
-var (
-	mockRoot = ""
+	"github.com/shuoyanshen/qat_plugin/pkg/hostroot"
 )
 
 const (
@@ -36,8 +33,8 @@ type Hint struct {
 // Hints represents set of hints collected from multiple providers.
 type Hints map[string]Hint
 
-func getDevicesFromVirtual(realDevPath string) (devs []string, err error) {
-	relPath, err := filepath.Rel("/sys/devices/virtual", realDevPath)
+func getDevicesFromVirtual(root hostroot.Root, realDevPath string) (devs []string, err error) {
+	relPath, err := filepath.Rel(root.Sys("devices", "virtual"), realDevPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to find relative path")
 	}
@@ -49,7 +46,7 @@ func getDevicesFromVirtual(realDevPath string) (devs []string, err error) {
 	dir, file := filepath.Split(relPath)
 	switch dir {
 	case "vfio/":
-		iommuGroup := filepath.Join(mockRoot, "/sys/kernel/iommu_groups", file, "devices")
+		iommuGroup := root.Sys("kernel", "iommu_groups", file, "devices")
 
 		files, err := os.ReadDir(iommuGroup)
 		if err != nil {
@@ -71,7 +68,7 @@ func getDevicesFromVirtual(realDevPath string) (devs []string, err error) {
 	}
 }
 
-func getTopologyHint(sysFSPath string) (*Hint, error) {
+func getTopologyHint(root hostroot.Root, sysFSPath string) (*Hint, error) {
 	hint := Hint{Provider: sysFSPath}
 	fileMap := map[string]*string{
 		"local_cpulist": &hint.CPUs,
@@ -91,7 +88,7 @@ func getTopologyHint(sysFSPath string) (*Hint, error) {
 	if hint.NUMAs != "" && hint.CPUs == "" {
 		// broken topology hint. BIOS reports socket id as NUMA node
 		// First, try to get hints from parent device or bus.
-		parentHints, er := NewTopologyHints(filepath.Dir(sysFSPath))
+		parentHints, er := NewTopologyHints(root, filepath.Dir(sysFSPath))
 		if er == nil {
 			cpulist := map[string]bool{}
 			numalist := map[string]bool{}
@@ -125,8 +122,8 @@ func getTopologyHint(sysFSPath string) (*Hint, error) {
 }
 
 // NewTopologyHints return array of hints for the main device and its
-// dependend devices (e.g. RAID).
-func NewTopologyHints(devPath string) (hints Hints, err error) {
+// dependend devices (e.g. RAID). devPath is a sysfs path under the root.
+func NewTopologyHints(root hostroot.Root, devPath string) (hints Hints, err error) {
 	hints = make(Hints)
 
 	realDevPath, err := filepath.EvalSymlinks(devPath)
@@ -134,8 +131,8 @@ func NewTopologyHints(devPath string) (hints Hints, err error) {
 		return nil, errors.Wrapf(err, "failed get realpath for %s", devPath)
 	}
 
-	for p := realDevPath; strings.HasPrefix(p, mockRoot+"/sys/devices/"); p = filepath.Dir(p) {
-		hint, er := getTopologyHint(p)
+	for p := realDevPath; strings.HasPrefix(p, root.Sys("devices")+"/"); p = filepath.Dir(p) {
+		hint, er := getTopologyHint(root, p)
 		if er != nil {
 			return nil, er
 		}
@@ -146,11 +143,11 @@ func NewTopologyHints(devPath string) (hints Hints, err error) {
 		}
 	}
 
-	fromVirtual, _ := getDevicesFromVirtual(realDevPath)
+	fromVirtual, _ := getDevicesFromVirtual(root, realDevPath)
 	deps, _ := filepath.Glob(filepath.Join(realDevPath, "slaves/*"))
 
 	for _, device := range append(deps, fromVirtual...) {
-		deviceHints, er := NewTopologyHints(device)
+		deviceHints, er := NewTopologyHints(root, device)
 		if er != nil {
 			return nil, er
 		}
@@ -206,7 +203,10 @@ func (h *Hint) String() string {
 // this function returns physical device where this inode resides (storage device).
 // If result device is a virtual one (e.g. tmpfs), error will be returned.
 // For non-existing path, no error returned and path is empty.
-func FindSysFsDevice(dev string) (string, error) {
+// dev is a host path which is looked up under the root, as is the returned sysfs path.
+func FindSysFsDevice(root hostroot.Root, dev string) (string, error) {
+	dev = root.DevPath(dev)
+
 	fi, err := os.Stat(dev)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -234,14 +234,14 @@ func FindSysFsDevice(dev string) (string, error) {
 		return "", errors.Errorf("%s is a virtual device node", dev)
 	}
 
-	devPath := fmt.Sprintf("/sys/dev/%s/%d:%d", devType, major, minor)
+	devPath := root.Sys("dev", devType, fmt.Sprintf("%d:%d", major, minor))
 
 	realDevPath, err := filepath.EvalSymlinks(devPath)
 	if err != nil {
 		return "", errors.Wrapf(err, "failed get realpath for %s", devPath)
 	}
 
-	return filepath.Join(mockRoot, realDevPath), nil
+	return realDevPath, nil
 }
 
 // readFilesInDirectory small helper to fill struct with content from sysfs entry.
@@ -275,15 +275,15 @@ func mapKeys(m map[string]bool) []string {
 	return ret
 }
 
-// GetTopologyInfo returns topology information for the list of device nodes.
-//                        devPaths
-func GetTopologyInfo(devs []string) (*pluginapi.TopologyInfo, error) {
+// GetTopologyInfo returns topology information for the list of host device
+// nodes looked up under the root.
+func GetTopologyInfo(root hostroot.Root, devs []string) (*pluginapi.TopologyInfo, error) {
 	var result pluginapi.TopologyInfo
 
 	nodeIDs := map[int64]struct{}{}
 
 	for _, dev := range devs {
-		sysfsDevice, err := FindSysFsDevice(dev)
+		sysfsDevice, err := FindSysFsDevice(root, dev)
 		if err != nil {
 			return nil, err
 		}
@@ -292,7 +292,7 @@ func GetTopologyInfo(devs []string) (*pluginapi.TopologyInfo, error) {
 			return nil, errors.Errorf("device %s doesn't exist", dev)
 		}
 
-		hints, err := NewTopologyHints(sysfsDevice)
+		hints, err := NewTopologyHints(root, sysfsDevice)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,92 @@
+// Package uevent receives kernel uevents over netlink.
+package uevent
+
+import (
+	"bytes"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Size of the receive buffer. A single uevent is limited to a few kilobytes.
+const bufSize = 64 * 1024
+
+// Event is a kernel uevent.
+type Event struct {
+	Action  string
+	DevPath string
+	Env     map[string]string
+}
+
+// Listener receives kernel uevents broadcast over netlink.
+type Listener struct {
+	file *os.File
+	buf  []byte
+}
+
+// NewListener subscribes to kernel uevents.
+func NewListener() (*Listener, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can't create uevent socket")
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		_ = unix.Close(fd)
+		return nil, errors.Wrap(err, "Can't bind uevent socket")
+	}
+
+	// A non-blocking descriptor makes the file pollable so that Close
+	// interrupts a pending Read.
+	return &Listener{
+		file: os.NewFile(uintptr(fd), "uevent"),
+		buf:  make([]byte, bufSize),
+	}, nil
+}
+
+// Read blocks until the next uevent is received or the listener is closed.
+func (l *Listener) Read() (*Event, error) {
+	for {
+		n, err := l.file.Read(l.buf)
+		if err != nil {
+			return nil, errors.Wrap(err, "Can't read uevent")
+		}
+
+		if ev := parse(l.buf[:n]); ev != nil {
+			return ev, nil
+		}
+	}
+}
+
+// Close stops receiving uevents.
+func (l *Listener) Close() error {
+	return l.file.Close()
+}
+
+// parse parses a kernel uevent of the form "ACTION@DEVPATH\0KEY=VALUE\0...".
+// Messages sent by udev and other malformed messages are ignored.
+func parse(msg []byte) *Event {
+	fields := bytes.Split(msg, []byte{0})
+
+	header := strings.SplitN(string(fields[0]), "@", 2)
+	if len(header) != 2 {
+		return nil
+	}
+
+	ev := &Event{
+		Action:  header[0],
+		DevPath: header[1],
+		Env:     make(map[string]string),
+	}
+
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(string(field), "=", 2)
+		if len(kv) == 2 {
+			ev.Env[kv[0]] = kv[1]
+		}
+	}
+
+	return ev
+}
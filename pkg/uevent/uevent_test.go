@@ -0,0 +1,54 @@
+package uevent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tcases := []struct {
+		name     string
+		msg      string
+		expected *Event
+	}{
+		{
+			name: "kernel uevent",
+			msg:  "bind@/devices/pci0000:3d/0000:3d:01.0\x00ACTION=bind\x00SUBSYSTEM=pci\x00DRIVER=c6xxvf\x00PCI_ID=8086:37C9\x00",
+			expected: &Event{
+				Action:  "bind",
+				DevPath: "/devices/pci0000:3d/0000:3d:01.0",
+				Env: map[string]string{
+					"ACTION":    "bind",
+					"SUBSYSTEM": "pci",
+					"DRIVER":    "c6xxvf",
+					"PCI_ID":    "8086:37C9",
+				},
+			},
+		},
+		{
+			name: "value with =",
+			msg:  "change@/devices/virtual/misc/foo\x00KEY=a=b\x00MALFORMED\x00",
+			expected: &Event{
+				Action:  "change",
+				DevPath: "/devices/virtual/misc/foo",
+				Env:     map[string]string{"KEY": "a=b"},
+			},
+		},
+		{
+			name: "udev message",
+			msg:  "libudev\x00\xfe\xed\xca\xfeACTION=add\x00",
+		},
+		{
+			name: "empty message",
+			msg:  "",
+		},
+	}
+
+	for _, tc := range tcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if ev := parse([]byte(tc.msg)); !reflect.DeepEqual(ev, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, ev)
+			}
+		})
+	}
+}